@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,6 +32,25 @@ var (
 	errUnsuccessfulAuth = errors.New("Unsuccessful authorization. No attempted principals were able to perform the requested operation")
 )
 
+// ErrPendingApproval is returned, wrapped with the ID of the pending change,
+// when the server holds a change for approval by a second admin instead of
+// applying it.
+var ErrPendingApproval = errors.New("change submitted for approval by a second admin")
+
+// pendingErr reports a change that the server held for approval. The server
+// returns the pending change as the response data; changes that were applied
+// return no data.
+func pendingErr(data json.RawMessage) error {
+	if len(data) == 0 || data[0] != '{' {
+		return nil
+	}
+	var pending PendingChange
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w as pending change %s", ErrPendingApproval, pending.ID)
+}
+
 // Client is an interface for interacting with a specific knox key
 type Client interface {
 	// GetPrimary returns the primary key version for the knox key.
@@ -194,6 +214,22 @@ type APIClient interface {
 	GetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	CacheGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	NetworkGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
+	BreakGlass(keyID, justification string) (*BreakGlassGrant, error)
+	GetPendingChanges() ([]PendingChange, error)
+	ApprovePendingChange(changeID string) error
+	RejectPendingChange(changeID string) error
+	GetEffectiveAccess(keyID string) ([]EffectiveGrant, error)
+	GetPrincipalAccess(principal string, principalType PrincipalType, groups []string) ([]PrincipalKeyAccess, error)
+	ExplainAccess(keyID string, accessType AccessType, principal string, principalType PrincipalType, groups []string) (*AuthorizationExplanation, error)
+	AuditMachinePrefixes() ([]MachinePrefixFinding, error)
+	GetOrphanedKeys() ([]OrphanedKey, error)
+	CreateAPIKey(name, team string, ttl time.Duration) (*APIKeyInfo, error)
+	GetAPIKeys(team string) ([]APIKeyInfo, error)
+	RevokeAPIKey(apiKeyID string) error
+	CreateSession() (*SessionToken, error)
+	RevokeSession(sessionID string) error
+	EnrollTOTP() (*TOTPEnrollment, error)
+	EnrollUserTOTP(userID string) (*TOTPEnrollment, error)
 }
 
 type HTTP interface {
@@ -212,6 +248,37 @@ type HTTPClient struct {
 // for the request. clientOverride is useful when using multiple TLS certs as different auth handlers.
 type AuthHandler func() (authToken string, authType string, clientOverride HTTP)
 
+// Authorization schemes understood by the Knox server in addition to the
+// legacy two byte prefixes, such as "0u", of the Authorization header.
+const (
+	BearerScheme     = "Bearer"
+	GitHubScheme     = "Knox-GitHub"
+	MachineScheme    = "Knox-Machine"
+	SpiffeScheme     = "Knox-Spiffe"
+	APIKeyScheme     = "Knox-API-Key"
+	SessionScheme    = "Knox-Session"
+	SSHScheme        = "Knox-SSH"
+	KubernetesScheme = "Knox-Kubernetes"
+)
+
+// Authorization builds an Authorization header value from a scheme and credentials.
+func Authorization(scheme, credentials string) string {
+	return scheme + " " + credentials
+}
+
+// NewSchemeAuthHandler returns an AuthHandler that sends the credentials
+// returned by getCredentials with the given Authorization scheme. It is
+// skipped when getCredentials returns an empty string.
+func NewSchemeAuthHandler(scheme, authType string, getCredentials func() string) AuthHandler {
+	return func() (string, string, HTTP) {
+		credentials := getCredentials()
+		if credentials == "" {
+			return "", "", nil
+		}
+		return Authorization(scheme, credentials), authType, nil
+	}
+}
+
 // NewClient creates a new client to connect to talk to Knox.
 // NOTE: passing multiple authHandlers can cause severe performance issues, use with caution.
 func NewClient(host string, client HTTP, authHandlers []AuthHandler, keyFolder, version string) APIClient {
@@ -357,6 +424,87 @@ func (c *HTTPClient) UpdateVersion(keyID, versionID string, status VersionStatus
 	return c.UncachedClient.UpdateVersion(keyID, versionID, status)
 }
 
+// BreakGlass requests emergency read access to a key with the given justification.
+func (c *HTTPClient) BreakGlass(keyID, justification string) (*BreakGlassGrant, error) {
+	return c.UncachedClient.BreakGlass(keyID, justification)
+}
+
+// GetPendingChanges lists changes to sensitive keys that are awaiting approval.
+func (c *HTTPClient) GetPendingChanges() ([]PendingChange, error) {
+	return c.UncachedClient.GetPendingChanges()
+}
+
+// ApprovePendingChange approves and applies a pending change.
+func (c *HTTPClient) ApprovePendingChange(changeID string) error {
+	return c.UncachedClient.ApprovePendingChange(changeID)
+}
+
+// RejectPendingChange discards a pending change.
+func (c *HTTPClient) RejectPendingChange(changeID string) error {
+	return c.UncachedClient.RejectPendingChange(changeID)
+}
+
+// GetEffectiveAccess explains each entry in the ACL of a key.
+func (c *HTTPClient) GetEffectiveAccess(keyID string) ([]EffectiveGrant, error) {
+	return c.UncachedClient.GetEffectiveAccess(keyID)
+}
+
+// GetPrincipalAccess lists the keys a principal can access and the ACL entries responsible.
+func (c *HTTPClient) GetPrincipalAccess(principal string, principalType PrincipalType, groups []string) ([]PrincipalKeyAccess, error) {
+	return c.UncachedClient.GetPrincipalAccess(principal, principalType, groups)
+}
+
+// ExplainAccess explains whether a principal would be granted access to a key.
+// If principal is empty the caller's own identity is evaluated.
+func (c *HTTPClient) ExplainAccess(keyID string, accessType AccessType, principal string, principalType PrincipalType, groups []string) (*AuthorizationExplanation, error) {
+	return c.UncachedClient.ExplainAccess(keyID, accessType, principal, principalType, groups)
+}
+
+// AuditMachinePrefixes reports MachinePrefix entries that match unintended hosts.
+func (c *HTTPClient) AuditMachinePrefixes() ([]MachinePrefixFinding, error) {
+	return c.UncachedClient.AuditMachinePrefixes()
+}
+
+// GetOrphanedKeys lists keys that no user or user group can administer.
+func (c *HTTPClient) GetOrphanedKeys() ([]OrphanedKey, error) {
+	return c.UncachedClient.GetOrphanedKeys()
+}
+
+// CreateAPIKey issues an API key owned by team. A zero ttl never expires.
+func (c *HTTPClient) CreateAPIKey(name, team string, ttl time.Duration) (*APIKeyInfo, error) {
+	return c.UncachedClient.CreateAPIKey(name, team, ttl)
+}
+
+// GetAPIKeys lists the API keys of the caller's teams, or of team if set.
+func (c *HTTPClient) GetAPIKeys(team string) ([]APIKeyInfo, error) {
+	return c.UncachedClient.GetAPIKeys(team)
+}
+
+// RevokeAPIKey revokes an API key.
+func (c *HTTPClient) RevokeAPIKey(apiKeyID string) error {
+	return c.UncachedClient.RevokeAPIKey(apiKeyID)
+}
+
+// CreateSession exchanges the client's credentials for a session token.
+func (c *HTTPClient) CreateSession() (*SessionToken, error) {
+	return c.UncachedClient.CreateSession()
+}
+
+// RevokeSession revokes a session token.
+func (c *HTTPClient) RevokeSession(sessionID string) error {
+	return c.UncachedClient.RevokeSession(sessionID)
+}
+
+// EnrollTOTP replaces the TOTP second factor of the user.
+func (c *HTTPClient) EnrollTOTP() (*TOTPEnrollment, error) {
+	return c.UncachedClient.EnrollTOTP()
+}
+
+// EnrollUserTOTP enrolls a new TOTP second factor for another user.
+func (c *HTTPClient) EnrollUserTOTP(userID string) (*TOTPEnrollment, error) {
+	return c.UncachedClient.EnrollUserTOTP(userID)
+}
+
 func (c *HTTPClient) getClient() (HTTP, error) {
 	if c.UncachedClient.DefaultClient == nil {
 		c.UncachedClient.DefaultClient = &http.Client{}
@@ -372,12 +520,15 @@ func (c *HTTPClient) getHTTPData(method string, path string, body url.Values, da
 type UncachedHTTPClient struct {
 	// Host is used as the host for http connections
 	Host string
-	//AuthHandlers contains a list of auth handlers which return the authorization string for authenticating to knox. Users should be prefixed by 0u, machines by 0m. On fail, return empty string.
+	//AuthHandlers contains a list of auth handlers which return the authorization string for authenticating to knox, either "<scheme> <credentials>" or prefixed by 0u for users and 0t for machines. On fail, return empty string.
 	AuthHandlers []AuthHandler
 	// DefaultClient is the http client for making network calls
 	DefaultClient HTTP
 	// Version is the current client version, useful for debugging and sent as a header
 	Version string
+	// StepUpPrompt, if set, is asked for a second factor code when the server
+	// requires one for an operation, and the request is then repeated with it.
+	StepUpPrompt func() (string, error)
 }
 
 // NewUncachedClient creates a new uncached client to connect to talk to Knox.
@@ -499,8 +650,11 @@ func (c *UncachedHTTPClient) PutAccess(keyID string, a ...Access) error {
 		return err
 	}
 	d.Set("acl", string(s))
-	err = c.getHTTPData("PUT", "/v0/keys/"+keyID+"/access/", d, nil)
-	return err
+	var pending json.RawMessage
+	if err := c.getHTTPData("PUT", "/v0/keys/"+keyID+"/access/", d, &pending); err != nil {
+		return err
+	}
+	return pendingErr(pending)
 }
 
 // AddVersion adds a key version to a specific key.
@@ -521,8 +675,155 @@ func (c *UncachedHTTPClient) UpdateVersion(keyID, versionID string, status Versi
 	}
 	d.Set("status", string(s))
 
-	err = c.getHTTPData("PUT", "/v0/keys/"+keyID+"/versions/"+versionID+"/", d, nil)
-	return err
+	var pending json.RawMessage
+	if err := c.getHTTPData("PUT", "/v0/keys/"+keyID+"/versions/"+versionID+"/", d, &pending); err != nil {
+		return err
+	}
+	return pendingErr(pending)
+}
+
+// BreakGlass requests emergency read access to a key with the given justification.
+func (c *UncachedHTTPClient) BreakGlass(keyID, justification string) (*BreakGlassGrant, error) {
+	grant := &BreakGlassGrant{}
+	d := url.Values{}
+	d.Set("justification", justification)
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/breakglass/", d, grant)
+	return grant, err
+}
+
+// GetPendingChanges lists changes to sensitive keys that are awaiting approval.
+func (c *UncachedHTTPClient) GetPendingChanges() ([]PendingChange, error) {
+	var l []PendingChange
+	err := c.getHTTPData("GET", "/v0/pending/", nil, &l)
+	return l, err
+}
+
+// ApprovePendingChange approves and applies a pending change.
+func (c *UncachedHTTPClient) ApprovePendingChange(changeID string) error {
+	return c.getHTTPData("POST", "/v0/pending/"+changeID+"/approve/", url.Values{}, nil)
+}
+
+// RejectPendingChange discards a pending change.
+func (c *UncachedHTTPClient) RejectPendingChange(changeID string) error {
+	return c.getHTTPData("POST", "/v0/pending/"+changeID+"/reject/", url.Values{}, nil)
+}
+
+// GetEffectiveAccess explains each entry in the ACL of a key.
+func (c *UncachedHTTPClient) GetEffectiveAccess(keyID string) ([]EffectiveGrant, error) {
+	var l []EffectiveGrant
+	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/access/effective/", nil, &l)
+	return l, err
+}
+
+// GetPrincipalAccess lists the keys a principal can access and the ACL entries responsible.
+func (c *UncachedHTTPClient) GetPrincipalAccess(principal string, principalType PrincipalType, groups []string) ([]PrincipalKeyAccess, error) {
+	t, err := principalType.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("principal", principal)
+	d.Set("type", strings.Trim(string(t), `"`))
+	if len(groups) > 0 {
+		d.Set("groups", strings.Join(groups, ","))
+	}
+	var l []PrincipalKeyAccess
+	err = c.getHTTPData("GET", "/v0/access/?"+d.Encode(), nil, &l)
+	return l, err
+}
+
+// ExplainAccess explains whether a principal would be granted access to a key.
+// If principal is empty the caller's own identity is evaluated.
+func (c *UncachedHTTPClient) ExplainAccess(keyID string, accessType AccessType, principal string, principalType PrincipalType, groups []string) (*AuthorizationExplanation, error) {
+	a, err := accessType.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("access", strings.Trim(string(a), `"`))
+	if principal != "" {
+		t, err := principalType.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		d.Set("principal", principal)
+		d.Set("type", strings.Trim(string(t), `"`))
+		if len(groups) > 0 {
+			d.Set("groups", strings.Join(groups, ","))
+		}
+	}
+	explanation := &AuthorizationExplanation{}
+	err = c.getHTTPData("GET", "/v0/keys/"+keyID+"/authorization/?"+d.Encode(), nil, explanation)
+	return explanation, err
+}
+
+// AuditMachinePrefixes reports MachinePrefix entries that match unintended hosts.
+func (c *UncachedHTTPClient) AuditMachinePrefixes() ([]MachinePrefixFinding, error) {
+	var l []MachinePrefixFinding
+	err := c.getHTTPData("GET", "/v0/audit/machineprefixes/", nil, &l)
+	return l, err
+}
+
+// GetOrphanedKeys lists keys that no user or user group can administer.
+func (c *UncachedHTTPClient) GetOrphanedKeys() ([]OrphanedKey, error) {
+	var l []OrphanedKey
+	err := c.getHTTPData("GET", "/v0/audit/orphanedkeys/", nil, &l)
+	return l, err
+}
+
+// CreateAPIKey issues an API key owned by team. A zero ttl never expires.
+func (c *UncachedHTTPClient) CreateAPIKey(name, team string, ttl time.Duration) (*APIKeyInfo, error) {
+	key := &APIKeyInfo{}
+	d := url.Values{}
+	d.Set("name", name)
+	d.Set("team", team)
+	if ttl > 0 {
+		d.Set("ttl", ttl.String())
+	}
+	err := c.getHTTPData("POST", "/v0/apikeys/", d, key)
+	return key, err
+}
+
+// GetAPIKeys lists the API keys of the caller's teams, or of team if set.
+func (c *UncachedHTTPClient) GetAPIKeys(team string) ([]APIKeyInfo, error) {
+	var l []APIKeyInfo
+	path := "/v0/apikeys/"
+	if team != "" {
+		path += "?team=" + url.QueryEscape(team)
+	}
+	err := c.getHTTPData("GET", path, nil, &l)
+	return l, err
+}
+
+// RevokeAPIKey revokes an API key.
+func (c *UncachedHTTPClient) RevokeAPIKey(apiKeyID string) error {
+	return c.getHTTPData("DELETE", "/v0/apikeys/"+apiKeyID+"/", nil, nil)
+}
+
+// CreateSession exchanges the client's credentials for a session token.
+func (c *UncachedHTTPClient) CreateSession() (*SessionToken, error) {
+	session := &SessionToken{}
+	err := c.getHTTPData("POST", "/v0/sessions/", url.Values{}, session)
+	return session, err
+}
+
+// RevokeSession revokes a session token.
+func (c *UncachedHTTPClient) RevokeSession(sessionID string) error {
+	return c.getHTTPData("DELETE", "/v0/sessions/"+sessionID+"/", nil, nil)
+}
+
+// EnrollTOTP replaces the TOTP second factor of the user.
+func (c *UncachedHTTPClient) EnrollTOTP() (*TOTPEnrollment, error) {
+	enrollment := &TOTPEnrollment{}
+	err := c.getHTTPData("POST", "/v0/totp/", url.Values{}, enrollment)
+	return enrollment, err
+}
+
+// EnrollUserTOTP enrolls a new TOTP second factor for another user.
+func (c *UncachedHTTPClient) EnrollUserTOTP(userID string) (*TOTPEnrollment, error) {
+	enrollment := &TOTPEnrollment{}
+	err := c.getHTTPData("POST", "/v0/totp/"+url.PathEscape(userID)+"/", url.Values{}, enrollment)
+	return enrollment, err
 }
 
 func (c *UncachedHTTPClient) getClient() (HTTP, error) {
@@ -561,17 +862,24 @@ func (c *UncachedHTTPClient) getHTTPDataWithContext(ctx context.Context, method
 
 		// Create the request per authHandler to prevent body from being reused between requests.
 		// This is due to the body being non-reusable after the first read.
-		r, err := http.NewRequestWithContext(ctx, method, "https://"+c.Host+path, bytes.NewBufferString(body.Encode()))
-		if err != nil {
-			return err
-		}
+		newRequest := func() (*http.Request, error) {
+			r, err := http.NewRequestWithContext(ctx, method, "https://"+c.Host+path, bytes.NewBufferString(body.Encode()))
+			if err != nil {
+				return nil, err
+			}
 
-		// Get user from env variable and machine hostname from elsewhere.
-		r.Header.Set("Authorization", authToken)
-		r.Header.Set("User-Agent", fmt.Sprintf("Knox_Client/%s", c.Version))
+			// Get user from env variable and machine hostname from elsewhere.
+			r.Header.Set("Authorization", authToken)
+			r.Header.Set("User-Agent", fmt.Sprintf("Knox_Client/%s", c.Version))
 
-		if body != nil {
-			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if body != nil {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			return r, nil
+		}
+		r, err := newRequest()
+		if err != nil {
+			return err
 		}
 
 		var cli HTTP
@@ -600,6 +908,19 @@ func (c *UncachedHTTPClient) getHTTPDataWithContext(ctx context.Context, method
 				return err
 			}
 			if resp.Status != "ok" {
+				if resp.Code == StepUpRequiredCode && c.StepUpPrompt != nil && r.Header.Get(StepUpHeader) == "" {
+					// Ask for a second factor once and repeat the request with it.
+					code, err := c.StepUpPrompt()
+					if err != nil {
+						return err
+					}
+					if r, err = newRequest(); err != nil {
+						return err
+					}
+					r.Header.Set(StepUpHeader, code)
+					i--
+					continue
+				}
 				if resp.Code == UnauthorizedCode || resp.Code == UnauthenticatedCode {
 					// If we get a 401 or 403, we need to continue to a different auth handler.
 					break
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+func init() {
+	cmdAPIKeys.Run = runAPIKeys // break init cycle
+	cmdCreateAPIKey.Run = runCreateAPIKey
+}
+
+var cmdAPIKeys = &Command{
+	UsageLine: "apikeys [-team <team>] [-json]",
+	Short:     "lists API keys of your teams",
+	Long: `
+Apikeys lists the Knox-issued API keys owned by the teams (user groups) you belong to, with their id, owning team, creator and expiry. Tokens are only shown when a key is created.
+
+-team: Lists only the keys of this team.
+-json: Returns the keys as JSON.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox create-apikey, knox revoke-apikey
+	`,
+}
+
+var cmdCreateAPIKey = &Command{
+	UsageLine: "create-apikey [-ttl <duration>] <team> <name>",
+	Short:     "issues an API key for non-interactive clients",
+	Long: `
+Create-apikey issues an API key for CI jobs and other clients that have neither machine certificates nor user credentials, and prints its token. The token cannot be retrieved again, so store it in the client's secret store straight away.
+
+The key is owned by team, which must be a user group you belong to; any member of the team can list and revoke it. Grant the key access to secrets with 'knox access -K <key_identifier> <api_key_id>', using the id printed when it is created. Names are only labels; a new key with the name of a revoked one does not inherit its access. It does not inherit the team's access.
+
+Clients authenticate by setting $KNOX_API_KEY to the token.
+
+-ttl: How long the key is valid, such as 720h. By default keys do not expire.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox apikeys, knox revoke-apikey, knox access
+	`,
+}
+
+var cmdRevokeAPIKey = &Command{
+	Run:       runRevokeAPIKey,
+	UsageLine: "revoke-apikey <api_key_id>",
+	Short:     "revokes an API key",
+	Long: `
+Revoke-apikey revokes an API key, which stops authenticating immediately. You must belong to the key's owning team.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox apikeys, knox create-apikey
+	`,
+}
+
+var apiKeysTeam = cmdAPIKeys.Flag.String("team", "", "")
+var apiKeysJSON = cmdAPIKeys.Flag.Bool("json", false, "")
+var createAPIKeyTTL = cmdCreateAPIKey.Flag.Duration("ttl", 0, "")
+
+func runAPIKeys(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("apikeys takes no arguments; see 'knox help apikeys'"), false}
+	}
+	keys, err := cli.GetAPIKeys(*apiKeysTeam)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting API keys: %w", err), true}
+	}
+	if *apiKeysJSON {
+		return printJSON(keys)
+	}
+	for _, k := range keys {
+		expiry := "never expires"
+		if k.Expiry != 0 {
+			expiry = "expires " + time.Unix(0, k.Expiry).Format(time.RFC3339)
+		}
+		fmt.Printf("%s %s team %s, created by %s, %s\n", k.ID, k.Name, k.Team, k.Creator, expiry)
+	}
+	return nil
+}
+
+func runCreateAPIKey(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 2 {
+		return &ErrorStatus{fmt.Errorf("create-apikey takes exactly two arguments; see 'knox help create-apikey'"), false}
+	}
+	if *createAPIKeyTTL < 0 {
+		return &ErrorStatus{fmt.Errorf("-ttl must not be negative"), false}
+	}
+	key, err := cli.CreateAPIKey(args[1], args[0], *createAPIKeyTTL)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error creating API key: %w", err), true}
+	}
+	fmt.Printf("Created API key %s (id %s). Its token, which will not be shown again, is:\n%s\n", key.Name, key.ID, key.Token)
+	return nil
+}
+
+func runRevokeAPIKey(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("revoke-apikey takes exactly one argument; see 'knox help revoke-apikey'"), false}
+	}
+	if err := cli.RevokeAPIKey(args[0]); err != nil {
+		return &ErrorStatus{fmt.Errorf("error revoking API key: %w", err), true}
+	}
+	fmt.Printf("Revoked API key %s.\n", args[0])
+	return nil
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+func init() {
+	cmdBreakGlass.Run = runBreakGlass // break init cycle
+}
+
+var cmdBreakGlass = &Command{
+	UsageLine: "breakglass -j <justification> <key_identifier>",
+	Short:     "requests emergency read access to a key",
+	Long: `
+Breakglass grants you short-lived read access to a key you are not on the ACL for. It is intended for incident response only.
+
+-j: The reason access is needed, e.g. an incident ticket. This is required.
+
+Only members of the groups designated by the knox server operators may use this command. Every grant and every read made with it is logged and flagged for review by the security team.
+
+After access is granted, read the key with "knox get -n <key_identifier>".
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox get, knox acl
+	`,
+}
+
+var breakGlassJustification = cmdBreakGlass.Flag.String("j", "", "")
+
+func runBreakGlass(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("breakglass takes exactly one argument; see 'knox help breakglass'"), false}
+	}
+	if *breakGlassJustification == "" {
+		return &ErrorStatus{fmt.Errorf("breakglass requires a justification (-j); see 'knox help breakglass'"), false}
+	}
+
+	grant, err := cli.BreakGlass(args[0], *breakGlassJustification)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error requesting break-glass access: %w", err), true}
+	}
+	fmt.Printf("Read access to %s granted to %s until %s. This access has been logged for review.\n",
+		grant.KeyID, grant.Principal, time.Unix(0, grant.Expiry).Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdCan.Run = runCan // break init cycle
+}
+
+var cmdCan = &Command{
+	UsageLine: "can [-json] [{-U|-M|-S} [-groups <group,...>]] <key_identifier> {Read|Write|Admin} [principal]",
+	Short:     "explains whether a principal can access a key",
+	Long: `
+Can asks the knox server whether a principal would be granted the given access to a key, without performing the access, and explains the decision.
+
+By default your own identity is evaluated, including every principal you authenticated as. For each of them the ACL entries that grant the access are listed. If no ACL entry grants it, the output says whether the server's access callback or a break-glass grant would allow it.
+
+To evaluate a different principal, pass it as the last argument along with its type. This requires admin access to the key or membership in the audit group:
+
+-U: The principal is a user.
+-M: The principal is a machine hostname.
+-S: The principal is a service SPIFFE ID.
+-groups: A comma separated list of groups to evaluate a user as a member of.
+-json: Returns the explanation as JSON.
+
+This doesn't require any access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox acl, knox who-can, knox what-can
+	`,
+}
+
+var canJSON = cmdCan.Flag.Bool("json", false, "")
+var canUser = cmdCan.Flag.Bool("U", false, "")
+var canMachine = cmdCan.Flag.Bool("M", false, "")
+var canService = cmdCan.Flag.Bool("S", false, "")
+var canGroups = cmdCan.Flag.String("groups", "", "")
+
+func runCan(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 2 && len(args) != 3 {
+		return &ErrorStatus{fmt.Errorf("can takes two or three arguments; see 'knox help can'"), false}
+	}
+	keyID := args[0]
+	var accessType knox.AccessType
+	if err := accessType.UnmarshalJSON([]byte(`"` + args[1] + `"`)); err != nil || accessType == knox.None {
+		return &ErrorStatus{fmt.Errorf("access must be one of Read, Write or Admin; see 'knox help can'"), false}
+	}
+
+	principal := ""
+	var principalType knox.PrincipalType
+	var groups []string
+	if len(args) == 3 {
+		principal = args[2]
+		switch {
+		case *canUser:
+			principalType = knox.User
+		case *canMachine:
+			principalType = knox.Machine
+		case *canService:
+			principalType = knox.Service
+		default:
+			return &ErrorStatus{fmt.Errorf("can requires {-U|-M|-S} with a principal; see 'knox help can'"), false}
+		}
+		if *canGroups != "" {
+			groups = strings.Split(*canGroups, ",")
+		}
+	}
+
+	explanation, err := cli.ExplainAccess(keyID, accessType, principal, principalType, groups)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error explaining access: %w", err), true}
+	}
+	if *canJSON {
+		return printJSON(explanation)
+	}
+
+	if explanation.Allowed {
+		fmt.Printf("ALLOWED: %s access to %s (via %s)\n", args[1], keyID, explanation.Source)
+	} else {
+		fmt.Printf("DENIED: %s access to %s\n", args[1], keyID)
+	}
+	for _, d := range explanation.Principals {
+		ids := []string{}
+		for _, raw := range d.Principal {
+			ids = append(ids, raw.Type+" "+raw.ID)
+		}
+		name := strings.Join(ids, ", ")
+		if d.Provider != "" {
+			name = d.Provider + ": " + name
+		}
+		for _, g := range d.OutsideNetworks {
+			fmt.Printf("  %s: %s (request origin %s is outside these networks)\n", name, g.Description, explanation.Origin)
+		}
+		if len(d.Entries) == 0 {
+			fmt.Printf("  %s: no matching ACL entry\n", name)
+			continue
+		}
+		for _, g := range d.Entries {
+			eEnc, err := json.Marshal(g.Entry)
+			if err != nil {
+				return &ErrorStatus{fmt.Errorf("could not marshal entry: %v", g.Entry), true}
+			}
+			suffix := ""
+			if g.Default {
+				suffix = " (default)"
+			}
+			fmt.Printf("  %s: %s%s\n", name, eEnc, suffix)
+		}
+	}
+	if explanation.CallbackError != "" {
+		fmt.Printf("  access callback error: %s\n", explanation.CallbackError)
+	}
+	return nil
+}
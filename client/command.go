@@ -72,6 +72,7 @@ func Run(
 ) {
 
 	cli = client
+	setStepUpPrompt(client)
 	if p != nil {
 		if p.Logf != nil {
 			logf = p.Logf
@@ -156,6 +157,11 @@ var commands = []*Command{
 	cmdGet,
 	cmdGetVersions,
 	cmdGetACL,
+	cmdWhoCan,
+	cmdWhatCan,
+	cmdCan,
+	cmdPrefixAudit,
+	cmdOrphans,
 	cmdPromote,
 	cmdCreate,
 	cmdAdd,
@@ -163,6 +169,16 @@ var commands = []*Command{
 	cmdReactivate,
 	cmdUpdateAccess,
 	cmdDelete,
+	cmdBreakGlass,
+	cmdPending,
+	cmdApprove,
+	cmdReject,
+	cmdAPIKeys,
+	cmdCreateAPIKey,
+	cmdRevokeAPIKey,
+	cmdSession,
+	cmdRevokeSession,
+	cmdEnrollTOTP,
 
 	// These are additional help topics
 	cmdListKeyTemplates,
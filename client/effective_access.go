@@ -0,0 +1,139 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdWhoCan.Run = runWhoCan   // break init cycle
+	cmdWhatCan.Run = runWhatCan // break init cycle
+}
+
+var cmdWhoCan = &Command{
+	UsageLine: "who-can [-json] <key_identifier>",
+	Short:     "explains who can access a key",
+	Long: `
+Who-can explains each entry in the ACL of a key: who it matches, what access it grants, and whether it is a default entry added to every key. When the knox server has a principal inventory, machine and service prefix entries also list the known machines and services they match.
+
+-json: Returns the report as JSON.
+
+This doesn't require any access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox acl, knox what-can
+	`,
+}
+
+var cmdWhatCan = &Command{
+	UsageLine: "what-can [-json] {-U|-M|-S} [-groups <group,...>] <principal>",
+	Short:     "lists the keys a principal can access",
+	Long: `
+What-can lists every key that the given principal can read, write or administer through key ACLs, along with the ACL entries that grant that access. Access granted dynamically by the server (e.g. through access callbacks) is not included.
+
+-U: The principal is a user.
+-M: The principal is a machine hostname.
+-S: The principal is a service SPIFFE ID.
+-groups: A comma separated list of groups to evaluate a user as a member of.
+-json: Returns the report as JSON.
+
+This doesn't require any access to the keys, but requires membership in the audit group configured on the knox server.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox acl, knox who-can
+	`,
+}
+
+var whoCanJSON = cmdWhoCan.Flag.Bool("json", false, "")
+
+var whatCanJSON = cmdWhatCan.Flag.Bool("json", false, "")
+var whatCanUser = cmdWhatCan.Flag.Bool("U", false, "")
+var whatCanMachine = cmdWhatCan.Flag.Bool("M", false, "")
+var whatCanService = cmdWhatCan.Flag.Bool("S", false, "")
+var whatCanGroups = cmdWhatCan.Flag.String("groups", "", "")
+
+func runWhoCan(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("who-can takes only one argument; see 'knox help who-can'"), false}
+	}
+	grants, err := cli.GetEffectiveAccess(args[0])
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting effective access: %w", err), true}
+	}
+	if *whoCanJSON {
+		return printJSON(grants)
+	}
+	for _, g := range grants {
+		access, err := g.Entry.AccessType.MarshalJSON()
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("could not marshal entry: %v", g.Entry), true}
+		}
+		line := fmt.Sprintf("%s: %s", strings.Trim(string(access), `"`), g.Description)
+		if g.Default {
+			line += " (default)"
+		}
+		fmt.Println(line)
+		for _, m := range g.Matches {
+			fmt.Printf("    %s\n", m)
+		}
+	}
+	return nil
+}
+
+func runWhatCan(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("what-can takes only one argument; see 'knox help what-can'"), false}
+	}
+	var principalType knox.PrincipalType
+	switch {
+	case *whatCanUser:
+		principalType = knox.User
+	case *whatCanMachine:
+		principalType = knox.Machine
+	case *whatCanService:
+		principalType = knox.Service
+	default:
+		return &ErrorStatus{fmt.Errorf("what-can requires {-U|-M|-S}; see 'knox help what-can'"), false}
+	}
+	var groups []string
+	if *whatCanGroups != "" {
+		groups = strings.Split(*whatCanGroups, ",")
+	}
+
+	accesses, err := cli.GetPrincipalAccess(args[0], principalType, groups)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting principal access: %w", err), true}
+	}
+	if *whatCanJSON {
+		return printJSON(accesses)
+	}
+	for _, a := range accesses {
+		access, err := a.AccessType.MarshalJSON()
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("could not marshal access: %v", a), true}
+		}
+		fmt.Printf("%s %s\n", a.KeyID, strings.Trim(string(access), `"`))
+		for _, e := range a.Entries {
+			eEnc, err := json.Marshal(e)
+			if err != nil {
+				return &ErrorStatus{fmt.Errorf("could not marshal entry: %v", e), true}
+			}
+			fmt.Printf("    %s\n", eEnc)
+		}
+	}
+	return nil
+}
+
+func printJSON(v interface{}) *ErrorStatus {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("could not marshal response: %w", err), true}
+	}
+	fmt.Println(string(enc))
+	return nil
+}
@@ -16,6 +16,14 @@ If the $KNOX_USER_AUTH env variable is set, the value will be used as an OAuth t
 
 If the $KNOX_MACHINE_AUTH env variable is set, the value will be used as the current client hostname. 
 
+If the $KNOX_API_KEY env variable is set, the value will be used as a Knox-issued API key (see knox create-apikey).
+
+If the $KNOX_SESSION_TOKEN env variable is set, the value will be used as a Knox session token in place of any other credentials (see knox session).
+
+If the $KNOX_SSH_CERT env variable is set to the path of an SSH user certificate, requests are signed with the certificate's key, taken from $KNOX_SSH_KEY if set and otherwise from the SSH agent.
+
+If the $KNOX_OTP env variable is set, the value will be used as the code of your second factor when an operation requires one, instead of prompting (see knox enroll-totp).
+
 See also: knox login
 	`,
 }
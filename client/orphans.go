@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func init() {
+	cmdOrphans.Run = runOrphans // break init cycle
+}
+
+var cmdOrphans = &Command{
+	UsageLine: "orphans [-json]",
+	Short:     "lists keys without a human admin",
+	Long: `
+Orphans lists keys that no user or user group has admin access to, along with the machines or services that can still administer them. Such keys can only be managed by those principals and should have a human admin added with 'knox access -a'.
+
+The knox server rejects ACL changes that would leave a key without a human admin, so these keys predate that check or were changed by the security team.
+
+-json: Returns the keys as JSON.
+
+This command doesn't require any access to the keys, but requires membership in the audit group configured on the knox server.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox access, knox who-can
+	`,
+}
+
+var orphansJSON = cmdOrphans.Flag.Bool("json", false, "")
+
+func runOrphans(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("orphans takes no arguments; see 'knox help orphans'"), false}
+	}
+	orphans, err := cli.GetOrphanedKeys()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting orphaned keys: %w", err), true}
+	}
+	if *orphansJSON {
+		return printJSON(orphans)
+	}
+	for _, o := range orphans {
+		aEnc, err := json.Marshal(o.Admins)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("could not marshal admins: %v", o.Admins), true}
+		}
+		fmt.Printf("%s admins: %s\n", o.KeyID, aEnc)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+var cmdPending = &Command{
+	Run:       runPending,
+	UsageLine: "pending",
+	Short:     "lists changes awaiting approval",
+	Long: `
+Pending lists changes to sensitive keys that have been submitted by one admin and are waiting for a second admin to approve or reject them.
+
+Each change is printed as JSON, including its id, the key, the operation and who requested it. Changes that are not reviewed before they expire are discarded.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox approve, knox reject
+	`,
+}
+
+var cmdApprove = &Command{
+	Run:       runApprove,
+	UsageLine: "approve <change_id>",
+	Short:     "approves and applies a pending change",
+	Long: `
+Approve applies a pending change to a sensitive key.
+
+You must have the same access to the key that the change requires, and you cannot approve a change that you requested.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox pending, knox reject
+	`,
+}
+
+var cmdReject = &Command{
+	Run:       runReject,
+	UsageLine: "reject <change_id>",
+	Short:     "rejects a pending change",
+	Long: `
+Reject discards a pending change to a sensitive key without applying it. Requesters may use this to withdraw their own changes.
+
+You must have the same access to the key that the change requires.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox pending, knox approve
+	`,
+}
+
+func runPending(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("pending takes no arguments; see 'knox help pending'"), false}
+	}
+	changes, err := cli.GetPendingChanges()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting pending changes: %w", err), true}
+	}
+	for _, c := range changes {
+		cEnc, err := json.Marshal(c)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("could not marshal pending change: %v", c), true}
+		}
+		fmt.Println(string(cEnc))
+	}
+	return nil
+}
+
+func runApprove(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("approve takes exactly one argument; see 'knox help approve'"), false}
+	}
+	err := cli.ApprovePendingChange(args[0])
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error approving change: %w", err), true}
+	}
+	fmt.Printf("Approved and applied change %s.\n", args[0])
+	return nil
+}
+
+func runReject(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("reject takes exactly one argument; see 'knox help reject'"), false}
+	}
+	err := cli.RejectPendingChange(args[0])
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error rejecting change: %w", err), true}
+	}
+	fmt.Printf("Rejected change %s.\n", args[0])
+	return nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	cmdPrefixAudit.Run = runPrefixAudit // break init cycle
+}
+
+var cmdPrefixAudit = &Command{
+	UsageLine: "prefix-audit [-json]",
+	Short:     "reports machine prefix rules that match unintended hosts",
+	Long: `
+Prefix-audit reports machine prefix (-P) ACL entries on any key that match known hosts in the middle of a name. For example, the prefix 'auth' matches 'authz-evil01' as well as 'auth001', and the prefix 'web1' matches 'web12' as well as 'web1-a'.
+
+Each finding lists the key, the entry and the hosts it matches unexpectedly. Consider replacing such entries with machine patterns (knox access -H) such as 'auth[0-9]*'.
+
+-json: Returns the findings as JSON.
+
+This requires the knox server to be configured with a host inventory and membership in its audit group. It doesn't require any access to the keys.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox access, knox who-can
+	`,
+}
+
+var prefixAuditJSON = cmdPrefixAudit.Flag.Bool("json", false, "")
+
+func runPrefixAudit(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("prefix-audit takes no arguments; see 'knox help prefix-audit'"), false}
+	}
+	findings, err := cli.AuditMachinePrefixes()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error auditing machine prefixes: %w", err), true}
+	}
+	if *prefixAuditJSON {
+		return printJSON(findings)
+	}
+	for _, f := range findings {
+		eEnc, err := json.Marshal(f.Entry)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("could not marshal entry: %v", f.Entry), true}
+		}
+		fmt.Printf("%s %s matches: %s\n", f.KeyID, eEnc, strings.Join(f.Unintended, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+func init() {
+	cmdSession.Run = runSession // break init cycle
+}
+
+var cmdSession = &Command{
+	UsageLine: "session [-json]",
+	Short:     "exchanges your credentials for a short-lived session token",
+	Long: `
+Session exchanges the credentials the client authenticates with for a short-lived Knox session token and prints it. The token carries the identities and groups you have now, so requests made with it skip the original identity providers until it expires.
+
+Use the token by setting $KNOX_SESSION_TOKEN. A session token cannot be exchanged for another one; run 'knox session' with your original credentials again once it expires.
+
+-json: Returns the session id, token and expiry as JSON.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox revoke-session, knox help auth
+	`,
+}
+
+var cmdRevokeSession = &Command{
+	Run:       runRevokeSession,
+	UsageLine: "revoke-session <session_id>",
+	Short:     "revokes a session token",
+	Long: `
+Revoke-session revokes a session token by its id, which stops it authenticating immediately.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox session
+	`,
+}
+
+var sessionJSON = cmdSession.Flag.Bool("json", false, "")
+
+func runSession(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("session takes no arguments; see 'knox help session'"), false}
+	}
+	session, err := cli.CreateSession()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error creating session: %w", err), true}
+	}
+	if *sessionJSON {
+		return printJSON(session)
+	}
+	fmt.Printf("Created session %s, expires %s. Its token is:\n%s\n", session.ID, time.Unix(0, session.Expiry).Format(time.RFC3339), session.Token)
+	return nil
+}
+
+func runRevokeSession(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("revoke-session takes exactly one argument; see 'knox help revoke-session'"), false}
+	}
+	if err := cli.RevokeSession(args[0]); err != nil {
+		return &ErrorStatus{fmt.Errorf("error revoking session: %w", err), true}
+	}
+	fmt.Printf("Revoked session %s.\n", args[0])
+	return nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdEnrollTOTP.Run = runEnrollTOTP // break init cycle
+}
+
+var cmdEnrollTOTP = &Command{
+	UsageLine: "enroll-totp [-json] [<user_id>]",
+	Short:     "enrolls a second factor for destructive operations",
+	Long: `
+Enroll-totp replaces your TOTP second factor and prints the secret and an otpauth:// URI of the new one to add to an authenticator app. This requires a code from your current second factor.
+
+Your first second factor is enrolled by an administrator, who runs enroll-totp with your user ID and hands the secret over to you.
+
+The server may require a code from it for operations such as deleting keys or changing their access. The client then prompts for the code, or reads it from $KNOX_OTP if set.
+
+-json: Returns the secret and URI as JSON.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox delete, knox access
+	`,
+}
+
+var enrollTOTPJSON = cmdEnrollTOTP.Flag.Bool("json", false, "")
+
+func runEnrollTOTP(cmd *Command, args []string) *ErrorStatus {
+	var enrollment *knox.TOTPEnrollment
+	var err error
+	switch len(args) {
+	case 0:
+		enrollment, err = cli.EnrollTOTP()
+	case 1:
+		enrollment, err = cli.EnrollUserTOTP(args[0])
+	default:
+		return &ErrorStatus{fmt.Errorf("enroll-totp takes at most one argument; see 'knox help enroll-totp'"), false}
+	}
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error enrolling second factor: %w", err), true}
+	}
+	if *enrollTOTPJSON {
+		return printJSON(enrollment)
+	}
+	fmt.Printf("Enrolled a second factor. Add it to an authenticator app with the secret\n%s\nor the URI\n%s\n", enrollment.Secret, enrollment.URI)
+	return nil
+}
+
+// promptStepUpCode reads a second factor code from $KNOX_OTP or the terminal.
+func promptStepUpCode() (string, error) {
+	if code := os.Getenv("KNOX_OTP"); code != "" {
+		return code, nil
+	}
+	fmt.Fprint(os.Stderr, "This operation requires a second factor. Enter the code from your authenticator app: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("problem reading second factor code: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// setStepUpPrompt makes the client prompt for second factor codes unless it
+// already has a prompt.
+func setStepUpPrompt(client knox.APIClient) {
+	if c, ok := client.(*knox.HTTPClient); ok && c.UncachedClient != nil && c.UncachedClient.StepUpPrompt == nil {
+		c.UncachedClient.StepUpPrompt = promptStepUpCode
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/pinterest/knox"
 )
@@ -13,7 +14,7 @@ func init() {
 }
 
 var cmdUpdateAccess = &Command{
-	UsageLine: "access (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P|-S|-N} <key_identifier> <principal>)",
+	UsageLine: "access (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P|-H|-S|-N|-K} [-networks <cidrs>] <key_identifier> <principal>)",
 	Short:     "access modifies the acl of a key",
 	Long: `
 Access will add or change the acl on a key by adding a specific access control rule.
@@ -28,9 +29,13 @@ Access will add or change the acl on a key by adding a specific access control r
 -M: A specific machine. The principal should be set to the exact hostname.
 -U: A specific user. The principal should be set to the ldap username of the user.
 -G: A specific user group. The principal should be set to the group name. This takes the format of ou=Security,ou=Prod,ou=groups,dc=pinterest,dc=com in LDAP.
--P: A machine hostname prefix. Prefix matching will be used to determine access. For example, if the principal is set to 'auth' then 'auth004' would match (and so would any hostname beginning with auth).
+-P: A machine hostname prefix. Prefix matching will be used to determine access. For example, if the principal is set to 'auth' then 'auth004' would match (and so would any hostname beginning with auth, including 'authz01'). Prefer -H for new rules.
+-H: A machine hostname pattern. Either a glob, where '*' and '?' match within a single DNS label and '[0-9]' is a character class, such as 'auth[0-9]*.prod.example.com', or a regular expression anchored with '^' and '$'.
 -S: A specific service. The principal should be set to the exact SPIFFE ID. For example, 'spiffe://example.com/service'.
 -N: A service prefix (namespace). The principal should be set to a SPIFFE ID ending with a slash, such as 'spiffe://example.com/namespace/'. This will match all services under that prefix, so for example 'spiffe://example.com/namespace/service' would be allowed.
+-K: A Knox-issued API key. The principal should be set to the API key's id (see knox create-apikey).
+
+-networks: A comma separated list of CIDR ranges, such as '10.0.0.0/8,192.168.1.0/24'. The rule will only apply to requests originating from these networks, so a credential used from elsewhere is not granted access by it.
 
 This command requires admin access to the key.
 
@@ -51,8 +56,12 @@ var updateAccessMachine = cmdUpdateAccess.Flag.Bool("M", false, "")
 var updateAccessUser = cmdUpdateAccess.Flag.Bool("U", false, "")
 var updateAccessGroup = cmdUpdateAccess.Flag.Bool("G", false, "")
 var updateAccessPrefix = cmdUpdateAccess.Flag.Bool("P", false, "")
+var updateAccessPattern = cmdUpdateAccess.Flag.Bool("H", false, "")
 var updateAccessService = cmdUpdateAccess.Flag.Bool("S", false, "")
 var updateAccessServicePrefix = cmdUpdateAccess.Flag.Bool("N", false, "")
+var updateAccessAPIKey = cmdUpdateAccess.Flag.Bool("K", false, "")
+
+var updateAccessNetworks = cmdUpdateAccess.Flag.String("networks", "", "")
 
 func runUpdateAccess(cmd *Command, args []string) *ErrorStatus {
 	if *updateAccessACL != "" {
@@ -104,12 +113,19 @@ func runUpdateAccess(cmd *Command, args []string) *ErrorStatus {
 		access.Type = knox.UserGroup
 	case *updateAccessPrefix:
 		access.Type = knox.MachinePrefix
+	case *updateAccessPattern:
+		access.Type = knox.MachinePattern
 	case *updateAccessService:
 		access.Type = knox.Service
 	case *updateAccessServicePrefix:
 		access.Type = knox.ServicePrefix
+	case *updateAccessAPIKey:
+		access.Type = knox.APIKey
 	default:
-		return &ErrorStatus{fmt.Errorf("access requires {-M|-U|-G|-P|-S|-N}; see 'knox help access'"), false}
+		return &ErrorStatus{fmt.Errorf("access requires {-M|-U|-G|-P|-H|-S|-N|-K}; see 'knox help access'"), false}
+	}
+	if *updateAccessNetworks != "" {
+		access.Networks = knox.NewNetworks(strings.Split(*updateAccessNetworks, ",")...)
 	}
 	err := cli.PutAccess(keyID, access)
 	if err != nil {
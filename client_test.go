@@ -548,6 +548,203 @@ func TestPutAccess(t *testing.T) {
 	}
 }
 
+func TestPutAccessPendingApproval(t *testing.T) {
+	resp, err := buildGoodResponse(PendingChange{ID: "c1", KeyID: "testkey"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	err = cli.PutAccess("testkey", Access{Type: User, AccessType: Read, ID: "test"})
+	if !errors.Is(err, ErrPendingApproval) || !strings.Contains(err.Error(), "c1") {
+		t.Fatalf("expected a pending approval error naming the change, got %v", err)
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	expected := BreakGlassGrant{KeyID: "testkey", Principal: "responder", Justification: "INC-1", Expiry: 10}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "POST" {
+			t.Fatalf("%s is not POST", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/testkey/breakglass/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/breakglass/")
+		}
+		r.ParseForm()
+		if r.PostForm["justification"][0] != "INC-1" {
+			t.Fatalf("%s is not INC-1", r.PostForm["justification"][0])
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	grant, err := cli.BreakGlass("testkey", "INC-1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if *grant != expected {
+		t.Fatalf("%+v is not %+v", *grant, expected)
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	expected := []PendingChange{{ID: "c1", KeyID: "testkey", Operation: "deletekey", Requester: "alice"}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var paths []string
+	srv := buildServer(200, resp, func(r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	changes, err := cli.GetPendingChanges()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("%+v is not %+v", changes, expected)
+	}
+	if err := cli.ApprovePendingChange("c1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := cli.RejectPendingChange("c1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	expectedPaths := []string{"GET /v0/pending/", "POST /v0/pending/c1/approve/", "POST /v0/pending/c1/reject/"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Fatalf("%v is not %v", paths, expectedPaths)
+	}
+}
+
+func TestGetPrincipalAccess(t *testing.T) {
+	expected := []PrincipalKeyAccess{{KeyID: "testkey", AccessType: Read, Entries: []Access{{Type: UserGroup, ID: "eng", AccessType: Read}}}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.URL.Path != "/v0/access/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/access/")
+		}
+		q := r.URL.Query()
+		if q.Get("principal") != "bob" || q.Get("type") != "User" || q.Get("groups") != "eng,ops" {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	accesses, err := cli.GetPrincipalAccess("bob", User, []string{"eng", "ops"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(accesses, expected) {
+		t.Fatalf("%+v is not %+v", accesses, expected)
+	}
+}
+
+func TestGetOrphanedKeys(t *testing.T) {
+	expected := []OrphanedKey{{KeyID: "testkey", Admins: []Access{{Type: Machine, ID: "web001", AccessType: Admin}}}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.URL.Path != "/v0/audit/orphanedkeys/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/audit/orphanedkeys/")
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	orphans, err := cli.GetOrphanedKeys()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("%+v is not %+v", orphans, expected)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	expected := APIKeyInfo{ID: "k1", Name: "deploy", Team: "ci", Creator: "alice", Token: "k1.secret"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var requests []string
+	srv := buildServer(200, resp, func(r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Form.Encode())
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	key, err := cli.CreateAPIKey("deploy", "ci", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if *key != expected {
+		t.Fatalf("%+v is not %+v", *key, expected)
+	}
+	cli.GetAPIKeys("ci")
+	if err := cli.RevokeAPIKey("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	expectedRequests := []string{
+		"POST /v0/apikeys/ name=deploy&team=ci&ttl=24h0m0s",
+		"GET /v0/apikeys/ team=ci",
+		"DELETE /v0/apikeys/k1/ ",
+	}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Fatalf("%v is not %v", requests, expectedRequests)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	expected := SessionToken{ID: "s1", Token: "header.payload.signature", Expiry: 10}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var requests []string
+	srv := buildServer(200, resp, func(r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	session, err := cli.CreateSession()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if *session != expected {
+		t.Fatalf("%+v is not %+v", *session, expected)
+	}
+	if err := cli.RevokeSession("s1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	expectedRequests := []string{"POST /v0/sessions/", "DELETE /v0/sessions/s1/"}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Fatalf("%v is not %v", requests, expectedRequests)
+	}
+}
+
 func TestConcurrentDeletes(t *testing.T) {
 	var ops uint64
 	srv := buildConcurrentServer(200, func(r *http.Request) []byte {
@@ -940,3 +1137,89 @@ func TestUncachedClientCacheGetKeyWithContext(t *testing.T) {
 		t.Fatalf("Expected ID %s, got %s", expected.ID, k.ID)
 	}
 }
+
+func TestNewSchemeAuthHandler(t *testing.T) {
+	token := ""
+	handler := NewSchemeAuthHandler(BearerScheme, "oidc", func() string { return token })
+	if auth, _, _ := handler(); auth != "" {
+		t.Fatalf("expected empty credentials to skip the handler, got %q", auth)
+	}
+	token = "abc"
+	auth, authType, client := handler()
+	if auth != "Bearer abc" || authType != "oidc" || client != nil {
+		t.Fatalf("unexpected handler output %q %q %v", auth, authType, client)
+	}
+}
+
+func TestStepUpPrompt(t *testing.T) {
+	required, err := buildErrorResponse(StepUpRequiredCode, nil)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	ok, err := buildGoodResponse(nil)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var codes []string
+	var bodies []string
+	srv := buildConcurrentServer(200, func(r *http.Request) []byte {
+		r.ParseForm()
+		codes = append(codes, r.Header.Get(StepUpHeader))
+		bodies = append(bodies, r.Form.Encode())
+		if r.Header.Get(StepUpHeader) == "" {
+			return required
+		}
+		return ok
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	if err := cli.DeleteKey("k1"); err == nil {
+		t.Fatal("expected an error without a prompt")
+	}
+
+	prompts := 0
+	cli.UncachedClient.StepUpPrompt = func() (string, error) {
+		prompts++
+		return "123456", nil
+	}
+	codes, bodies = nil, nil
+	if err := cli.PutAccess("k1", Access{Type: User, ID: "bob", AccessType: Read}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if prompts != 1 || !reflect.DeepEqual(codes, []string{"", "123456"}) {
+		t.Fatalf("unexpected prompts %d and codes %v", prompts, codes)
+	}
+	if bodies[0] == "" || bodies[0] != bodies[1] {
+		t.Fatalf("expected the repeated request to keep its body, got %v", bodies)
+	}
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	expected := TOTPEnrollment{Secret: "SECRET", URI: "otpauth://totp/Knox:alice"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var requests []string
+	srv := buildServer(200, resp, func(r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	if _, err := cli.EnrollTOTP(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	enrollment, err := cli.EnrollUserTOTP("alice")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if *enrollment != expected {
+		t.Fatalf("%+v is not %+v", *enrollment, expected)
+	}
+	expectedRequests := []string{"POST /v0/totp/", "POST /v0/totp/alice/"}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Fatalf("%v is not %v", requests, expectedRequests)
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/user"
+	"sync"
 	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/client"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // certPEMBlock is the certificate signed by the CA to identify the machine using the client
@@ -46,6 +52,9 @@ const hostname = "localhost:9000"
 const tokenEndpoint = "https://oauth.token.endpoint.used.for/knox/login"
 const clientID = ""
 
+// sshAudience is the name the knox server expects SSH authentication tokens to be signed for
+const sshAudience = "knox"
+
 // keyFolder is the directory where keys are cached
 const keyFolder = "/var/lib/knox/v0/keys/"
 
@@ -66,27 +75,47 @@ func getCert() (tls.Certificate, error) {
 }
 
 // authHandler is used to generate an authentication header.
-// The server expects VersionByte + TypeByte + IDToPassToAuthHandler.
+// The server expects "<scheme> <credentials>", or the legacy VersionByte + TypeByte + IDToPassToAuthHandler.
 func authHandler() (string, string, knox.HTTP) {
+	if s := os.Getenv("KNOX_SESSION_TOKEN"); s != "" {
+		return knox.Authorization(knox.SessionScheme, s), authTypeUser, nil
+	}
 	if s := os.Getenv("KNOX_USER_AUTH"); s != "" {
-		return "0u" + s, authTypeUser, nil
+		return knox.Authorization(knox.GitHubScheme, s), authTypeUser, nil
 	}
 	if s := os.Getenv("KNOX_MACHINE_AUTH"); s != "" {
 		c, _ := getCert()
 		x509Cert, err := x509.ParseCertificate(c.Certificate[0])
 		if err != nil {
-			return "0t" + s, authTypeMachine, nil
+			return knox.Authorization(knox.MachineScheme, s), authTypeMachine, nil
 		}
 		if len(x509Cert.Subject.CommonName) > 0 {
-			return "0t" + x509Cert.Subject.CommonName, authTypeMachine, nil
+			return knox.Authorization(knox.MachineScheme, x509Cert.Subject.CommonName), authTypeMachine, nil
 		} else if len(x509Cert.DNSNames) > 0 {
-			return "0t" + x509Cert.DNSNames[0], authTypeMachine, nil
+			return knox.Authorization(knox.MachineScheme, x509Cert.DNSNames[0]), authTypeMachine, nil
 		} else {
-			return "0t" + s, authTypeMachine, nil
+			return knox.Authorization(knox.MachineScheme, s), authTypeMachine, nil
 		}
 	}
 	if s := os.Getenv("KNOX_SERVICE_AUTH"); s != "" {
-		return "0s" + s, authTypeMachine, nil
+		return knox.Authorization(knox.SpiffeScheme, s), authTypeMachine, nil
+	}
+	if s := os.Getenv("KNOX_API_KEY"); s != "" {
+		return knox.Authorization(knox.APIKeyScheme, s), authTypeMachine, nil
+	}
+	if s := os.Getenv("KNOX_SSH_CERT"); s != "" {
+		sshOnce.Do(func() {
+			var err error
+			sshHandler, err = sshAuthHandler(s, os.Getenv("KNOX_SSH_KEY"))
+			if err != nil {
+				log.Println("Failed to authenticate with SSH certificate:", err)
+			}
+		})
+		if sshHandler == nil {
+			return "", "", nil
+		}
+		token, _, signingClient := sshHandler()
+		return token, authTypeUser, signingClient
 	}
 	u, err := user.Current()
 	if err != nil {
@@ -103,7 +132,64 @@ func authHandler() (string, string, knox.HTTP) {
 		return "", "", nil
 	}
 
-	return "0u" + authResp.AccessToken, authTypeUser, nil
+	return knox.Authorization(knox.GitHubScheme, authResp.AccessToken), authTypeUser, nil
+}
+
+// httpClient makes the client's requests. SSH authentication signs each
+// request before passing it on.
+var httpClient knox.HTTP
+
+var (
+	sshOnce    sync.Once
+	sshHandler knox.AuthHandler
+)
+
+// sshAuthHandler signs requests with the SSH certificate in certFile. The
+// certificate's private key is read from keyFile if set, and otherwise looked
+// up in the SSH agent, whose connection is kept open for the life of the
+// process.
+func sshAuthHandler(certFile, keyFile string) (knox.AuthHandler, error) {
+	d, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(d)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", certFile)
+	}
+
+	if keyFile != "" {
+		d, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(d)
+		if err != nil {
+			return nil, err
+		}
+		return knox.NewSSHCertAuthHandler(cert, signer, sshAudience, httpClient), nil
+	}
+
+	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return knox.NewSSHCertAuthHandler(cert, signer, sshAudience, httpClient), nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("no key for %s in the SSH agent", certFile)
 }
 
 func main() {
@@ -119,10 +205,11 @@ func main() {
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
 	authHandlers := []knox.AuthHandler{authHandler}
 	cli := &knox.HTTPClient{
 		KeyFolder:      keyFolder,
-		UncachedClient: knox.NewUncachedClient(hostname, &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, authHandlers, ""),
+		UncachedClient: knox.NewUncachedClient(hostname, httpClient, authHandlers, ""),
 	}
 
 	loginCommand := client.NewLoginCommand(clientID, tokenEndpoint, "", "", "", "")
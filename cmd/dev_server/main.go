@@ -14,6 +14,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pinterest/knox"
@@ -41,7 +42,14 @@ var gitSha = expvar.NewString("version")
 var service = expvar.NewString("service")
 
 var (
-	flagAddr = flag.String("http", ":9000", "HTTP port to listen on")
+	flagAddr               = flag.String("http", ":9000", "HTTP port to listen on")
+	flagSSHCAKeys          = flag.String("ssh-ca-keys", "", "File of SSH CA public keys trusted to sign user certificates")
+	flagImpersonationGroup = flag.String("impersonation-group", "", "User group allowed to inspect access as other principals")
+	flagAuditGroup         = flag.String("audit-group", "", "User group allowed to report on the ACLs of every key")
+	flagAuthThrottle       = flag.Bool("auth-throttle", false, "Lock out client addresses and credentials that repeatedly fail authentication")
+	flagStepUpAdminGroup   = flag.String("step-up-admin-group", "", "User group allowed to enroll second factors for other users")
+	flagStepUpBootstrap    = flag.String("step-up-bootstrap-user", "", "User to enroll a second factor for at startup, such as the first step-up administrator")
+	flagStepUpRoutes       = flag.String("step-up-routes", "", "Comma separated route IDs, such as deletekey,putaccess, that require a second factor")
 )
 
 const (
@@ -73,18 +81,80 @@ func main() {
 	certPool := x509.NewCertPool()
 	certPool.AppendCertsFromPEM([]byte(caCert))
 
+	apiKeys := auth.NewTempAPIKeyStore()
+	server.SetAPIKeyStore(apiKeys)
+
+	sessionKey, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		errLogger.Fatal("Failed to make session signing key: ", err)
+	}
+	sessions, err := auth.NewSessionTokens(auth.SessionTokenConfig{
+		Keys:        []auth.SessionSigningKey{{ID: "dev", Key: sessionKey}},
+		Revocations: auth.NewTempSessionRevocationStore(),
+		APIKeys:     apiKeys,
+	})
+	if err != nil {
+		errLogger.Fatal(err)
+	}
+	server.SetSessionTokens(sessions)
+	server.SetImpersonationGroup(*flagImpersonationGroup)
+	server.SetAuditGroup(*flagAuditGroup)
+	if *flagAuthThrottle {
+		server.SetAuthThrottle(server.NewAuthThrottle(server.AuthThrottleConfig{}))
+	}
+
+	if *flagStepUpRoutes != "" {
+		var rules []server.StepUpRule
+		for _, id := range strings.Split(*flagStepUpRoutes, ",") {
+			rules = append(rules, server.StepUpRule{RouteID: strings.TrimSpace(id)})
+		}
+		stepUp, err := server.NewStepUp(server.StepUpConfig{
+			Store:      server.NewTempTOTPStore(),
+			Rules:      rules,
+			AdminGroup: *flagStepUpAdminGroup,
+		})
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		if *flagStepUpBootstrap != "" {
+			enrollment, err := stepUp.Enroll(*flagStepUpBootstrap)
+			if err != nil {
+				errLogger.Fatal(err)
+			}
+			accLogger.Printf("Enrolled a second factor for %s: %s", *flagStepUpBootstrap, enrollment.URI)
+		}
+		server.SetStepUp(stepUp)
+	}
+
+	providers := []auth.Provider{
+		auth.NewMTLSAuthProvider(certPool),
+		auth.NewGitHubProvider(authTimeout),
+		auth.NewSpiffeAuthProvider(certPool),
+		auth.NewSpiffeAuthFallbackProvider(certPool),
+		auth.NewAPIKeyProvider(apiKeys),
+		auth.NewSessionTokenProvider(sessions),
+	}
+	if *flagSSHCAKeys != "" {
+		data, err := os.ReadFile(*flagSSHCAKeys)
+		if err != nil {
+			errLogger.Fatal("Failed to read SSH CA keys: ", err)
+		}
+		caKeys, err := auth.ParseSSHCAKeys(data)
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		sshProvider, err := auth.NewSSHCertProvider(auth.SSHCertProviderConfig{CAKeys: caKeys, Audience: "knox"})
+		if err != nil {
+			errLogger.Fatal(err)
+		}
+		providers = append(providers, sshProvider)
+	}
+
 	decorators := [](func(http.HandlerFunc) http.HandlerFunc){
 		server.Logger(accLogger),
 		server.AddHeader("Content-Type", "application/json"),
 		server.AddHeader("X-Content-Type-Options", "nosniff"),
-		server.Authentication(
-			[]auth.Provider{
-				auth.NewMTLSAuthProvider(certPool),
-				auth.NewGitHubProvider(authTimeout),
-				auth.NewSpiffeAuthProvider(certPool),
-				auth.NewSpiffeAuthFallbackProvider(certPool),
-			},
-			nil),
+		server.Authentication(providers, nil),
 	}
 
 	r, err := server.GetRouter(cryptor, db, decorators, make([]server.Route, 0))
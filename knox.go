@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"regexp"
 	"sort"
@@ -23,6 +24,16 @@ var (
 	ErrACLInvalidServicePrefixNoSlash  = fmt.Errorf("Service prefix had no trailing slash, must conform to 'spiffe://<domain>/<path>/' format.")
 	ErrACLInvalidServicePrefixTooShort = fmt.Errorf("Service prefix too short, path of namespace for prefix needs to be longer.")
 
+	ErrACLInvalidMachinePattern           = fmt.Errorf("Machine pattern is invalid, must be a hostname glob or a regular expression anchored with '^' and '$'.")
+	ErrACLMachinePatternNoLiteral         = fmt.Errorf("Machine pattern must contain at least one literal hostname character.")
+	ErrACLMachinePatternMatchesEverything = fmt.Errorf("Machine pattern matches empty or arbitrary hostnames.")
+
+	ErrACLInvalidAPIKeyName = fmt.Errorf("API key name is invalid, must be 1-64 letters, digits, '.', '_' or '-'.")
+	ErrACLInvalidAPIKeyID   = fmt.Errorf("API key ID is invalid, must be the 32 hexadecimal digit ID of the key.")
+
+	ErrACLInvalidNetwork = fmt.Errorf("Network is invalid, must be in CIDR notation such as '10.0.0.0/8'.")
+	ErrACLNoHumanAdmin   = fmt.Errorf("ACL must keep at least one user or user group with admin access.")
+
 	ErrInvalidKeyID       = fmt.Errorf("KeyID can only contain alphanumeric characters, colons, and underscores.")
 	ErrInvalidVersionHash = fmt.Errorf("Hash does not match")
 
@@ -117,6 +128,11 @@ const (
 	Service
 	// ServicePrefix represents a prefix to match multiple SPIFFE IDs.
 	ServicePrefix
+	// MachinePattern represents a hostname glob or anchored regular expression
+	// to match multiple machines.
+	MachinePattern
+	// APIKey represents a Knox-issued API key, identified by its ID.
+	APIKey
 )
 
 // UnmarshalJSON parses JSON input to set an PrincipalType.
@@ -134,6 +150,10 @@ func (s *PrincipalType) UnmarshalJSON(b []byte) error {
 		*s = Service
 	case `"ServicePrefix"`:
 		*s = ServicePrefix
+	case `"MachinePattern"`:
+		*s = MachinePattern
+	case `"APIKey"`:
+		*s = APIKey
 	default:
 		// To ensure compatibilty in the event of new PrincipalTypes, don't
 		// throw an error. Instead just create a bogus Type. When displaying
@@ -158,6 +178,10 @@ func (s PrincipalType) MarshalJSON() ([]byte, error) {
 		return json.Marshal("Service")
 	case ServicePrefix:
 		return json.Marshal("ServicePrefix")
+	case MachinePattern:
+		return json.Marshal("MachinePattern")
+	case APIKey:
+		return json.Marshal("APIKey")
 	case Unknown:
 		// Explicitly prevent unrecognized PrincipalTypes from being marshaled
 		return nil, invalidTypeError{"PrincipalType"}
@@ -195,6 +219,14 @@ func (s PrincipalType) IsValidPrincipal(id string, extraValidators []PrincipalVa
 		if s == ServicePrefix && !endsWithSlash {
 			return ErrACLInvalidServicePrefixNoSlash
 		}
+	case MachinePattern:
+		if err := validateMachinePattern(id); err != nil {
+			return err
+		}
+	case APIKey:
+		if !IsValidAPIKeyID(id) {
+			return ErrACLInvalidAPIKeyID
+		}
 	}
 
 	for _, extraValidator := range extraValidators {
@@ -239,6 +271,80 @@ func ServicePrefixPathComponentsValidator(minPathComponents int) PrincipalValida
 	}
 }
 
+// machinePatternCanary is a hostname no legitimate pattern should match. A
+// pattern that matches it is considered to match arbitrary hosts.
+const machinePatternCanary = "knox-canary-0.unmatched.invalid"
+
+// MachinePatternRegexp compiles a MachinePattern principal into an anchored
+// regular expression. A pattern that starts with '^' and ends with '$' is used
+// as a regular expression directly. Anything else is a hostname glob that is
+// matched label by label: '*' matches any run of characters and '?' any single
+// character within one DNS label (neither crosses a '.'), and '[...]' is a
+// character class. All other characters are literal.
+func MachinePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	expr := pattern
+	if !isAnchoredRegexp(pattern) {
+		var err error
+		if expr, err = globToRegexp(pattern); err != nil {
+			return nil, err
+		}
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, ErrACLInvalidMachinePattern
+	}
+	return re, nil
+}
+
+func isAnchoredRegexp(pattern string) bool {
+	return strings.HasPrefix(pattern, "^") && strings.HasSuffix(pattern, "$") && len(pattern) > 1
+}
+
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString("[^.]*")
+		case '?':
+			b.WriteString("[^.]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 1 {
+				return "", ErrACLInvalidMachinePattern
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.ContainsAny(class, `.\[`) {
+				return "", ErrACLInvalidMachinePattern
+			}
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+func validateMachinePattern(pattern string) error {
+	re, err := MachinePatternRegexp(pattern)
+	if err != nil {
+		return err
+	}
+	if !isAnchoredRegexp(pattern) && strings.Trim(pattern, "*?.") == "" {
+		return ErrACLMachinePatternNoLiteral
+	}
+	if re.MatchString("") || re.MatchString(machinePatternCanary) {
+		return ErrACLMachinePatternMatchesEverything
+	}
+	return nil
+}
+
 // AccessType represents what kind of Access is granted in a key's ACL.
 type AccessType int
 
@@ -302,6 +408,101 @@ type Access struct {
 	Type       PrincipalType `json:"type"`
 	ID         string        `json:"id"`
 	AccessType AccessType    `json:"access"`
+	// Networks optionally restricts the entry to requests originating from
+	// one of the given CIDR ranges. An entry without networks applies to
+	// requests from anywhere.
+	Networks Networks `json:"networks,omitempty"`
+}
+
+// Networks is a list of CIDR ranges. It is held as a comma separated string
+// so that Access stays comparable, and is encoded in JSON as an array of
+// strings.
+type Networks string
+
+// NewNetworks builds Networks from CIDR ranges, trimming surrounding space.
+func NewNetworks(cidrs ...string) Networks {
+	trimmed := make([]string, 0, len(cidrs))
+	for _, c := range cidrs {
+		trimmed = append(trimmed, strings.TrimSpace(c))
+	}
+	return Networks(strings.Join(trimmed, ","))
+}
+
+// List returns the CIDR ranges.
+func (n Networks) List() []string {
+	if n == "" {
+		return nil
+	}
+	return strings.Split(string(n), ",")
+}
+
+// MarshalJSON encodes the networks as an array of strings.
+func (n Networks) MarshalJSON() ([]byte, error) {
+	l := n.List()
+	if l == nil {
+		l = []string{}
+	}
+	return json.Marshal(l)
+}
+
+// UnmarshalJSON decodes networks from an array of strings.
+func (n *Networks) UnmarshalJSON(b []byte) error {
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	for _, c := range l {
+		if strings.Contains(c, ",") {
+			return ErrACLInvalidNetwork
+		}
+	}
+	*n = NewNetworks(l...)
+	return nil
+}
+
+// Validate ensures every network is a CIDR range.
+func (n Networks) Validate() error {
+	for _, c := range n.List() {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return ErrACLInvalidNetwork
+		}
+	}
+	return nil
+}
+
+// Equal reports whether a and b grant the same access under the same
+// conditions. It is the same as a == b.
+func (a Access) Equal(b Access) bool {
+	return a == b
+}
+
+// AllowsOrigin reports whether the entry applies to a request from ip. A nil
+// ip (origin unknown) only satisfies entries without networks.
+func (a Access) AllowsOrigin(ip net.IP) bool {
+	if a.Networks == "" {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.Networks.List() {
+		_, cidr, err := net.ParseCIDR(n)
+		if err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForOrigin returns the entries of the ACL that apply to a request from ip.
+func (acl ACL) ForOrigin(ip net.IP) ACL {
+	filtered := ACL{}
+	for _, a := range acl {
+		if a.AllowsOrigin(ip) {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
 }
 
 // Validate ensures the ACL is of valid form. Not specifying the same group
@@ -311,6 +512,9 @@ func (acl ACL) Validate() error {
 		if a.AccessType == None {
 			return ErrACLContainsNone
 		}
+		if err := a.Networks.Validate(); err != nil {
+			return err
+		}
 		for j, b := range acl {
 			if i != j && a.ID == b.ID && a.Type == b.Type {
 				return ErrACLDuplicateEntries
@@ -320,6 +524,16 @@ func (acl ACL) Validate() error {
 	return nil
 }
 
+// HasHumanAdmin reports whether a user or user group has admin access.
+func (acl ACL) HasHumanAdmin() bool {
+	for _, a := range acl {
+		if (a.Type == User || a.Type == UserGroup) && a.AccessType == Admin {
+			return true
+		}
+	}
+	return false
+}
+
 // Add appends an access to the ACL. It does so by overwriting any existing access
 // that principal or group may have had.
 func (acl ACL) Add(a Access) ACL {
@@ -582,6 +796,17 @@ func (p PrincipalMux) Principals() []Principal {
 	return principals
 }
 
+// PrincipalsByProvider returns all the constituent principals being muxed,
+// including the default, indexed by the name of the provider that
+// authenticated them.
+func (p PrincipalMux) PrincipalsByProvider() map[string]Principal {
+	principals := make(map[string]Principal, len(p.allPrincipals))
+	for provider, principal := range p.allPrincipals {
+		principals[provider] = principal
+	}
+	return principals
+}
+
 // Raw returns the raw version of all the principals.
 func (p PrincipalMux) Raw() []RawPrincipal {
 	raw := []RawPrincipal{}
@@ -615,6 +840,11 @@ const (
 	BadRequestDataCode
 	BadKeyFormatCode
 	BadPrincipalIdentifier
+	PendingApprovalCode
+	PendingChangeDoesNotExistCode
+	APIKeyDoesNotExistCode
+	TooManyRequestsCode
+	StepUpRequiredCode
 )
 
 // Response is the format for responses from the api server.
@@ -627,9 +857,193 @@ type Response struct {
 	Data      interface{} `json:"data"`
 }
 
+// ErrorResponse is the body of unsuccessful responses from the v1 api. v1
+// responses are otherwise the requested resource itself, without a Response
+// envelope.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes why a v1 request failed. Type is a stable name for the
+// error, such as "key_not_found", and Code is the matching numeric code used
+// by the v0 api.
+type APIError struct {
+	Type    string `json:"type"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the message of the error.
+func (e APIError) Error() string {
+	return e.Message
+}
+
+// KeyCreateRequest is the body of a v1 request to create a key.
+type KeyCreateRequest struct {
+	ID   string `json:"id"`
+	Data []byte `json:"data"`
+	ACL  ACL    `json:"acl,omitempty"`
+}
+
+// VersionCreateRequest is the body of a v1 request to add a key version.
+type VersionCreateRequest struct {
+	Data []byte `json:"data"`
+}
+
+// VersionUpdateRequest is the body of a v1 request to change the status of a
+// key version.
+type VersionUpdateRequest struct {
+	Status *VersionStatus `json:"status"`
+}
+
 // AccessCallbackInput is the input to the access callback function.
 type AccessCallbackInput struct {
 	Key        Key            `json:"key"`
 	Principals []RawPrincipal `json:"principals"`
 	AccessType AccessType     `json:"access_type"`
 }
+
+// BreakGlassGrant is a short-lived, audited emergency read grant on a key for
+// a principal that is not otherwise on the key's ACL.
+type BreakGlassGrant struct {
+	KeyID         string `json:"key_id"`
+	Principal     string `json:"principal"`
+	Justification string `json:"justification"`
+	Expiry        int64  `json:"expiry"`
+}
+
+// PendingChange is a change to a sensitive key that has been submitted by one
+// admin and is waiting for approval by a second, distinct admin.
+type PendingChange struct {
+	ID        string         `json:"id"`
+	KeyID     string         `json:"key_id"`
+	Operation string         `json:"operation"`
+	ACL       ACL            `json:"acl,omitempty"`
+	VersionID uint64         `json:"version_id,omitempty"`
+	Status    *VersionStatus `json:"status,omitempty"`
+	Requester string         `json:"requester"`
+	// RequesterIDs are every identity the requester authenticated with, none
+	// of which may approve the change.
+	RequesterIDs []string `json:"requester_ids,omitempty"`
+	Created      int64    `json:"created"`
+	Expiry       int64    `json:"expiry"`
+}
+
+// EffectiveGrant explains what a single ACL entry on a key grants.
+type EffectiveGrant struct {
+	Entry Access `json:"entry"`
+	// Description is a human readable explanation of who the entry matches.
+	Description string `json:"description"`
+	// Default is true if the entry is one the server adds to every new key.
+	Default bool `json:"default"`
+	// Matches lists the known principals that the entry matches. It is only
+	// populated for prefix entries when the server has a principal inventory.
+	Matches []string `json:"matches,omitempty"`
+}
+
+// PrincipalKeyAccess describes the access a principal has to one key and the
+// ACL entries that grant it.
+type PrincipalKeyAccess struct {
+	KeyID      string     `json:"key_id"`
+	AccessType AccessType `json:"access"`
+	Entries    []Access   `json:"entries"`
+}
+
+// These are the sources of an authorization decision.
+const (
+	DecisionSourceACL            = "acl"
+	DecisionSourceAccessCallback = "access_callback"
+	DecisionSourceBreakGlass     = "break_glass"
+)
+
+// PrincipalDecision explains how the ACL of a key applies to one principal.
+type PrincipalDecision struct {
+	// Provider is the authentication provider that produced the principal, if known.
+	Provider  string         `json:"provider,omitempty"`
+	Principal []RawPrincipal `json:"principal"`
+	Allowed   bool           `json:"allowed"`
+	// Entries are the ACL entries granting the requested access.
+	Entries []EffectiveGrant `json:"entries"`
+	// OutsideNetworks are entries that would grant the access but are
+	// restricted to networks the request did not originate from.
+	OutsideNetworks []EffectiveGrant `json:"outside_networks,omitempty"`
+}
+
+// AuthorizationExplanation is the result of evaluating a principal's request
+// for a type of access to a key, without performing the access.
+type AuthorizationExplanation struct {
+	KeyID      string     `json:"key_id"`
+	AccessType AccessType `json:"access"`
+	// Origin is the client address the request was evaluated from, if known.
+	Origin  string `json:"origin,omitempty"`
+	Allowed bool   `json:"allowed"`
+	// Source is what allowed the request (see the DecisionSource constants),
+	// or empty if it was denied.
+	Source     string              `json:"source,omitempty"`
+	Principals []PrincipalDecision `json:"principals"`
+	// CallbackError is set if the access callback failed.
+	CallbackError string `json:"callback_error,omitempty"`
+}
+
+// MachinePrefixFinding reports a MachinePrefix entry that matches known hosts
+// in the middle of a name, e.g. the prefix "auth" matching "authz-evil01".
+type MachinePrefixFinding struct {
+	KeyID      string   `json:"key_id"`
+	Entry      Access   `json:"entry"`
+	Unintended []string `json:"unintended"`
+}
+
+// OrphanedKey reports a key that no user or user group can administer.
+type OrphanedKey struct {
+	KeyID  string   `json:"key_id"`
+	Admins []Access `json:"admins"`
+}
+
+// APIKeyInfo describes a Knox-issued API key. Keys are granted access through
+// ACL entries of type APIKey holding the key's ID, and are managed by members
+// of the owning team. IDs are random and never reused, so grants cannot pass
+// to a later key; Name is only a label for people. Token is only returned when the key is created; Knox
+// stores just a hash of it.
+type APIKeyInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Team    string `json:"team"`
+	Creator string `json:"creator"`
+	Created int64  `json:"created"`
+	Expiry  int64  `json:"expiry,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// SessionToken is a short-lived Knox session token, which authenticates as
+// the principals it was issued to until it expires or is revoked by ID.
+type SessionToken struct {
+	ID     string `json:"id"`
+	Token  string `json:"token"`
+	Expiry int64  `json:"expiry"`
+}
+
+// StepUpHeader carries the one-time code of a user's second factor, for
+// operations that the server requires a fresh second factor for.
+const StepUpHeader = "X-Knox-OTP"
+
+// TOTPEnrollment is a newly enrolled TOTP second factor. Secret is base32
+// encoded and URI is an otpauth:// URI for authenticator apps.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+var apiKeyNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// IsValidAPIKeyName reports whether name may be used for an API key.
+func IsValidAPIKeyName(name string) bool {
+	return apiKeyNameRegexp.MatchString(name)
+}
+
+var apiKeyIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// IsValidAPIKeyID reports whether id has the form of the IDs Knox generates
+// for API keys.
+func IsValidAPIKeyID(id string) bool {
+	return apiKeyIDRegexp.MatchString(id)
+}
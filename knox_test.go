@@ -3,6 +3,8 @@ package knox_test
 import (
 	"bytes"
 	"encoding/json"
+	"net"
+	"strings"
 	"testing"
 
 	. "github.com/pinterest/knox"
@@ -135,7 +137,7 @@ func TestAccessTypeMarshaling(t *testing.T) {
 	}
 }
 func TestPrincipalTypeMarshaling(t *testing.T) {
-	for _, in := range []PrincipalType{User, UserGroup, Machine, MachinePrefix, Service, ServicePrefix} {
+	for _, in := range []PrincipalType{User, UserGroup, Machine, MachinePrefix, Service, ServicePrefix, MachinePattern, APIKey} {
 		var out PrincipalType
 		marshalUnmarshal(t, &in, &out)
 		if in != out {
@@ -224,6 +226,91 @@ func TestACLValidate(t *testing.T) {
 	if dupACL.Validate() == nil {
 		t.Error("dupACL should err")
 	}
+
+	a8 := Access{ID: "testuser2", AccessType: Read, Type: User, Networks: NewNetworks("10.0.0.0/8", "2001:db8::/32")}
+	if err := (ACL{a1, a8}).Validate(); err != nil {
+		t.Errorf("networkACL should be valid, got %v", err)
+	}
+	a9 := Access{ID: "testuser3", AccessType: Read, Type: User, Networks: NewNetworks("10.0.0.1")}
+	if err := (ACL{a1, a9}).Validate(); err != ErrACLInvalidNetwork {
+		t.Errorf("expected ErrACLInvalidNetwork, got %v", err)
+	}
+}
+
+func TestACLHasHumanAdmin(t *testing.T) {
+	machineAdmin := Access{ID: "web001", AccessType: Admin, Type: Machine}
+	userWriter := Access{ID: "alice", AccessType: Write, Type: User}
+	if (ACL{machineAdmin, userWriter}).HasHumanAdmin() {
+		t.Error("expected no human admin")
+	}
+	if !(ACL{machineAdmin, {ID: "alice", AccessType: Admin, Type: User}}).HasHumanAdmin() {
+		t.Error("expected user admin to count")
+	}
+	if !(ACL{{ID: "security", AccessType: Admin, Type: UserGroup}}).HasHumanAdmin() {
+		t.Error("expected group admin to count")
+	}
+}
+
+func TestAccessAllowsOrigin(t *testing.T) {
+	open := Access{ID: "a", AccessType: Read, Type: User}
+	restricted := Access{ID: "b", AccessType: Read, Type: Machine, Networks: NewNetworks("10.0.0.0/8", "2001:db8::/32")}
+
+	cases := []struct {
+		ip         string
+		restricted bool
+	}{
+		{"10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"192.168.1.1", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if !open.AllowsOrigin(ip) {
+			t.Errorf("entry without networks should allow %q", c.ip)
+		}
+		if restricted.AllowsOrigin(ip) != c.restricted {
+			t.Errorf("expected %v for %q", c.restricted, c.ip)
+		}
+		filtered := ACL{open, restricted}.ForOrigin(ip)
+		if c.restricted && len(filtered) != 2 || !c.restricted && len(filtered) != 1 {
+			t.Errorf("unexpected filtered ACL for %q: %v", c.ip, filtered)
+		}
+	}
+
+	if !restricted.Equal(Access{ID: "b", AccessType: Read, Type: Machine, Networks: NewNetworks("10.0.0.0/8", "2001:db8::/32")}) {
+		t.Error("expected identical entries to be equal")
+	}
+	if restricted.Equal(Access{ID: "b", AccessType: Read, Type: Machine}) {
+		t.Error("expected entries with different networks to differ")
+	}
+}
+
+func TestNetworksJSON(t *testing.T) {
+	a := Access{ID: "b", AccessType: Read, Type: Machine, Networks: NewNetworks("10.0.0.0/8", " 2001:db8::/32")}
+	b, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"networks":["10.0.0.0/8","2001:db8::/32"]`) {
+		t.Fatalf("expected networks to be encoded as an array, got %s", b)
+	}
+	var decoded Access
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// Access is comparable, so it can be a map key.
+	if seen := map[Access]bool{a: true}; !seen[decoded] {
+		t.Fatalf("expected %+v to round trip, got %+v", a, decoded)
+	}
+
+	b, _ = json.Marshal(Access{ID: "b", AccessType: Read, Type: Machine})
+	if strings.Contains(string(b), "networks") {
+		t.Fatalf("expected networks to be omitted when empty, got %s", b)
+	}
+	if err := json.Unmarshal([]byte(`{"networks":["10.0.0.0/8,192.168.0.0/16"]}`), &decoded); err == nil {
+		t.Fatal("expected a network containing a comma to be refused")
+	}
 }
 
 func TestACLAddMultiple(t *testing.T) {
@@ -458,6 +545,20 @@ func TestPrincipalValidation(t *testing.T) {
 	// No trailing slash
 	validatePrincipal(ServicePrefix, "spiffe://example.com/foo", false)
 
+	// Machine patterns that are malformed or match arbitrary hosts
+	validatePrincipal(MachinePattern, "", false)
+	validatePrincipal(MachinePattern, "*", false)
+	validatePrincipal(MachinePattern, "*.*", false)
+	validatePrincipal(MachinePattern, "auth[0-9", false)
+	validatePrincipal(MachinePattern, "auth[a.b]", false)
+	validatePrincipal(MachinePattern, "^auth($", false)
+	validatePrincipal(MachinePattern, "^.*$", false)
+	validatePrincipal(MachinePattern, "^[a-z].*$", false)
+	validatePrincipal(APIKey, "ci deploy", false)
+	validatePrincipal(APIKey, "ci/deploy", false)
+	validatePrincipal(APIKey, "deploy", false)
+	validatePrincipal(APIKey, "0123456789ABCDEF0123456789ABCDEF", false)
+
 	// -- Valid examples --
 	validatePrincipal(User, "test", true)
 	validatePrincipal(UserGroup, "test", true)
@@ -465,4 +566,37 @@ func TestPrincipalValidation(t *testing.T) {
 	validatePrincipal(MachinePrefix, "test", true)
 	validatePrincipal(Service, "spiffe://example.com/service", true)
 	validatePrincipal(ServicePrefix, "spiffe://example.com/prefix/", true)
+	validatePrincipal(MachinePattern, "auth[0-9]*.prod.example.com", true)
+	validatePrincipal(MachinePattern, "auth*", true)
+	validatePrincipal(MachinePattern, `^auth[0-9]+\.prod\.example\.com$`, true)
+	validatePrincipal(APIKey, "0123456789abcdef0123456789abcdef", true)
+}
+
+func TestMachinePatternRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"auth[0-9]*", "auth001", true},
+		{"auth[0-9]*", "authz-evil01", false},
+		{"auth[0-9]*", "auth001.prod", false},
+		{"auth?.prod.example.com", "auth1.prod.example.com", true},
+		{"auth?.prod.example.com", "auth1xprodxexample.com", false},
+		{"*.prod.example.com", "auth1.prod.example.com", true},
+		{"*.prod.example.com", "a.b.prod.example.com", false},
+		{"web[!0-9]*", "webx", true},
+		{"web[!0-9]*", "web1", false},
+		{`^auth[0-9]+$`, "auth12", true},
+		{`^auth[0-9]+$`, "auth12z", false},
+	}
+	for _, c := range cases {
+		re, err := MachinePatternRegexp(c.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", c.pattern, err)
+		}
+		if re.MatchString(c.host) != c.match {
+			t.Errorf("%s matching %s: expected %v", c.pattern, c.host, c.match)
+		}
+	}
 }
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/internal/bounded"
+)
+
+// maxWebhookCacheEntries bounds the decision cache so that a flood of distinct
+// requests cannot grow it without limit. Expired entries are purged first.
+const maxWebhookCacheEntries = 10000
+
+// AccessWebhookConfig configures an AccessWebhook.
+type AccessWebhookConfig struct {
+	// URL is the endpoint of the authorization service. Inputs are POSTed to it
+	// as {"input": <AccessCallbackInput>} and it must reply with
+	// {"result": true|false}, following the OPA data API contract.
+	URL string
+
+	// Timeout bounds each call to the authorization service. Zero means no timeout.
+	Timeout time.Duration
+
+	// CacheTTL is how long a decision is reused for an identical input. Zero
+	// disables caching. Errors are never cached.
+	CacheTTL time.Duration
+
+	// FailOpen grants access when the authorization service cannot be reached
+	// or returns a malformed response. When false (the default), access is
+	// denied in that case.
+	FailOpen bool
+}
+
+// AccessWebhook is an access callback that delegates decisions to an external
+// HTTP authorization service. Install it with SetAccessCallback(w.Callback).
+type AccessWebhook struct {
+	url      string
+	ttl      time.Duration
+	failOpen bool
+	client   httpDoer
+	time     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]webhookDecision
+}
+
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type webhookDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+type webhookRequest struct {
+	Input knox.AccessCallbackInput `json:"input"`
+}
+
+type webhookResponse struct {
+	Result *bool `json:"result"`
+}
+
+// NewAccessWebhook builds an AccessWebhook from the given configuration.
+func NewAccessWebhook(cfg AccessWebhookConfig) (*AccessWebhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("access webhook requires a URL")
+	}
+	return &AccessWebhook{
+		url:      cfg.URL,
+		ttl:      cfg.CacheTTL,
+		failOpen: cfg.FailOpen,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		time:     time.Now,
+		cache:    map[string]webhookDecision{},
+	}, nil
+}
+
+// Callback implements the access callback signature expected by SetAccessCallback.
+func (w *AccessWebhook) Callback(input knox.AccessCallbackInput) (bool, error) {
+	input = scrubCallbackInput(input)
+	body, err := json.Marshal(webhookRequest{Input: input})
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(body)
+	cacheKey := hex.EncodeToString(sum[:])
+	if allow, ok := w.cached(cacheKey); ok {
+		return allow, nil
+	}
+
+	allow, err := w.query(body)
+	if err != nil {
+		log.Printf("access webhook failed for key %s (fail open: %v): %v", input.Key.ID, w.failOpen, err)
+		return w.failOpen, nil
+	}
+	w.store(cacheKey, allow)
+	return allow, nil
+}
+
+func (w *AccessWebhook) query(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("authorization service returned status %s", resp.Status)
+	}
+	decoded := webhookResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return false, err
+	}
+	if decoded.Result == nil {
+		return false, fmt.Errorf("authorization service response has no result")
+	}
+	return *decoded.Result, nil
+}
+
+func (w *AccessWebhook) cached(k string) (bool, bool) {
+	if w.ttl <= 0 {
+		return false, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	d, ok := w.cache[k]
+	if !ok {
+		return false, false
+	}
+	if !w.time().Before(d.expires) {
+		delete(w.cache, k)
+		return false, false
+	}
+	return d.allow, true
+}
+
+func (w *AccessWebhook) store(k string, allow bool) {
+	if w.ttl <= 0 {
+		return
+	}
+	now := w.time()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !bounded.MakeRoom(w.cache, maxWebhookCacheEntries, func(d webhookDecision) bool { return !now.Before(d.expires) }) {
+		clear(w.cache)
+	}
+	w.cache[k] = webhookDecision{allow: allow, expires: now.Add(w.ttl)}
+}
+
+// scrubCallbackInput removes key material from the input so that secrets are
+// never sent to the authorization service, and orders the principals so that
+// identical requests produce identical cache keys.
+func scrubCallbackInput(input knox.AccessCallbackInput) knox.AccessCallbackInput {
+	input.Key.VersionList = nil
+	input.Key.TinkKeyset = ""
+	principals := make([]knox.RawPrincipal, len(input.Principals))
+	copy(principals, input.Principals)
+	sort.Slice(principals, func(i, j int) bool {
+		if principals[i].Type == principals[j].Type {
+			return principals[i].ID < principals[j].ID
+		}
+		return principals[i].Type < principals[j].Type
+	})
+	input.Principals = principals
+	return input
+}
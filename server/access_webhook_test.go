@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func webhookTestInput() knox.AccessCallbackInput {
+	return knox.AccessCallbackInput{
+		Key: knox.Key{
+			ID:          "k1",
+			ACL:         knox.ACL{{ID: "alice", Type: knox.User, AccessType: knox.Admin}},
+			VersionList: knox.KeyVersionList{{ID: 1, Data: []byte("secret"), Status: knox.Primary}},
+		},
+		Principals: []knox.RawPrincipal{{ID: "bob", Type: "user"}},
+		AccessType: knox.Read,
+	}
+}
+
+func TestAccessWebhookDecision(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		req := webhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		if len(req.Input.Key.VersionList) != 0 {
+			t.Error("key versions must not be sent to the authorization service")
+		}
+		allow := req.Input.Principals[0].ID == "bob"
+		json.NewEncoder(w).Encode(map[string]bool{"result": allow})
+	}))
+	defer srv.Close()
+
+	w, err := NewAccessWebhook(AccessWebhookConfig{URL: srv.URL, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	w.time = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		allow, err := w.Callback(webhookTestInput())
+		if err != nil || !allow {
+			t.Fatalf("expected allow, got %v, %v", allow, err)
+		}
+	}
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("expected decision to be cached, got %d calls", c)
+	}
+
+	denied := webhookTestInput()
+	denied.Principals = []knox.RawPrincipal{{ID: "eve", Type: "user"}}
+	allow, err := w.Callback(denied)
+	if err != nil || allow {
+		t.Fatalf("expected deny, got %v, %v", allow, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	w.Callback(webhookTestInput())
+	if c := atomic.LoadInt32(&calls); c != 3 {
+		t.Fatalf("expected expired decision to be refetched, got %d calls", c)
+	}
+}
+
+func TestAccessWebhookFailureModes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if strings.HasSuffix(r.URL.Path, "/empty") {
+			w.Write([]byte("{}"))
+			return
+		}
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/error", "/slow", "/empty"} {
+		for _, failOpen := range []bool{true, false} {
+			w, err := NewAccessWebhook(AccessWebhookConfig{
+				URL:      srv.URL + path,
+				Timeout:  50 * time.Millisecond,
+				CacheTTL: time.Minute,
+				FailOpen: failOpen,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			allow, err := w.Callback(webhookTestInput())
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", path, err)
+			}
+			if allow != failOpen {
+				t.Fatalf("%s: expected %v with fail open %v, got %v", path, failOpen, failOpen, allow)
+			}
+			if len(w.cache) != 0 {
+				t.Fatalf("%s: failures must not be cached", path)
+			}
+		}
+	}
+}
+
+func TestNewAccessWebhookRequiresURL(t *testing.T) {
+	if _, err := NewAccessWebhook(AccessWebhookConfig{}); err == nil {
+		t.Fatal("expected error for missing URL")
+	}
+}
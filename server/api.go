@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
@@ -32,23 +33,30 @@ func errF(c int, m string) *HTTPError {
 type httpErrResp struct {
 	Code    int
 	Message string
+	// Type names the error in v1 responses.
+	Type string
 }
 
 // HTTPErrMap is a mapping from err subcodes to the http err response that will be returned.
 var HTTPErrMap = map[int]*httpErrResp{
-	knox.NoKeyIDCode:                   {http.StatusBadRequest, "Missing Key ID"},
-	knox.InternalServerErrorCode:       {http.StatusInternalServerError, "Internal Server Error"},
-	knox.KeyIdentifierExistsCode:       {http.StatusBadRequest, "Key identifier exists"},
-	knox.KeyVersionDoesNotExistCode:    {http.StatusNotFound, "Key version does not exist"},
-	knox.KeyIdentifierDoesNotExistCode: {http.StatusNotFound, "Key identifier does not exist"},
-	knox.UnauthenticatedCode:           {http.StatusUnauthorized, "User or machine is not authenticated"},
-	knox.UnauthorizedCode:              {http.StatusForbidden, "User or machine not authorized"},
-	knox.NotYetImplementedCode:         {http.StatusNotImplemented, "Not yet implemented"},
-	knox.NotFoundCode:                  {http.StatusNotFound, "Route not found"},
-	knox.NoKeyDataCode:                 {http.StatusBadRequest, "Missing Key Data"},
-	knox.BadRequestDataCode:            {http.StatusBadRequest, "Bad request format"},
-	knox.BadKeyFormatCode:              {http.StatusBadRequest, "Key ID contains unsupported characters"},
-	knox.BadPrincipalIdentifier:        {http.StatusBadRequest, "Invalid principal identifier"},
+	knox.NoKeyIDCode:                   {http.StatusBadRequest, "Missing Key ID", "no_key_id"},
+	knox.InternalServerErrorCode:       {http.StatusInternalServerError, "Internal Server Error", "internal_error"},
+	knox.KeyIdentifierExistsCode:       {http.StatusBadRequest, "Key identifier exists", "key_exists"},
+	knox.KeyVersionDoesNotExistCode:    {http.StatusNotFound, "Key version does not exist", "key_version_not_found"},
+	knox.KeyIdentifierDoesNotExistCode: {http.StatusNotFound, "Key identifier does not exist", "key_not_found"},
+	knox.UnauthenticatedCode:           {http.StatusUnauthorized, "User or machine is not authenticated", "unauthenticated"},
+	knox.UnauthorizedCode:              {http.StatusForbidden, "User or machine not authorized", "unauthorized"},
+	knox.NotYetImplementedCode:         {http.StatusNotImplemented, "Not yet implemented", "not_implemented"},
+	knox.NotFoundCode:                  {http.StatusNotFound, "Route not found", "route_not_found"},
+	knox.NoKeyDataCode:                 {http.StatusBadRequest, "Missing Key Data", "no_key_data"},
+	knox.BadRequestDataCode:            {http.StatusBadRequest, "Bad request format", "bad_request"},
+	knox.BadKeyFormatCode:              {http.StatusBadRequest, "Key ID contains unsupported characters", "bad_key_id"},
+	knox.BadPrincipalIdentifier:        {http.StatusBadRequest, "Invalid principal identifier", "bad_principal"},
+	knox.PendingApprovalCode:           {http.StatusAccepted, "Change submitted for approval", "pending_approval"},
+	knox.PendingChangeDoesNotExistCode: {http.StatusNotFound, "Pending change does not exist", "pending_change_not_found"},
+	knox.APIKeyDoesNotExistCode:        {http.StatusNotFound, "API key does not exist", "api_key_not_found"},
+	knox.TooManyRequestsCode:           {http.StatusTooManyRequests, "Too many failed authentication attempts", "too_many_requests"},
+	knox.StepUpRequiredCode:            {http.StatusUnauthorized, "Second factor required", "step_up_required"},
 }
 
 func combine(f, g func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
@@ -63,12 +71,16 @@ func GetRouterFromKeyManager(
 	keyManager KeyManager,
 	decorators [](func(http.HandlerFunc) http.HandlerFunc),
 	additionalRoutes []Route) (*mux.Router, error) {
-	existingRouteIds := map[string]Route{}
+	type routeKey struct {
+		id      string
+		version int
+	}
+	existingRouteIds := map[routeKey]Route{}
 	existingRouteMethodAndPaths := map[string]map[string]Route{}
 	allRoutes := append(routes[:], additionalRoutes[:]...)
 
 	for _, route := range allRoutes {
-		if _, routeExists := existingRouteIds[route.Id]; routeExists {
+		if _, routeExists := existingRouteIds[routeKey{route.Id, route.Version}]; routeExists {
 			return nil, fmt.Errorf(
 				"there are ID conflicts for the route with ID: '%v'",
 				route.Id,
@@ -90,7 +102,7 @@ func GetRouterFromKeyManager(
 		}
 
 		existingRouteMethodAndPaths[route.Method][route.Path] = route
-		existingRouteIds[route.Id] = route
+		existingRouteIds[routeKey{route.Id, route.Version}] = route
 	}
 
 	r := mux.NewRouter()
@@ -101,7 +113,16 @@ func GetRouterFromKeyManager(
 		decorator = combine(decorators[j], decorator)
 	}
 
-	r.NotFoundHandler = setupRoute("404", keyManager)(decorator(WriteErr(errF(knox.NotFoundCode, ""))))
+	notFound := decorator(WriteErr(errF(knox.NotFoundCode, "")))
+	v0NotFound := setupRoute("404", 0, keyManager)(notFound)
+	v1NotFound := setupRoute("404", 1, keyManager)(notFound)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/v1/") {
+			v1NotFound(w, req)
+			return
+		}
+		v0NotFound(w, req)
+	})
 
 	for _, route := range allRoutes {
 		addRoute(r, route, decorator, keyManager)
@@ -128,7 +149,7 @@ func addRoute(
 	route Route,
 	routeDecorator func(f http.HandlerFunc) http.HandlerFunc,
 	keyManager KeyManager) {
-	handler := setupRoute(route.Id, keyManager)(parseParams(route.Parameters)(routeDecorator(route.ServeHTTP)))
+	handler := setupRoute(route.Id, route.Version, keyManager)(parseParams(route.Parameters)(routeDecorator(route.ServeHTTP)))
 	router.Handle(route.Path, handler).Methods(route.Method)
 }
 
@@ -212,6 +233,52 @@ func (p PostParameter) Name() string {
 	return string(p)
 }
 
+// maxJSONBodySize bounds JSON request bodies, matching the limit that
+// http.Request.ParseForm applies to form bodies.
+const maxJSONBodySize = 10 << 20
+
+// JSONBodyParameter is an implementation of the Parameter interface that
+// extracts the JSON document sent as the request body. Handlers decode it
+// with decodeJSONBody.
+type JSONBodyParameter string
+
+// Get returns the request body, or false if there is none
+func (p JSONBodyParameter) Get(r *http.Request) (string, bool) {
+	if r.Body == nil {
+		return "", false
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxJSONBodySize))
+	if err != nil || len(b) == 0 {
+		return "", false
+	}
+	return string(b), true
+}
+
+// Name represents the key corresponding to the request body in the
+// `parameters` map of the route handler function.
+func (p JSONBodyParameter) Name() string {
+	return string(p)
+}
+
+// decodeJSONBody decodes the JSON request body stored in parameters under
+// name into v. Unknown fields are refused so that misspelled fields are not
+// silently ignored.
+func decodeJSONBody(parameters map[string]string, name string, v interface{}) *HTTPError {
+	body, ok := parameters[name]
+	if !ok {
+		return errF(knox.BadRequestDataCode, "Missing JSON request body")
+	}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid JSON request body: %v", err))
+	}
+	if decoder.More() {
+		return errF(knox.BadRequestDataCode, "Invalid JSON request body: unexpected data after the document")
+	}
+	return nil
+}
+
 // Route is a struct that defines a path and method-specific
 // HTTP route on the Knox server
 type Route struct {
@@ -220,9 +287,17 @@ type Route struct {
 	Handler func(db KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError)
 
 	// Id represents A unique string identifier that represents this specific
-	// route
+	// route. Routes of different versions that perform the same operation
+	// share an Id, so that policies configured by route Id apply to all
+	// versions of the operation.
 	Id string
 
+	// Version is the API version whose conventions the route follows. Version
+	// 0 routes wrap responses in a knox.Response. Version 1 routes respond
+	// with the resource itself, or a knox.ErrorResponse, and use the HTTP
+	// status to report the outcome (see WriteResource).
+	Version int
+
 	// Path represents the relative HTTP path (or prefix) that must be specified
 	//  in order to invoke this route
 	Path string
@@ -236,10 +311,20 @@ type Route struct {
 	Parameters []Parameter
 }
 
+// v1ErrStatus overrides the HTTP status of errors in v1 responses where the
+// v0 status is kept for compatibility with old clients.
+var v1ErrStatus = map[int]int{
+	knox.KeyIdentifierExistsCode: http.StatusConflict,
+}
+
 // WriteErr returns a function that can encode error information and set an
 // HTTP error response code in the specified HTTP response writer
 func WriteErr(apiErr *HTTPError) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if getAPIVersion(r) >= 1 {
+			writeV1Err(w, r, apiErr)
+			return
+		}
 		resp := new(knox.Response)
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -281,15 +366,75 @@ func WriteData(w http.ResponseWriter, data interface{}) {
 	}
 }
 
+// errStatus returns the HTTP status of errors with subcode in responses of
+// the given API version.
+func errStatus(subcode, version int) int {
+	if c, ok := v1ErrStatus[subcode]; ok && version >= 1 {
+		return c
+	}
+	return HTTPErrMap[subcode].Code
+}
+
+// writeV1Err writes apiErr as a knox.ErrorResponse.
+func writeV1Err(w http.ResponseWriter, r *http.Request, apiErr *HTTPError) {
+	resp := HTTPErrMap[apiErr.Subcode]
+	code := errStatus(apiErr.Subcode, 1)
+	message := apiErr.Message
+	if message == "" {
+		message = resp.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	setAPIError(r, apiErr)
+
+	body := knox.ErrorResponse{Error: knox.APIError{Type: resp.Type, Code: apiErr.Subcode, Message: message}}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		// It is unclear what to do here since the server failed to write the response.
+		log.Println(err)
+	}
+}
+
+// WriteResource writes data as the response to a successful v1 request. The
+// status is 204 No Content if there is no data, 202 Accepted for changes held
+// for approval, whose pending change is the data, 201 Created for POST
+// requests and 200 OK otherwise.
+func WriteResource(w http.ResponseWriter, r *http.Request, data interface{}) {
+	if data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := data.(*knox.PendingChange); ok && r.Method != "GET" {
+		w.WriteHeader(http.StatusAccepted)
+	} else if r.Method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		// It is unclear what to do here since the server failed to write the response.
+		log.Println(err)
+	}
+}
+
 // ServeHTTP runs API middleware and calls the underlying handler function.
 func (r Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	db := getDB(req)
 	principal := GetPrincipal(req)
 	ps := GetParams(req)
+	principal, err := checkProviders(r.Id, principal)
+	if err != nil {
+		WriteErr(err)(w, req)
+		return
+	}
+	if err := checkStepUp(r.Id, principal, ps, req.Header.Get(knox.StepUpHeader)); err != nil {
+		WriteErr(err)(w, req)
+		return
+	}
 	data, err := r.Handler(db, principal, ps)
 
 	if err != nil {
 		WriteErr(err)(w, req)
+	} else if r.Version >= 1 {
+		WriteResource(w, req, data)
 	} else {
 		WriteData(w, data)
 	}
@@ -304,6 +449,30 @@ func AddDefaultAccess(a *knox.Access) {
 	defaultAccess = append(defaultAccess, *a)
 }
 
+type keyLabelRule struct {
+	prefix string
+	label  string
+}
+
+// Labels attached to keys by key ID prefix. Labels are server configuration
+// rather than key data and are used to select keys for stricter policies.
+var keyLabelRules []keyLabelRule
+
+// AddKeyLabel attaches label to every key whose ID starts with keyIDPrefix.
+func AddKeyLabel(keyIDPrefix, label string) {
+	keyLabelRules = append(keyLabelRules, keyLabelRule{keyIDPrefix, label})
+}
+
+// keyHasLabel reports whether any configured rule attaches label to keyID.
+func keyHasLabel(keyID, label string) bool {
+	for _, r := range keyLabelRules {
+		if r.label == label && strings.HasPrefix(keyID, r.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 var accessCallback func(knox.AccessCallbackInput) (bool, error)
 
 // SetAccessCallback adds a callback.
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// apiKeyStore holds Knox-issued API keys. When nil (the default), the API key
+// routes are disabled. The same store must be given to auth.NewAPIKeyProvider
+// for the keys to authenticate.
+var apiKeyStore auth.APIKeyStore
+
+// SetAPIKeyStore enables issuing API keys into store. Pass nil to disable it.
+func SetAPIKeyStore(s auth.APIKeyStore) {
+	apiKeyStore = s
+}
+
+// inTeam reports whether principal is a user in the team's user group. API
+// keys are managed only by users, so one API key cannot mint another.
+func inTeam(principal knox.Principal, team string) bool {
+	if !auth.IsUser(principal) {
+		return false
+	}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: team, AccessType: knox.Read}}
+	return principal.CanAccess(acl, knox.Read)
+}
+
+// createAPIKey issues a new API key owned by team, valid for ttl if positive.
+func createAPIKey(principal knox.Principal, name, team string, ttl time.Duration, now time.Time) (*knox.APIKeyInfo, *HTTPError) {
+	if !knox.IsValidAPIKeyName(name) {
+		return nil, errF(knox.BadRequestDataCode, knox.ErrACLInvalidAPIKeyName.Error())
+	}
+	if team == "" {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'team'")
+	}
+	if !inTeam(principal, team) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not a member of team %s", principal.GetID(), team))
+	}
+	info := knox.APIKeyInfo{
+		Name:    name,
+		Team:    team,
+		Creator: principal.GetID(),
+		Created: now.UnixNano(),
+	}
+	if ttl > 0 {
+		info.Expiry = now.Add(ttl).UnixNano()
+	}
+	record, token, err := auth.NewAPIKeyRecord(info)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	if err := apiKeyStore.Add(record); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	created := record.APIKeyInfo
+	created.Token = token
+	return &created, nil
+}
+
+// listAPIKeys returns the keys of the teams principal belongs to, restricted
+// to team if it is set, oldest first.
+func listAPIKeys(principal knox.Principal, team string) ([]knox.APIKeyInfo, error) {
+	all, err := apiKeyStore.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	member := map[string]bool{}
+	keys := []knox.APIKeyInfo{}
+	for _, r := range all {
+		if team != "" && r.Team != team {
+			continue
+		}
+		if _, ok := member[r.Team]; !ok {
+			member[r.Team] = inTeam(principal, r.Team)
+		}
+		if member[r.Team] {
+			keys = append(keys, r.APIKeyInfo)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+	return keys, nil
+}
+
+// revokeAPIKey deletes the key with the given ID if principal is in its team.
+func revokeAPIKey(principal knox.Principal, id string) *HTTPError {
+	record, err := apiKeyStore.Get(id)
+	if err != nil {
+		if err == auth.ErrAPIKeyNotFound {
+			return errF(knox.APIKeyDoesNotExistCode, fmt.Sprintf("No such API key %s", id))
+		}
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+	if !inTeam(principal, record.Team) {
+		return errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not a member of team %s", principal.GetID(), record.Team))
+	}
+	if err := apiKeyStore.Remove(id); err != nil {
+		if err == auth.ErrAPIKeyNotFound {
+			return errF(knox.APIKeyDoesNotExistCode, fmt.Sprintf("No such API key %s", id))
+		}
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return nil
+}
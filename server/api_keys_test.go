@@ -0,0 +1,107 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestAPIKeys(t *testing.T) {
+	store := auth.NewTempAPIKeyStore()
+	SetAPIKeyStore(store)
+	defer SetAPIKeyStore(nil)
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", []string{"ci-team"})
+	bob := auth.NewUser("bob", []string{"web-team"})
+
+	// Only members of the owning team can create keys for it.
+	if _, err := postAPIKeyHandler(m, bob, map[string]string{"name": "deploy", "team": "ci-team"}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+	for _, params := range []map[string]string{
+		{"name": "bad name", "team": "ci-team"},
+		{"name": "deploy"},
+		{"name": "deploy", "team": "ci-team", "ttl": "soon"},
+	} {
+		if _, err := postAPIKeyHandler(m, alice, params); err == nil || err.Subcode != knox.BadRequestDataCode {
+			t.Fatalf("%v: expected bad request, got %+v", params, err)
+		}
+	}
+
+	i, err := postAPIKeyHandler(m, alice, map[string]string{"name": "deploy", "team": "ci-team", "ttl": "24h"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	created := i.(*knox.APIKeyInfo)
+	if created.Token == "" || created.Creator != "alice" || created.Expiry == 0 {
+		t.Fatalf("unexpected key %+v", created)
+	}
+
+	// The token authenticates as an API key principal, which is granted
+	// access only by APIKey entries.
+	principal, authErr := auth.NewAPIKeyProvider(store).Authenticate(created.Token, nil)
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+	acl := `[{"type":"UserGroup","id":"ci-team","access":"Admin"},{"type":"APIKey","id":"` + created.ID + `","access":"Read"}]`
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "ci_secret", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "other_secret", "data": "MQ==", "acl": `[{"type":"UserGroup","id":"ci-team","access":"Admin"}]`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := getKeyHandler(m, principal, map[string]string{"keyID": "ci_secret"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := getKeyHandler(m, principal, map[string]string{"keyID": "other_secret"}); err == nil {
+		t.Fatal("expected API key not to inherit its team's access")
+	}
+
+	// ACL entries name API keys by their ID, never by their reusable name.
+	if _, err := putAccessHandler(m, alice, map[string]string{"keyID": "ci_secret", "acl": `[{"type":"APIKey","id":"deploy","access":"Read"}]`}); err == nil || err.Subcode != knox.BadPrincipalIdentifier {
+		t.Fatalf("expected bad principal, got %+v", err)
+	}
+
+	// API keys cannot mint or manage API keys.
+	if _, err := postAPIKeyHandler(m, principal, map[string]string{"name": "child", "team": "ci-team"}); err == nil {
+		t.Fatal("expected API key principal to be unable to create keys")
+	}
+
+	// Listing shows only the principal's teams and never returns tokens.
+	i, err = getAPIKeysHandler(m, alice, map[string]string{})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	keys := i.([]knox.APIKeyInfo)
+	if len(keys) != 1 || keys[0].Name != "deploy" || keys[0].Token != "" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	i, _ = getAPIKeysHandler(m, bob, map[string]string{})
+	if len(i.([]knox.APIKeyInfo)) != 0 {
+		t.Fatal("expected keys of other teams to be hidden")
+	}
+
+	// Revocation takes effect immediately.
+	if _, err := deleteAPIKeyHandler(m, bob, map[string]string{"apiKeyID": created.ID}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+	if _, err := deleteAPIKeyHandler(m, alice, map[string]string{"apiKeyID": created.ID}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := deleteAPIKeyHandler(m, alice, map[string]string{"apiKeyID": created.ID}); err == nil || err.Subcode != knox.APIKeyDoesNotExistCode {
+		t.Fatalf("expected not found, got %+v", err)
+	}
+	if _, authErr := auth.NewAPIKeyProvider(store).Authenticate(created.Token, nil); authErr == nil {
+		t.Fatal("expected revoked key to fail authentication")
+	}
+}
+
+func TestAPIKeysDisabled(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", []string{"ci-team"})
+	if _, err := getAPIKeysHandler(m, u, map[string]string{}); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented, got %+v", err)
+	}
+}
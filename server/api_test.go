@@ -304,6 +304,10 @@ func TestScrub(t *testing.T) {
 	if v, ok := r["data"]; !ok || v == "secret_sauce" {
 		t.Fatal("data should be scrubbed, but still present.")
 	}
+	r = scrub(map[string]string{"body": `{"data": "c2VjcmV0X3NhdWNl"}`})
+	if v, ok := r["body"]; !ok || strings.Contains(v, "c2VjcmV0X3NhdWNl") {
+		t.Fatal("body should be scrubbed, but still present.")
+	}
 }
 
 func TestDuplicateRouteId(t *testing.T) {
@@ -403,3 +407,66 @@ func TestAdditionalRouteFunctionality(t *testing.T) {
 		)
 	}
 }
+
+func TestSchemeProviderMatch(t *testing.T) {
+	github := auth.MockGitHubProvider()
+	apiKeys := auth.NewAPIKeyProvider(auth.NewTempAPIKeyStore())
+	cases := []struct {
+		provider      auth.Provider
+		header, value string
+		match         bool
+		payload       string
+	}{
+		{github, "Authorization", "0utoken", true, "token"},
+		{github, "Authorization", "Knox-GitHub token", true, "token"},
+		{github, "Authorization", "knox-github  token ", true, "token"},
+		{github, "Authorization", "Bearer token", false, ""},
+		{github, "Authorization", "Knox-GitHub ", false, ""},
+		{github, "Authorization", "0atoken", false, ""},
+		{apiKeys, "Authorization", "0atoken", true, "token"},
+		{apiKeys, "Authorization", "Knox-API-Key token", true, "token"},
+		{apiKeys, "X-Knox-API-Key", "token", true, "token"},
+		{apiKeys, "Authorization", "Knox-GitHub token", false, ""},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set(c.header, c.value)
+		match, payload := SchemeProviderMatch(c.provider, r)
+		if match != c.match || payload != c.payload {
+			t.Errorf("%s %s: %q: got %v %q", c.provider.Name(), c.header, c.value, match, payload)
+		}
+	}
+}
+
+func TestRouteIdVersions(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	db := keydb.NewTempDB()
+	decorators := [](func(http.HandlerFunc) http.HandlerFunc){}
+
+	// An Id may be reused by a route of another version, but not twice within one.
+	route := additionalMockRoute()
+	route.Id = "getkeys"
+	route.Version = 2
+	if _, err := GetRouter(cryptor, db, decorators, []Route{route}); err != nil {
+		t.Fatalf("Did not expect an error while creating router. Details: %v", err)
+	}
+	route.Version = 1
+	if _, err := GetRouter(cryptor, db, decorators, []Route{route}); err == nil {
+		t.Fatal("Expected an error when two v1 routes were provided with duplicate IDs")
+	}
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	var req knox.VersionCreateRequest
+	for _, body := range []string{`{"data": "bm90IGJhc2U2NA"}`, `{"data": "Zmlyc3Q="} {}`, `{"data": "Zmlyc3Q=", "extra": 1}`} {
+		if err := decodeJSONBody(map[string]string{"body": body}, "body", &req); err == nil || err.Subcode != knox.BadRequestDataCode {
+			t.Errorf("expected %s to be refused, got %+v", body, err)
+		}
+	}
+	if err := decodeJSONBody(map[string]string{}, "body", &req); err == nil {
+		t.Error("expected a missing body to be refused")
+	}
+	if err := decodeJSONBody(map[string]string{"body": `{"data": "Zmlyc3Q="}`}, "body", &req); err != nil || string(req.Data) != "first" {
+		t.Fatalf("unexpected %+v %q", err, req.Data)
+	}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// These are the operations that may be held for approval.
+const (
+	OperationDeleteKey  = "deletekey"
+	OperationPutAccess  = "putaccess"
+	OperationPutVersion = "putversion"
+)
+
+// SensitiveLabel is the default key label that triggers two-person approval.
+const SensitiveLabel = "sensitive"
+
+// defaultPendingChangeTTL is used when ApprovalConfig.TTL is unset.
+const defaultPendingChangeTTL = 24 * time.Hour
+
+// ErrPendingChangeNotFound is returned by a PendingChangeStore for unknown IDs.
+var ErrPendingChangeNotFound = fmt.Errorf("Pending change not found")
+
+// PendingChangeStore persists changes awaiting approval.
+//
+// Remove must fail with ErrPendingChangeNotFound if the change does not exist,
+// as that is what guarantees a change is applied at most once.
+type PendingChangeStore interface {
+	Add(c knox.PendingChange) error
+	Get(id string) (*knox.PendingChange, error)
+	GetAll() ([]knox.PendingChange, error)
+	Remove(id string) error
+}
+
+// NewTempPendingChangeStore creates an in memory PendingChangeStore. Like
+// keydb.TempDB it does no replication across servers and is meant for tests
+// and single-server deployments.
+func NewTempPendingChangeStore() PendingChangeStore {
+	return &tempPendingChangeStore{changes: map[string]knox.PendingChange{}}
+}
+
+type tempPendingChangeStore struct {
+	sync.Mutex
+	changes map[string]knox.PendingChange
+}
+
+func (s *tempPendingChangeStore) Add(c knox.PendingChange) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.changes[c.ID]; ok {
+		return fmt.Errorf("pending change %s already exists", c.ID)
+	}
+	s.changes[c.ID] = c
+	return nil
+}
+
+func (s *tempPendingChangeStore) Get(id string) (*knox.PendingChange, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.changes[id]
+	if !ok {
+		return nil, ErrPendingChangeNotFound
+	}
+	return &c, nil
+}
+
+func (s *tempPendingChangeStore) GetAll() ([]knox.PendingChange, error) {
+	s.Lock()
+	defer s.Unlock()
+	all := make([]knox.PendingChange, 0, len(s.changes))
+	for _, c := range s.changes {
+		all = append(all, c)
+	}
+	return all, nil
+}
+
+func (s *tempPendingChangeStore) Remove(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.changes[id]; !ok {
+		return ErrPendingChangeNotFound
+	}
+	delete(s.changes, id)
+	return nil
+}
+
+// ApprovalConfig configures two-person approval.
+type ApprovalConfig struct {
+	// Store holds pending changes. Required.
+	Store PendingChangeStore
+
+	// TTL is how long a change may wait for approval before it is discarded.
+	// Defaults to 24 hours.
+	TTL time.Duration
+
+	// Label selects the keys that require approval (see AddKeyLabel).
+	// Defaults to SensitiveLabel.
+	Label string
+}
+
+// TwoPersonApproval holds changes to labelled keys until a second admin,
+// distinct from the requester, approves them.
+type TwoPersonApproval struct {
+	store PendingChangeStore
+	ttl   time.Duration
+	label string
+	time  func() time.Time
+}
+
+// NewTwoPersonApproval builds a TwoPersonApproval from the given configuration.
+func NewTwoPersonApproval(cfg ApprovalConfig) (*TwoPersonApproval, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("two-person approval requires a pending change store")
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultPendingChangeTTL
+	}
+	label := cfg.Label
+	if label == "" {
+		label = SensitiveLabel
+	}
+	return &TwoPersonApproval{
+		store: cfg.Store,
+		ttl:   ttl,
+		label: label,
+		time:  time.Now,
+	}, nil
+}
+
+// twoPersonApproval is consulted by the mutating handlers when set. When nil
+// (the default), changes are applied immediately.
+var twoPersonApproval *TwoPersonApproval
+
+// SetTwoPersonApproval enables two-person approval. Pass nil to disable it.
+func SetTwoPersonApproval(a *TwoPersonApproval) {
+	twoPersonApproval = a
+}
+
+// requiresApproval reports whether changes to keyID must be approved.
+func requiresApproval(keyID string) bool {
+	return twoPersonApproval != nil && keyHasLabel(keyID, twoPersonApproval.label)
+}
+
+// submit stores change as pending and returns it, so that the caller learns
+// the ID under which it awaits approval.
+func (a *TwoPersonApproval) submit(principal knox.Principal, change knox.PendingChange) (*knox.PendingChange, *HTTPError) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	now := a.time()
+	change.ID = hex.EncodeToString(id)
+	change.Requester = principal.GetID()
+	change.RequesterIDs = principalIDs(principal)
+	change.Created = now.UnixNano()
+	change.Expiry = now.Add(a.ttl).UnixNano()
+	if err := a.store.Add(change); err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return &change, nil
+}
+
+// pendingResult returns the result of a handler that may hold its change for
+// approval: the pending change if it was held, and no data if it was applied.
+func pendingResult(change *knox.PendingChange, httpErr *HTTPError) (interface{}, *HTTPError) {
+	if change == nil {
+		return nil, httpErr
+	}
+	return change, httpErr
+}
+
+// get returns an unexpired pending change, discarding it if it has expired.
+func (a *TwoPersonApproval) get(id string) (*knox.PendingChange, error) {
+	c, err := a.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.time().UnixNano() >= c.Expiry {
+		a.store.Remove(id)
+		return nil, ErrPendingChangeNotFound
+	}
+	return c, nil
+}
+
+// list returns all unexpired pending changes, oldest first, discarding any
+// that have expired.
+func (a *TwoPersonApproval) list() ([]knox.PendingChange, error) {
+	all, err := a.store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	now := a.time().UnixNano()
+	live := []knox.PendingChange{}
+	for _, c := range all {
+		if now >= c.Expiry {
+			a.store.Remove(c.ID)
+			continue
+		}
+		live = append(live, c)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Created < live[j].Created })
+	return live, nil
+}
+
+// applyPendingChange performs the change through the KeyManager, mapping
+// errors the same way the original handlers do.
+func applyPendingChange(m KeyManager, c *knox.PendingChange) *HTTPError {
+	switch c.Operation {
+	case OperationDeleteKey:
+		if err := m.DeleteKey(c.KeyID); err != nil {
+			return errF(knox.InternalServerErrorCode, err.Error())
+		}
+		return nil
+	case OperationPutAccess:
+		if err := m.UpdateAccess(c.KeyID, c.ACL...); err != nil {
+			return errF(knox.InternalServerErrorCode, err.Error())
+		}
+		return nil
+	case OperationPutVersion:
+		if c.Status == nil {
+			return errF(knox.BadRequestDataCode, "Pending version change has no status")
+		}
+		return updateVersionErr(m.UpdateVersion(c.KeyID, c.VersionID, *c.Status))
+	default:
+		return errF(knox.InternalServerErrorCode, fmt.Sprintf("Unknown pending operation %s", c.Operation))
+	}
+}
+
+// principalIDs returns every identity of principal, starting with its ID.
+func principalIDs(principal knox.Principal) []string {
+	ids := []string{principal.GetID()}
+	for _, raw := range principal.Raw() {
+		if raw.ID != principal.GetID() {
+			ids = append(ids, raw.ID)
+		}
+	}
+	return ids
+}
+
+// isRequester reports whether any identity of principal is one the change
+// was submitted with.
+func isRequester(principal knox.Principal, c *knox.PendingChange) bool {
+	for _, id := range principalIDs(principal) {
+		if id == c.Requester {
+			return true
+		}
+		for _, requester := range c.RequesterIDs {
+			if id == requester {
+				return true
+			}
+		}
+	}
+	return false
+}
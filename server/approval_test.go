@@ -0,0 +1,210 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func setupApproval(t *testing.T) (*TwoPersonApproval, func()) {
+	a, err := NewTwoPersonApproval(ApprovalConfig{Store: NewTempPendingChangeStore(), TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddKeyLabel("prod_", SensitiveLabel)
+	SetTwoPersonApproval(a)
+	return a, func() {
+		SetTwoPersonApproval(nil)
+		keyLabelRules = nil
+	}
+}
+
+func pendingChanges(t *testing.T, m KeyManager, p knox.Principal) []knox.PendingChange {
+	i, err := getPendingChangesHandler(m, p, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	return i.([]knox.PendingChange)
+}
+
+// expectPending checks that a handler held its change for approval.
+func expectPending(t *testing.T, i interface{}, err *HTTPError) *knox.PendingChange {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("expected pending approval, got %+v", err)
+	}
+	change, ok := i.(*knox.PendingChange)
+	if !ok || change.ID == "" {
+		t.Fatalf("expected the pending change, got %+v", i)
+	}
+	return change
+}
+
+func TestTwoPersonApproval(t *testing.T) {
+	_, cleanup := setupApproval(t)
+	defer cleanup()
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", []string{"admins"})
+	bob := auth.NewUser("bob", []string{"admins"})
+	eve := auth.NewUser("eve", []string{})
+	acl := `[{"type":"UserGroup","id":"admins","access":"Admin"}]`
+	for _, id := range []string{"prod_db", "dev_db"} {
+		if _, err := postKeysHandler(m, alice, map[string]string{"id": id, "data": "MQ==", "acl": acl}); err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+
+	// Unlabelled keys are changed immediately.
+	if _, err := deleteKeyHandler(m, alice, map[string]string{"keyID": "dev_db"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Unauthorized principals can't submit changes.
+	_, err := putAccessHandler(m, eve, map[string]string{"keyID": "prod_db", "access": `{"type":"User","id":"eve","access":"Admin"}`})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+
+	i, err := putAccessHandler(m, alice, map[string]string{"keyID": "prod_db", "access": `{"type":"User","id":"carol","access":"Read"}`})
+	pending := expectPending(t, i, err)
+	key, _ := m.GetKey("prod_db", knox.Primary)
+	if auth.NewUser("carol", nil).CanAccess(key.ACL, knox.Read) {
+		t.Fatal("access change must not be applied before approval")
+	}
+
+	changes := pendingChanges(t, m, eve)
+	if len(changes) != 1 || changes[0].ID != pending.ID || changes[0].Requester != "alice" || changes[0].Operation != OperationPutAccess {
+		t.Fatalf("unexpected pending changes %+v", changes)
+	}
+	id := changes[0].ID
+
+	if _, err := approvePendingChangeHandler(m, alice, map[string]string{"changeID": id}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("requester must not approve own change, got %+v", err)
+	}
+	if _, err := approvePendingChangeHandler(m, eve, map[string]string{"changeID": id}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("non-admin must not approve, got %+v", err)
+	}
+	if _, err := approvePendingChangeHandler(m, bob, map[string]string{"changeID": id}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key, _ = m.GetKey("prod_db", knox.Primary)
+	if !auth.NewUser("carol", nil).CanAccess(key.ACL, knox.Read) {
+		t.Fatal("access change should be applied after approval")
+	}
+	if _, err := approvePendingChangeHandler(m, bob, map[string]string{"changeID": id}); err == nil || err.Subcode != knox.PendingChangeDoesNotExistCode {
+		t.Fatalf("approved change must not be applied twice, got %+v", err)
+	}
+
+	// Version changes and deletes are held too.
+	i, _ = postVersionHandler(m, alice, map[string]string{"keyID": "prod_db", "data": "Mg=="})
+	versionID := i.(uint64)
+	i, err = putVersionsHandler(m, alice, map[string]string{"keyID": "prod_db", "versionID": strconv.FormatUint(versionID, 10), "status": `"Primary"`})
+	expectPending(t, i, err)
+	i, err = deleteKeyHandler(m, bob, map[string]string{"keyID": "prod_db"})
+	expectPending(t, i, err)
+	changes = pendingChanges(t, m, eve)
+	if len(changes) != 2 || changes[0].Operation != OperationPutVersion || changes[1].Operation != OperationDeleteKey {
+		t.Fatalf("unexpected pending changes %+v", changes)
+	}
+
+	// Version changes need only Write access, but approving any change
+	// needs Admin access.
+	writer := auth.NewUser("walt", nil)
+	if err := m.UpdateAccess("prod_db", knox.Access{Type: knox.User, ID: "walt", AccessType: knox.Write}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := approvePendingChangeHandler(m, writer, map[string]string{"changeID": changes[0].ID}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected a writer to be refused, got %+v", err)
+	}
+	if _, err := approvePendingChangeHandler(m, bob, map[string]string{"changeID": changes[0].ID}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key, _ = m.GetKey("prod_db", knox.Primary)
+	if key.VersionList[0].ID != versionID {
+		t.Fatal("version should be promoted after approval")
+	}
+
+	// Requesters can withdraw their own changes.
+	if _, err := rejectPendingChangeHandler(m, bob, map[string]string{"changeID": changes[1].ID}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := m.GetKey("prod_db", knox.Primary); err != nil {
+		t.Fatal("rejected delete must not be applied")
+	}
+	if len(pendingChanges(t, m, eve)) != 0 {
+		t.Fatal("expected no pending changes")
+	}
+}
+
+func TestPendingChangeExpiry(t *testing.T) {
+	a, cleanup := setupApproval(t)
+	defer cleanup()
+	now := time.Unix(1000, 0)
+	a.time = func() time.Time { return now }
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", []string{"admins"})
+	bob := auth.NewUser("bob", []string{"admins"})
+	acl := `[{"type":"UserGroup","id":"admins","access":"Admin"}]`
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "prod_db", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	deleteKeyHandler(m, alice, map[string]string{"keyID": "prod_db"})
+	id := pendingChanges(t, m, bob)[0].ID
+
+	now = now.Add(2 * time.Hour)
+	if _, err := approvePendingChangeHandler(m, bob, map[string]string{"changeID": id}); err == nil || err.Subcode != knox.PendingChangeDoesNotExistCode {
+		t.Fatalf("expected expired change to be gone, got %+v", err)
+	}
+	if len(pendingChanges(t, m, bob)) != 0 {
+		t.Fatal("expected expired change to be discarded")
+	}
+}
+
+func TestTwoPersonApprovalDisabled(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", nil)
+	if _, err := getPendingChangesHandler(m, u, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented, got %+v", err)
+	}
+	if _, err := approvePendingChangeHandler(m, u, map[string]string{"changeID": "x"}); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented, got %+v", err)
+	}
+	if _, err := NewTwoPersonApproval(ApprovalConfig{}); err == nil {
+		t.Fatal("expected error without store")
+	}
+}
+
+func TestApprovalRequesterIdentities(t *testing.T) {
+	_, cleanup := setupApproval(t)
+	defer cleanup()
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", []string{"admins"})
+	laptop := auth.NewMachine("laptop01")
+	acl := `[{"type":"UserGroup","id":"admins","access":"Admin"}]`
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "prod_db", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	requester := knox.NewPrincipalMux(alice, map[string]knox.Principal{"github": alice, "mtls": laptop})
+	i, err := deleteKeyHandler(m, requester, map[string]string{"keyID": "prod_db"})
+	expectPending(t, i, err)
+	changes := pendingChanges(t, m, alice)
+	if len(changes) != 1 || len(changes[0].RequesterIDs) != 2 {
+		t.Fatalf("expected every requester identity to be recorded, got %+v", changes)
+	}
+
+	// Another user authenticating from the requester's machine cannot approve.
+	bob := auth.NewUser("bob", []string{"admins"})
+	approver := knox.NewPrincipalMux(bob, map[string]knox.Principal{"github": bob, "mtls": laptop})
+	if _, err := approvePendingChangeHandler(m, approver, map[string]string{"changeID": changes[0].ID}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected a shared identity to be refused, got %+v", err)
+	}
+	if _, err := approvePendingChangeHandler(m, bob, map[string]string{"changeID": changes[0].ID}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// ErrAPIKeyNotFound is returned by an APIKeyStore for unknown IDs.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyRecord is an API key as stored: its metadata and the SHA-256 hash of
+// its secret. Secrets are random, so a fast hash is sufficient.
+type APIKeyRecord struct {
+	knox.APIKeyInfo
+	SecretHash []byte `json:"secret_hash"`
+}
+
+// APIKeyStore persists Knox-issued API keys.
+//
+// Add must fail if a key with the same ID exists. IDs identify API key
+// principals in ACLs, so a store must never reuse the ID of a removed key;
+// NewAPIKeyRecord generates random IDs for this reason.
+type APIKeyStore interface {
+	Add(r APIKeyRecord) error
+	Get(id string) (*APIKeyRecord, error)
+	GetAll() ([]APIKeyRecord, error)
+	Remove(id string) error
+}
+
+// NewTempAPIKeyStore creates an in memory APIKeyStore. Like keydb.TempDB it
+// does no replication across servers and is meant for tests and
+// single-server deployments.
+func NewTempAPIKeyStore() APIKeyStore {
+	return &tempAPIKeyStore{keys: map[string]APIKeyRecord{}}
+}
+
+type tempAPIKeyStore struct {
+	sync.Mutex
+	keys map[string]APIKeyRecord
+}
+
+func (s *tempAPIKeyStore) Add(r APIKeyRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.keys[r.ID]; ok {
+		return fmt.Errorf("API key %s already exists", r.ID)
+	}
+	s.keys[r.ID] = r
+	return nil
+}
+
+func (s *tempAPIKeyStore) Get(id string) (*APIKeyRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &r, nil
+}
+
+func (s *tempAPIKeyStore) GetAll() ([]APIKeyRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	all := make([]APIKeyRecord, 0, len(s.keys))
+	for _, r := range s.keys {
+		all = append(all, r)
+	}
+	return all, nil
+}
+
+func (s *tempAPIKeyStore) Remove(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// NewAPIKeyRecord generates the ID and secret for a new API key described by
+// info. It returns the record to store and the token to hand to the client,
+// which is of the form <id>.<secret>.
+func NewAPIKeyRecord(info knox.APIKeyInfo) (APIKeyRecord, string, error) {
+	id := make([]byte, 16)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return APIKeyRecord{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIKeyRecord{}, "", err
+	}
+	info.ID = hex.EncodeToString(id)
+	info.Token = ""
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encoded))
+	return APIKeyRecord{APIKeyInfo: info, SecretHash: hash[:]}, info.ID + "." + encoded, nil
+}
+
+// APIKeyProvider authenticates clients by the API keys issued by Knox.
+type APIKeyProvider struct {
+	store APIKeyStore
+	time  func() time.Time
+}
+
+// NewAPIKeyProvider authenticates API keys held in store.
+func NewAPIKeyProvider(store APIKeyStore) *APIKeyProvider {
+	return &APIKeyProvider{store: store, time: time.Now}
+}
+
+// Version is set to 0 for APIKeyProvider
+func (p *APIKeyProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *APIKeyProvider) Name() string {
+	return "apikey"
+}
+
+// Type is set to a for APIKeyProvider
+func (p *APIKeyProvider) Type() byte {
+	return 'a'
+}
+
+// Schemes is set to Knox-API-Key for APIKeyProvider
+func (p *APIKeyProvider) Schemes() []string {
+	return []string{knox.APIKeyScheme}
+}
+
+// Header is set to X-Knox-API-Key for APIKeyProvider, for clients that cannot
+// set the Authorization header.
+func (p *APIKeyProvider) Header() string {
+	return "X-Knox-API-Key"
+}
+
+// Authenticate looks up the API key by its ID and checks its secret and expiry.
+func (p *APIKeyProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("auth: malformed API key")
+	}
+	record, err := p.store.Get(parts[0])
+	if err != nil {
+		if err == ErrAPIKeyNotFound {
+			return nil, fmt.Errorf("auth: unknown or revoked API key")
+		}
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], record.SecretHash) != 1 {
+		return nil, fmt.Errorf("auth: invalid API key")
+	}
+	if record.Expiry != 0 && p.time().UnixNano() >= record.Expiry {
+		return nil, fmt.Errorf("auth: API key %s has expired", record.Name)
+	}
+	return NewAPIKey(record.ID, record.Team), nil
+}
+
+// NewAPIKey creates the principal of the API key with the given ID, owned by
+// team.
+func NewAPIKey(id, team string) knox.Principal {
+	return apiKey{id: id, team: team}
+}
+
+// IsAPIKey returns true if the principal is an API key, or if the principal
+// is a PrincipalMux that contains at least one API key sub-principal.
+func IsAPIKey(p knox.Principal) bool {
+	if _, ok := p.(apiKey); ok {
+		return true
+	}
+	if mux, ok := p.(knox.PrincipalMux); ok {
+		for _, sub := range mux.Principals() {
+			if _, ok := sub.(apiKey); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apiKey represents a Knox-issued API key. It is granted access only by ACL
+// entries holding its ID, never through its owning team.
+type apiKey struct {
+	id   string
+	team string
+}
+
+func (k apiKey) GetID() string {
+	return k.id
+}
+
+// Type returns the underlying type of a principal, for logging/debugging purposes.
+func (k apiKey) Type() string {
+	return "apikey"
+}
+
+func (k apiKey) Raw() []knox.RawPrincipal {
+	return []knox.RawPrincipal{
+		{
+			ID:   k.GetID(),
+			Type: k.Type(),
+		},
+	}
+}
+
+// CanAccess determines if an API key can access an object represented by the
+// ACL with a certain AccessType. It compares the API key ID.
+func (k apiKey) CanAccess(acl knox.ACL, t knox.AccessType) bool {
+	for _, a := range acl {
+		if a.Type == knox.APIKey && a.ID == k.id && a.AccessType.CanAccess(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestAPIKeyProvider(t *testing.T) {
+	store := NewTempAPIKeyStore()
+	now := time.Now()
+	record, token, err := NewAPIKeyRecord(knox.APIKeyInfo{Name: "deploy", Team: "ci", Expiry: now.Add(time.Hour).UnixNano()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(record.SecretHash), strings.SplitN(token, ".", 2)[1]) || record.Token != "" {
+		t.Fatal("expected only a hash of the secret to be stored")
+	}
+	if err := store.Add(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(record); err == nil {
+		t.Fatal("expected duplicate ID to be rejected")
+	}
+
+	p := NewAPIKeyProvider(store)
+	p.time = func() time.Time { return now }
+	principal, err := p.Authenticate(token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != record.ID || !IsAPIKey(principal) || IsUser(principal) || IsService(principal) {
+		t.Fatalf("unexpected principal %v", principal)
+	}
+	acl := knox.ACL{
+		{Type: knox.UserGroup, ID: "ci", AccessType: knox.Admin},
+		{Type: knox.User, ID: "deploy", AccessType: knox.Admin},
+		{Type: knox.APIKey, ID: "deploy", AccessType: knox.Admin},
+		{Type: knox.APIKey, ID: record.ID, AccessType: knox.Read},
+	}
+	if !principal.CanAccess(acl, knox.Read) || principal.CanAccess(acl, knox.Write) {
+		t.Fatal("expected API key to get only its own entry's access")
+	}
+
+	// A key recreated under the same name does not inherit the ACL entries of
+	// the old one.
+	if err := store.Remove(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	recreated, recreatedToken, _ := NewAPIKeyRecord(knox.APIKeyInfo{Name: "deploy", Team: "ci"})
+	if err := store.Add(recreated); err != nil {
+		t.Fatal(err)
+	}
+	if recreated.ID == record.ID {
+		t.Fatal("expected a new ID")
+	}
+	principal, err = p.Authenticate(recreatedToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.CanAccess(acl, knox.Read) {
+		t.Fatal("expected recreated key not to match the old key's entry")
+	}
+	if err := store.Remove(recreated.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(record); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"", "nodot", record.ID + ".wrong", "unknown." + strings.SplitN(token, ".", 2)[1]} {
+		if _, err := p.Authenticate(bad, nil); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	p.time = func() time.Time { return now.Add(time.Hour) }
+	if _, err := p.Authenticate(token, nil); err == nil {
+		t.Fatal("expected expired key to be rejected")
+	}
+}
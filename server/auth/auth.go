@@ -2,17 +2,21 @@ package auth
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/context"
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/internal/bounded"
 )
 
 type contextKey int
@@ -71,8 +75,24 @@ type Provider interface {
 	Type() byte
 }
 
+// SchemeProvider is implemented by providers that also accept credentials
+// under standard Authorization header schemes, such as "Bearer".
+type SchemeProvider interface {
+	Provider
+	// Schemes lists the accepted schemes, which match case-insensitively.
+	Schemes() []string
+}
+
+// HeaderProvider is implemented by providers that also accept credentials in
+// a dedicated request header.
+type HeaderProvider interface {
+	Provider
+	// Header names the request header holding the credentials.
+	Header() string
+}
+
 func verifyCertificate(r *http.Request, cas *x509.CertPool,
-	timeFunc func() time.Time) (*x509.Certificate, error) {
+	timeFunc func() time.Time, revocation []RevocationChecker) (*x509.Certificate, error) {
 	certs := r.TLS.PeerCertificates
 	if len(certs) == 0 {
 		return nil, fmt.Errorf("auth: no peer certs configured")
@@ -95,6 +115,9 @@ func verifyCertificate(r *http.Request, cas *x509.CertPool,
 	if len(chains) == 0 {
 		return nil, fmt.Errorf("auth: no cert chains could be verified")
 	}
+	if err := checkRevocation(chains[0], revocation); err != nil {
+		return nil, err
+	}
 	return certs[0], nil
 }
 
@@ -108,8 +131,14 @@ func NewMTLSAuthProvider(CAs *x509.CertPool) *MTLSAuthProvider {
 
 // MTLSAuthProvider does authentication by verifying TLS certs against a collection of root CAs
 type MTLSAuthProvider struct {
-	CAs  *x509.CertPool
-	time func() time.Time
+	CAs        *x509.CertPool
+	time       func() time.Time
+	revocation []RevocationChecker
+}
+
+// AddRevocationChecker rejects client certificates that c reports as revoked.
+func (p *MTLSAuthProvider) AddRevocationChecker(c RevocationChecker) {
+	p.revocation = append(p.revocation, c)
 }
 
 // Version is set to 0 for MTLSAuthProvider
@@ -127,9 +156,14 @@ func (p *MTLSAuthProvider) Type() byte {
 	return 't'
 }
 
+// Schemes is set to Knox-Machine for MTLSAuthProvider
+func (p *MTLSAuthProvider) Schemes() []string {
+	return []string{knox.MachineScheme}
+}
+
 // Authenticate performs TLS based Authentication for the MTLSAuthProvider
 func (p *MTLSAuthProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
-	cert, err := verifyCertificate(r, p.CAs, p.time)
+	cert, err := verifyCertificate(r, p.CAs, p.time, p.revocation)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +191,14 @@ func NewSpiffeAuthProvider(CAs *x509.CertPool) *SpiffeProvider {
 type SpiffeProvider struct {
 	CAs  *x509.CertPool
 	time func() time.Time
+	// bundles, when set, replaces CAs with a bundle per trust domain.
+	bundles    *SpiffeBundleSet
+	revocation []RevocationChecker
+}
+
+// AddRevocationChecker rejects client certificates that c reports as revoked.
+func (p *SpiffeProvider) AddRevocationChecker(c RevocationChecker) {
+	p.revocation = append(p.revocation, c)
 }
 
 // Version is set to 0 for SpiffeProvider
@@ -174,9 +216,17 @@ func (p *SpiffeProvider) Type() byte {
 	return 's'
 }
 
+// Schemes is set to Knox-Spiffe for SpiffeProvider
+func (p *SpiffeProvider) Schemes() []string {
+	return []string{knox.SpiffeScheme}
+}
+
 // Authenticate performs TLS based Authentication and extracts the Spiffe URI extension
 func (p *SpiffeProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
-	cert, err := verifyCertificate(r, p.CAs, p.time)
+	if p.bundles != nil {
+		return p.authenticateFederated(r)
+	}
+	cert, err := verifyCertificate(r, p.CAs, p.time, p.revocation)
 	if err != nil {
 		return nil, err
 	}
@@ -190,6 +240,12 @@ func (p *SpiffeProvider) Authenticate(token string, r *http.Request) (knox.Princ
 	return spiffeToPrincipal(spiffeURIs)
 }
 
+// NewServiceFromSpiffeID creates a service principal from a SPIFFE ID of the
+// form spiffe://<domain>/<path>.
+func NewServiceFromSpiffeID(spiffeID string) (knox.Principal, error) {
+	return spiffeToPrincipal([]string{spiffeID})
+}
+
 func spiffeToPrincipal(spiffeURIs []string) (knox.Principal, error) {
 	if len(spiffeURIs) == 0 {
 		return nil, fmt.Errorf("auth: no SPIFFE identity in certificate")
@@ -243,14 +299,83 @@ func (s *SpiffeFallbackProvider) Type() byte {
 	return (&MTLSAuthProvider{}).Type()
 }
 
-// GitHubProvider implements user authentication through github.com
+// Schemes is set to be identical to the Schemes of the MTLSAuthProvider
+func (s *SpiffeFallbackProvider) Schemes() []string {
+	return (&MTLSAuthProvider{}).Schemes()
+}
+
+// defaultGitHubBaseURL is the API root of github.com.
+const defaultGitHubBaseURL = "https://api.github.com"
+
+// defaultGitHubCacheTTL is how long a token's principal is reused by default.
+const defaultGitHubCacheTTL = 5 * time.Minute
+
+// maxGitHubCacheEntries bounds the memory used by the GitHubProvider cache.
+const maxGitHubCacheEntries = 10000
+
+// GitHubProviderConfig configures a GitHubProvider.
+type GitHubProviderConfig struct {
+	// BaseURL is the API root, such as https://github.example.com/api/v3 for
+	// GitHub Enterprise. Defaults to https://api.github.com.
+	BaseURL string
+
+	// HTTPTimeout bounds each request to GitHub.
+	HTTPTimeout time.Duration
+
+	// CacheTTL is how long the principal for a token is reused before GitHub
+	// is asked again. Defaults to five minutes; negative disables caching.
+	CacheTTL time.Duration
+
+	// Teams adds the user's teams as groups of the form "org/team". The
+	// token needs the read:org scope.
+	Teams bool
+}
+
+type gitHubCacheEntry struct {
+	principal knox.Principal
+	expiry    time.Time
+}
+
+// GitHubProvider implements user authentication through github.com or
+// GitHub Enterprise. Principals are cached by a hash of the token.
 type GitHubProvider struct {
-	client httpClient
+	client   httpClient
+	baseURL  string
+	teams    bool
+	cacheTTL time.Duration
+	time     func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]gitHubCacheEntry
 }
 
 // NewGitHubProvider initializes GitHubProvider with an HTTP client with a timeout
 func NewGitHubProvider(httpTimeout time.Duration) *GitHubProvider {
-	return &GitHubProvider{&http.Client{Timeout: httpTimeout}}
+	return NewGitHubProviderWithConfig(GitHubProviderConfig{HTTPTimeout: httpTimeout})
+}
+
+// NewGitHubProviderWithConfig initializes GitHubProvider from the given configuration.
+func NewGitHubProviderWithConfig(cfg GitHubProviderConfig) *GitHubProvider {
+	return newGitHubProvider(&http.Client{Timeout: cfg.HTTPTimeout}, cfg)
+}
+
+func newGitHubProvider(client httpClient, cfg GitHubProviderConfig) *GitHubProvider {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultGitHubBaseURL
+	}
+	ttl := cfg.CacheTTL
+	if ttl == 0 {
+		ttl = defaultGitHubCacheTTL
+	}
+	return &GitHubProvider{
+		client:   client,
+		baseURL:  baseURL,
+		teams:    cfg.Teams,
+		cacheTTL: ttl,
+		time:     time.Now,
+		cache:    map[[sha256.Size]byte]gitHubCacheEntry{},
+	}
 }
 
 // Version is set to 0 for GitHubProvider
@@ -268,42 +393,152 @@ func (p *GitHubProvider) Type() byte {
 	return 'u'
 }
 
-// Authenticate uses the token to get user data from github.com
+// Schemes is set to Knox-GitHub for GitHubProvider. Bearer is not accepted so
+// that tokens meant for other providers are never sent to GitHub.
+func (p *GitHubProvider) Schemes() []string {
+	return []string{knox.GitHubScheme}
+}
+
+// Authenticate uses the token to get user data from GitHub, reusing the
+// result for the same token until the cache entry expires.
 func (p *GitHubProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	k := sha256.Sum256([]byte(token))
+	now := p.time()
+	if p.cacheTTL > 0 {
+		p.mu.Lock()
+		e, ok := p.cache[k]
+		p.mu.Unlock()
+		if ok && now.Before(e.expiry) {
+			return e.principal, nil
+		}
+	}
+
+	principal, err := p.lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	if p.cacheTTL > 0 {
+		p.store(k, gitHubCacheEntry{principal: principal, expiry: now.Add(p.cacheTTL)}, now)
+	}
+	return principal, nil
+}
+
+func (p *GitHubProvider) store(k [sha256.Size]byte, e gitHubCacheEntry, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !bounded.MakeRoom(p.cache, maxGitHubCacheEntries, func(v gitHubCacheEntry) bool { return !now.Before(v.expiry) }) {
+		clear(p.cache)
+	}
+	p.cache[k] = e
+}
+
+func (p *GitHubProvider) lookup(token string) (knox.Principal, error) {
 	user := &GitHubLoginFormat{}
-	if err := p.getAPI("https://api.github.com/user", token, user); err != nil {
+	if err := p.getAPI(p.baseURL+"/user", token, user); err != nil {
 		return nil, err
 	}
 
-	groupsJSON := &GitHubOrgFormat{}
-	if err := p.getAPI("https://api.github.com/user/orgs", token, groupsJSON); err != nil {
+	groups := []string{}
+	err := p.getPages(p.baseURL+"/user/orgs?per_page=100", token, func(dec *json.Decoder) error {
+		orgs := GitHubOrgFormat{}
+		if err := dec.Decode(&orgs); err != nil {
+			return err
+		}
+		for _, g := range orgs {
+			groups = append(groups, g.Name)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	groups := make([]string, len(*groupsJSON))
-	for i, g := range *groupsJSON {
-		groups[i] = g.Name
+
+	if p.teams {
+		err := p.getPages(p.baseURL+"/user/teams?per_page=100", token, func(dec *json.Decoder) error {
+			teams := GitHubTeamFormat{}
+			if err := dec.Decode(&teams); err != nil {
+				return err
+			}
+			for _, t := range teams {
+				groups = append(groups, t.Organization.Name+"/"+t.Slug)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return NewUser(user.Name, groups), nil
 }
 
 func (p *GitHubProvider) getAPI(url, token string, v interface{}) error {
-	req, err := http.NewRequest("GET", url, nil)
+	_, err := p.get(url, token, func(dec *json.Decoder) error {
+		return dec.Decode(v)
+	})
+	return err
+}
+
+// getPages calls decode for each page of a paginated list, following the
+// "next" links returned by GitHub. Links to another scheme or host than the
+// configured API are refused, so the token is only ever sent to the API.
+func (p *GitHubProvider) getPages(page, token string, decode func(*json.Decoder) error) error {
+	base, err := url.Parse(p.baseURL)
 	if err != nil {
 		return err
 	}
+	for page != "" {
+		next, err := p.get(page, token, decode)
+		if err != nil || next == "" {
+			return err
+		}
+		current, err := url.Parse(page)
+		if err != nil {
+			return err
+		}
+		nextURL, err := current.Parse(next)
+		if err != nil {
+			return fmt.Errorf("invalid next page link: %v", err)
+		}
+		if nextURL.Scheme != base.Scheme || nextURL.Host != base.Host {
+			return fmt.Errorf("refusing to follow next page link to %s://%s", nextURL.Scheme, nextURL.Host)
+		}
+		page = nextURL.String()
+	}
+	return nil
+}
+
+// get fetches url, decodes the body and returns the URL of the next page, if any.
+func (p *GitHubProvider) get(url, token string, decode func(*json.Decoder) error) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Add("Authorization", "Bearer "+token)
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("api request returned status %s", resp.Status)
+		return "", fmt.Errorf("api request returned status %s", resp.Status)
 	}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(v)
-	return err
+	if err := decode(json.NewDecoder(resp.Body)); err != nil {
+		return "", err
+	}
+	return nextPageURL(resp.Header.Get("Link")), nil
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL returns the rel="next" URL of a Link header.
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		if m := linkNextRegexp.FindStringSubmatch(strings.TrimSpace(part)); m != nil {
+			return m[1]
+		}
+	}
+	return ""
 }
 
 // GitHubLoginFormat specifies the json return format for /user field.
@@ -314,6 +549,12 @@ type GitHubLoginFormat struct {
 // GitHubOrgFormat specifies the JSON return format for /user/org.
 type GitHubOrgFormat []GitHubLoginFormat
 
+// GitHubTeamFormat specifies the JSON return format for /user/teams.
+type GitHubTeamFormat []struct {
+	Slug         string            `json:"slug"`
+	Organization GitHubLoginFormat `json:"organization"`
+}
+
 type httpClient interface {
 	Do(req *http.Request) (resp *http.Response, err error)
 }
@@ -388,7 +629,7 @@ func setFromList(groups []string) *stringSet {
 
 // NewUser creates a user principal with the given auth Provider.
 func NewUser(id string, groups []string) knox.Principal {
-	return user{id, *setFromList(groups)}
+	return user{ID: id, groups: *setFromList(groups), resolved: &resolvedGroups{}}
 }
 
 // NewMachine creates a machine principal with the given auth Provider.
@@ -405,9 +646,16 @@ func NewService(domain string, path string) knox.Principal {
 type user struct {
 	ID     string
 	groups stringSet
+
+	// resolved holds the groups from the GroupResolver, if one is set.
+	resolved *resolvedGroups
 }
 
 func (u user) inGroup(g string) bool {
+	if r := groupResolver; r != nil {
+		groups := u.resolved.get(r, u.ID)
+		return groups.memberOf(g)
+	}
 	return u.groups.memberOf(g)
 }
 
@@ -478,15 +726,37 @@ func (m machine) CanAccess(acl knox.ACL, t knox.AccessType) bool {
 				return true
 			}
 		case knox.MachinePrefix:
-			// TODO(devinlundberg): Investigate security implications of this
+			// Bare prefixes are not anchored to label boundaries, so e.g. "auth"
+			// also matches "authz01". Prefer MachinePattern for new entries.
 			if strings.HasPrefix(string(m), a.ID) && a.AccessType.CanAccess(t) {
 				return true
 			}
+		case knox.MachinePattern:
+			if a.AccessType.CanAccess(t) && matchesMachinePattern(a.ID, string(m)) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
+// machinePatterns caches compiled MachinePattern entries, which are evaluated
+// on every authorization check.
+var machinePatterns sync.Map
+
+func matchesMachinePattern(pattern, hostname string) bool {
+	re, ok := machinePatterns.Load(pattern)
+	if !ok {
+		compiled, err := knox.MachinePatternRegexp(pattern)
+		if err != nil {
+			// Invalid patterns never match.
+			return false
+		}
+		re, _ = machinePatterns.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(hostname)
+}
+
 // Service represents a given service from a trust domain
 type service struct {
 	domain string
@@ -556,6 +826,11 @@ func (c *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 		resp.Body = io.NopCloser(bytes.NewBufferString(data))
 		resp.StatusCode = 200
 		return resp, nil
+	case "/user/teams":
+		data := "[{\"slug\":\"testteam\",\"organization\":{\"login\":\"testgroup\"}}]"
+		resp.Body = io.NopCloser(bytes.NewBufferString(data))
+		resp.StatusCode = 200
+		return resp, nil
 	default:
 		resp.StatusCode = 404
 		resp.Body = io.NopCloser(bytes.NewBuffer(nil))
@@ -568,5 +843,5 @@ func (c *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 // MockGitHubProvider returns a mocked out authentication header with a simple mock "server".
 // If there exists an authorization header with user token that does not equal 'notvalid', it will log in as 'testuser'.
 func MockGitHubProvider() *GitHubProvider {
-	return &GitHubProvider{&mockHTTPClient{}}
+	return newGitHubProvider(&mockHTTPClient{}, GitHubProviderConfig{})
 }
@@ -5,8 +5,10 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"testing"
@@ -130,6 +132,32 @@ func TestMachineCanAccess(t *testing.T) {
 	}
 }
 
+func TestMachinePatternCanAccess(t *testing.T) {
+	acl := knox.ACL{
+		{ID: "auth[0-9]*", AccessType: knox.Read, Type: knox.MachinePattern},
+		{ID: "^db[0-9]+\\.prod$", AccessType: knox.Admin, Type: knox.MachinePattern},
+		{ID: "bad[", AccessType: knox.Admin, Type: knox.MachinePattern},
+	}
+	if !machine("auth001").CanAccess(acl, knox.Read) {
+		t.Error("machine can't access matching pattern")
+	}
+	if machine("auth001").CanAccess(acl, knox.Write) {
+		t.Error("machine can access pattern with increased access type")
+	}
+	if machine("authz-evil01").CanAccess(acl, knox.Read) {
+		t.Error("pattern must not match beyond its character class")
+	}
+	if !machine("db12.prod").CanAccess(acl, knox.Admin) {
+		t.Error("machine can't access matching regexp")
+	}
+	if machine("db12.prod.evil").CanAccess(acl, knox.Read) {
+		t.Error("regexp must be anchored")
+	}
+	if machine("bad[").CanAccess(acl, knox.Read) {
+		t.Error("invalid pattern must not match")
+	}
+}
+
 func TestServiceCanAccess(t *testing.T) {
 	s := NewService("example.com", "serviceA")
 	a1 := knox.Access{ID: "spiffe://example.com/serviceA", AccessType: knox.Read,
@@ -468,6 +496,115 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
+func TestGitHubProviderEnterprise(t *testing.T) {
+	var requests int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v3/user":
+			w.Write([]byte(`{"login":"alice"}`))
+		case "/api/v3/user/orgs":
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(`[{"login":"org2"}]`))
+				return
+			}
+			w.Header().Set("Link", `<`+srv.URL+`/api/v3/user/orgs?page=2>; rel="next", <`+srv.URL+`/api/v3/user/orgs?page=2>; rel="last"`)
+			w.Write([]byte(`[{"login":"org1"}]`))
+		case "/api/v3/user/teams":
+			w.Write([]byte(`[{"slug":"security","organization":{"login":"org1"}}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := NewGitHubProviderWithConfig(GitHubProviderConfig{
+		BaseURL:  srv.URL + "/api/v3/",
+		CacheTTL: time.Minute,
+		Teams:    true,
+	})
+	now := time.Now()
+	p.time = func() time.Time { return now }
+
+	principal, err := p.Authenticate("valid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := principal.(user)
+	if u.GetID() != "alice" {
+		t.Fatalf("unexpected principal %v", u)
+	}
+	for _, g := range []string{"org1", "org2", "org1/security"} {
+		if !u.inGroup(g) {
+			t.Errorf("expected user to be in %s", g)
+		}
+	}
+	if u.inGroup("security") {
+		t.Error("team should only be a group when qualified by its org")
+	}
+
+	// The principal is reused until the cache entry expires.
+	n := atomic.LoadInt32(&requests)
+	if _, err := p.Authenticate("valid", nil); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != n {
+		t.Fatal("expected cached principal to be used")
+	}
+	now = now.Add(time.Minute)
+	if _, err := p.Authenticate("valid", nil); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) == n {
+		t.Fatal("expected expired entry to be refreshed")
+	}
+
+	// Failures are not cached.
+	n = atomic.LoadInt32(&requests)
+	for i := 0; i < 2; i++ {
+		if _, err := p.Authenticate("invalid", nil); err == nil {
+			t.Fatal("expected error for invalid token")
+		}
+	}
+	if atomic.LoadInt32(&requests) != n+2 {
+		t.Fatal("expected failed lookups to be retried")
+	}
+}
+
+func TestGitHubProviderForeignNextPage(t *testing.T) {
+	var leaked int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&leaked, 1)
+		w.Write([]byte(`[]`))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"login":"alice"}`))
+		case "/user/orgs":
+			w.Header().Set("Link", `<`+other.URL+`/user/orgs?page=2>; rel="next"`)
+			w.Write([]byte(`[{"login":"org1"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := NewGitHubProviderWithConfig(GitHubProviderConfig{BaseURL: srv.URL})
+	if _, err := p.Authenticate("valid", nil); err == nil {
+		t.Fatal("expected a next page link to another host to be refused")
+	}
+	if atomic.LoadInt32(&leaked) != 0 {
+		t.Fatal("expected the token not to be sent to another host")
+	}
+}
+
 func TestGetInvalidUser(t *testing.T) {
 	token := "notvalid"
 	a := MockGitHubProvider()
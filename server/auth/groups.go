@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/internal/bounded"
+)
+
+// GroupResolver looks up the groups a user belongs to from a directory,
+// rather than relying on the groups presented at authentication time.
+type GroupResolver interface {
+	Groups(userID string) ([]string, error)
+}
+
+// groupResolver is consulted when users are checked against UserGroup entries.
+var groupResolver GroupResolver
+
+// SetGroupResolver makes r the source of group membership for every user,
+// regardless of the provider that authenticated them. Groups supplied by
+// providers are ignored while a resolver is set, and if resolution fails the
+// user matches no UserGroup entries. Pass nil to go back to provider groups.
+func SetGroupResolver(r GroupResolver) {
+	groupResolver = r
+}
+
+// GetGroupResolver returns the resolver set with SetGroupResolver, or nil.
+func GetGroupResolver() GroupResolver {
+	return groupResolver
+}
+
+// resolvedGroups holds the groups resolved for one user principal. Principals
+// are made for each request, so the resolver is asked at most once per
+// request however many UserGroup entries the principal is checked against.
+type resolvedGroups struct {
+	once   sync.Once
+	groups stringSet
+}
+
+// get returns the groups r resolves for userID, asking r only on the first
+// call. If resolution fails the user is in no groups.
+func (c *resolvedGroups) get(r GroupResolver, userID string) stringSet {
+	if c == nil {
+		return resolveGroups(r, userID)
+	}
+	c.once.Do(func() { c.groups = resolveGroups(r, userID) })
+	return c.groups
+}
+
+func resolveGroups(r GroupResolver, userID string) stringSet {
+	groups, err := r.Groups(userID)
+	if err != nil {
+		log.Printf("group resolution failed for %s: %v", userID, err)
+		return stringSet{}
+	}
+	return *setFromList(groups)
+}
+
+// StaticGroupResolver resolves groups from a JSON file mapping each group to
+// its members, such as {"security": ["alice", "bob"]}.
+type StaticGroupResolver struct {
+	path string
+
+	mu     sync.RWMutex
+	groups map[string][]string
+}
+
+// NewStaticGroupResolver loads group membership from the file at path.
+func NewStaticGroupResolver(path string) (*StaticGroupResolver, error) {
+	r := &StaticGroupResolver{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload rereads the file. On error the previous membership is kept.
+func (r *StaticGroupResolver) Reload() error {
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("could not read group file: %v", err)
+	}
+	members := map[string][]string{}
+	if err := json.Unmarshal(b, &members); err != nil {
+		return fmt.Errorf("could not parse group file: %v", err)
+	}
+	groups := map[string][]string{}
+	for g, users := range members {
+		for _, u := range users {
+			groups[u] = append(groups[u], g)
+		}
+	}
+	for _, gs := range groups {
+		sort.Strings(gs)
+	}
+	r.mu.Lock()
+	r.groups = groups
+	r.mu.Unlock()
+	return nil
+}
+
+// Groups returns the groups listing userID as a member.
+func (r *StaticGroupResolver) Groups(userID string) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.groups[userID], nil
+}
+
+// defaultLDAPGroupFilter matches posixGroup entries listing the user by uid.
+const defaultLDAPGroupFilter = "(&(objectClass=posixGroup)(memberUid=%s))"
+
+// defaultLDAPTimeout is used when LDAPGroupResolverConfig.Timeout is unset.
+const defaultLDAPTimeout = 5 * time.Second
+
+// defaultLDAPCacheTTL is used when LDAPGroupResolverConfig.CacheTTL is unset.
+const defaultLDAPCacheTTL = 5 * time.Minute
+
+// LDAPGroupResolverConfig configures group lookups against an LDAP directory.
+type LDAPGroupResolverConfig struct {
+	// URL is the directory to query, such as ldaps://ldap.example.com:636.
+	URL string
+
+	// TLSConfig is used for ldaps:// URLs.
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword authenticate the lookups. If BindDN is empty
+	// the directory is searched anonymously.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where the search for groups starts.
+	BaseDN string
+
+	// Filter selects the groups a user belongs to. Its single %s verb is
+	// replaced by the escaped user ID. Defaults to posixGroup memberUid.
+	Filter string
+
+	// Attribute names the group attribute to return, such as "cn". If empty,
+	// the group's DN is returned, which is the form UserGroup entries take.
+	Attribute string
+
+	// Timeout bounds each lookup. Defaults to five seconds.
+	Timeout time.Duration
+
+	// CacheTTL is how long a user's groups are remembered before the
+	// directory is searched again. Defaults to five minutes; a negative value
+	// searches the directory on every lookup.
+	CacheTTL time.Duration
+}
+
+// ldapConn is the part of *ldap.Conn used to look up groups.
+type ldapConn interface {
+	SetTimeout(time.Duration)
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPGroupResolver resolves groups by searching an LDAP directory. Each
+// search opens a new connection, so results are cached for CacheTTL.
+type LDAPGroupResolver struct {
+	cfg   LDAPGroupResolverConfig
+	dial  func() (ldapConn, error)
+	cache *CachingGroupResolver
+}
+
+// NewLDAPGroupResolver builds an LDAPGroupResolver from the given configuration.
+func NewLDAPGroupResolver(cfg LDAPGroupResolverConfig) (*LDAPGroupResolver, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("ldap group resolver requires a URL")
+	}
+	if cfg.BaseDN == "" {
+		return nil, fmt.Errorf("ldap group resolver requires a base DN")
+	}
+	if cfg.Filter == "" {
+		cfg.Filter = defaultLDAPGroupFilter
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultLDAPTimeout
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = defaultLDAPCacheTTL
+	}
+	r := &LDAPGroupResolver{cfg: cfg}
+	r.dial = func() (ldapConn, error) {
+		return ldap.DialURL(r.cfg.URL,
+			ldap.DialWithDialer(&net.Dialer{Timeout: r.cfg.Timeout}),
+			ldap.DialWithTLSConfig(r.cfg.TLSConfig))
+	}
+	if cfg.CacheTTL > 0 {
+		r.cache = NewCachingGroupResolver(groupResolverFunc(r.search), cfg.CacheTTL)
+	}
+	return r, nil
+}
+
+// Groups returns the groups userID belongs to, searching the directory if
+// they are not cached.
+func (r *LDAPGroupResolver) Groups(userID string) ([]string, error) {
+	if r.cache != nil {
+		return r.cache.Groups(userID)
+	}
+	return r.search(userID)
+}
+
+// search searches the directory for the groups userID belongs to.
+func (r *LDAPGroupResolver) search(userID string) ([]string, error) {
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(r.cfg.Timeout)
+
+	if r.cfg.BindDN != "" {
+		if err := conn.Bind(r.cfg.BindDN, r.cfg.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	var attributes []string
+	if r.cfg.Attribute != "" {
+		attributes = []string{r.cfg.Attribute}
+	} else {
+		// Request no attributes; only the DN is needed.
+		attributes = []string{"1.1"}
+	}
+	req := ldap.NewSearchRequest(
+		r.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(r.cfg.Timeout/time.Second), false,
+		fmt.Sprintf(r.cfg.Filter, ldap.EscapeFilter(userID)),
+		attributes, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	for _, e := range res.Entries {
+		if r.cfg.Attribute == "" {
+			groups = append(groups, e.DN)
+			continue
+		}
+		groups = append(groups, e.GetAttributeValues(r.cfg.Attribute)...)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// groupResolverFunc adapts a function to a GroupResolver.
+type groupResolverFunc func(userID string) ([]string, error)
+
+func (f groupResolverFunc) Groups(userID string) ([]string, error) {
+	return f(userID)
+}
+
+// maxGroupCacheEntries bounds the memory used by a CachingGroupResolver.
+const maxGroupCacheEntries = 10000
+
+type groupCacheEntry struct {
+	groups []string
+	expiry time.Time
+}
+
+// CachingGroupResolver remembers the groups returned by another resolver for
+// a fixed time. Failed lookups are not cached.
+type CachingGroupResolver struct {
+	resolver GroupResolver
+	ttl      time.Duration
+	time     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]groupCacheEntry
+}
+
+// NewCachingGroupResolver caches lookups made through r for ttl.
+func NewCachingGroupResolver(r GroupResolver, ttl time.Duration) *CachingGroupResolver {
+	return &CachingGroupResolver{
+		resolver: r,
+		ttl:      ttl,
+		time:     time.Now,
+		cache:    map[string]groupCacheEntry{},
+	}
+}
+
+// Groups returns the cached groups for userID, looking them up if absent or expired.
+func (c *CachingGroupResolver) Groups(userID string) ([]string, error) {
+	now := c.time()
+
+	c.mu.Lock()
+	e, ok := c.cache[userID]
+	c.mu.Unlock()
+	if ok && now.Before(e.expiry) {
+		return e.groups, nil
+	}
+
+	groups, err := c.resolver.Groups(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !bounded.MakeRoom(c.cache, maxGroupCacheEntries, func(v groupCacheEntry) bool { return !now.Before(v.expiry) }) {
+		clear(c.cache)
+	}
+	c.cache[userID] = groupCacheEntry{groups: groups, expiry: now.Add(c.ttl)}
+	return groups, nil
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pinterest/knox"
+)
+
+type ldapGroup struct {
+	cn      string
+	members []string
+}
+
+// fakeLDAP is an in-memory directory answering simple binds and group searches.
+type fakeLDAP struct {
+	bindDN   string
+	password string
+	groups   map[string]ldapGroup
+	bound    bool
+}
+
+var memberUidFilter = regexp.MustCompile(`memberUid=([^)]*)`)
+
+func (s *fakeLDAP) SetTimeout(time.Duration) {}
+
+func (s *fakeLDAP) Close() error { return nil }
+
+func (s *fakeLDAP) Bind(username, password string) error {
+	if username != s.bindDN || password != s.password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+	}
+	s.bound = true
+	return nil
+}
+
+func (s *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if !s.bound {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, fmt.Errorf("bind required"))
+	}
+	wantCN := false
+	for _, a := range req.Attributes {
+		wantCN = wantCN || a == "cn"
+	}
+	res := &ldap.SearchResult{}
+	if m := memberUidFilter.FindStringSubmatch(req.Filter); m != nil {
+		for dn, g := range s.groups {
+			for _, member := range g.members {
+				if member != m[1] {
+					continue
+				}
+				attrs := map[string][]string{}
+				if wantCN {
+					attrs["cn"] = []string{g.cn}
+				}
+				res.Entries = append(res.Entries, ldap.NewEntry(dn, attrs))
+			}
+		}
+	}
+	return res, nil
+}
+
+var testLDAPGroups = map[string]ldapGroup{
+	"cn=security,ou=groups,dc=example,dc=com": {cn: "security", members: []string{"alice"}},
+	"cn=eng,ou=groups,dc=example,dc=com":      {cn: "eng", members: []string{"alice", "bob"}},
+}
+
+func TestLDAPGroupResolver(t *testing.T) {
+	r, err := NewLDAPGroupResolver(LDAPGroupResolverConfig{
+		URL:          "ldap://ldap.example.com",
+		BindDN:       "cn=knox,dc=example,dc=com",
+		BindPassword: "hunter2",
+		BaseDN:       "ou=groups,dc=example,dc=com",
+		CacheTTL:     -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.dial = func() (ldapConn, error) {
+		return &fakeLDAP{bindDN: "cn=knox,dc=example,dc=com", password: r.cfg.BindPassword, groups: testLDAPGroups}, nil
+	}
+	groups, err := r.Groups("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cn=eng,ou=groups,dc=example,dc=com", "cn=security,ou=groups,dc=example,dc=com"}
+	if fmt.Sprint(groups) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+
+	r.cfg.Attribute = "cn"
+	groups, err = r.Groups("bob")
+	if err != nil || fmt.Sprint(groups) != "[eng]" {
+		t.Fatalf("expected [eng], got %v, %v", groups, err)
+	}
+
+	// Filter metacharacters in the user ID must not widen the search.
+	groups, err = r.Groups("*")
+	if err != nil || len(groups) != 0 {
+		t.Fatalf("expected no groups, got %v, %v", groups, err)
+	}
+
+	r.dial = func() (ldapConn, error) {
+		return &fakeLDAP{bindDN: "cn=knox,dc=example,dc=com", password: "rotated", groups: testLDAPGroups}, nil
+	}
+	if _, err := r.Groups("alice"); err == nil {
+		t.Fatal("expected bind failure")
+	}
+
+	if _, err := NewLDAPGroupResolver(LDAPGroupResolverConfig{URL: "ldap://ldap.example.com"}); err == nil {
+		t.Fatal("expected error for missing base DN")
+	}
+}
+
+func TestLDAPGroupResolverCaches(t *testing.T) {
+	r, err := NewLDAPGroupResolver(LDAPGroupResolverConfig{
+		URL:    "ldap://ldap.example.com",
+		BaseDN: "ou=groups,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dials := 0
+	r.dial = func() (ldapConn, error) {
+		dials++
+		return &fakeLDAP{bound: true, groups: testLDAPGroups}, nil
+	}
+	for i := 0; i < 3; i++ {
+		if groups, err := r.Groups("bob"); err != nil || len(groups) != 1 {
+			t.Fatalf("unexpected result %v, %v", groups, err)
+		}
+	}
+	if dials != 1 {
+		t.Fatalf("expected lookups to be cached by default, got %d dials", dials)
+	}
+}
+
+func TestStaticGroupResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "groups.json")
+	if err := os.WriteFile(path, []byte(`{"security": ["alice"], "eng": ["alice", "bob"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStaticGroupResolver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups, _ := r.Groups("alice"); fmt.Sprint(groups) != "[eng security]" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+
+	os.WriteFile(path, []byte(`{"eng": ["bob"]}`), 0600)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if groups, _ := r.Groups("alice"); len(groups) != 0 {
+		t.Fatalf("expected alice to be removed, got %v", groups)
+	}
+
+	os.WriteFile(path, []byte(`not json`), 0600)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected error for malformed file")
+	}
+	if groups, _ := r.Groups("bob"); fmt.Sprint(groups) != "[eng]" {
+		t.Fatalf("expected previous membership to be kept, got %v", groups)
+	}
+}
+
+type countingResolver struct {
+	calls int
+	err   error
+}
+
+func (c *countingResolver) Groups(userID string) ([]string, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []string{"group-of-" + userID}, nil
+}
+
+func TestCachingGroupResolver(t *testing.T) {
+	inner := &countingResolver{}
+	r := NewCachingGroupResolver(inner, time.Minute)
+	now := time.Unix(1000, 0)
+	r.time = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if groups, err := r.Groups("alice"); err != nil || groups[0] != "group-of-alice" {
+			t.Fatalf("unexpected result %v, %v", groups, err)
+		}
+	}
+	if inner.calls != 1 {
+		t.Fatalf("expected lookups to be cached, got %d calls", inner.calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	inner.err = fmt.Errorf("directory down")
+	if _, err := r.Groups("alice"); err == nil {
+		t.Fatal("expected error after expiry")
+	}
+	inner.err = nil
+	r.Groups("alice")
+	if inner.calls != 3 {
+		t.Fatalf("expected errors not to be cached, got %d calls", inner.calls)
+	}
+}
+
+func TestUserCanAccessWithGroupResolver(t *testing.T) {
+	defer SetGroupResolver(nil)
+	path := filepath.Join(t.TempDir(), "groups.json")
+	os.WriteFile(path, []byte(`{"security": ["alice"]}`), 0600)
+	r, err := NewStaticGroupResolver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice logged in claiming "eng", but the directory says "security".
+	alice := NewUser("alice", []string{"eng"})
+	eng := knox.ACL{{Type: knox.UserGroup, ID: "eng", AccessType: knox.Read}}
+	security := knox.ACL{{Type: knox.UserGroup, ID: "security", AccessType: knox.Read}}
+	if !alice.CanAccess(eng, knox.Read) || alice.CanAccess(security, knox.Read) {
+		t.Fatal("expected provider groups without a resolver")
+	}
+
+	SetGroupResolver(r)
+	if alice.CanAccess(eng, knox.Read) || !alice.CanAccess(security, knox.Read) {
+		t.Fatal("expected resolved groups to replace provider groups")
+	}
+
+	// Principals resolve their groups once, so a fresh one sees the new resolver.
+	alice = NewUser("alice", []string{"eng"})
+	SetGroupResolver(&countingResolver{err: fmt.Errorf("directory down")})
+	if alice.CanAccess(security, knox.Read) || alice.CanAccess(eng, knox.Read) {
+		t.Fatal("expected group entries to fail closed when resolution fails")
+	}
+	if !alice.CanAccess(knox.ACL{{Type: knox.User, ID: "alice", AccessType: knox.Read}}, knox.Read) {
+		t.Fatal("expected user entries to be unaffected by resolution failure")
+	}
+}
+
+func TestUserResolvesGroupsOnce(t *testing.T) {
+	defer SetGroupResolver(nil)
+	inner := &countingResolver{}
+	SetGroupResolver(inner)
+
+	alice := NewUser("alice", nil)
+	acl := knox.ACL{
+		{Type: knox.UserGroup, ID: "eng", AccessType: knox.Read},
+		{Type: knox.UserGroup, ID: "security", AccessType: knox.Read},
+		{Type: knox.UserGroup, ID: "group-of-alice", AccessType: knox.Read},
+	}
+	for i := 0; i < 2; i++ {
+		if !alice.CanAccess(acl, knox.Read) || alice.CanAccess(acl, knox.Write) {
+			t.Fatal("expected read access through the resolved group")
+		}
+	}
+	if inner.calls != 1 {
+		t.Fatalf("expected one lookup per principal, got %d", inner.calls)
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pinterest/knox/log"
+)
+
+// jwtAlgorithms are the signature algorithms accepted on JWTs. Symmetric
+// algorithms are excluded as the keys are published.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// defaultJWKSCacheTTL is how long fetched keys are used before refetching.
+const defaultJWKSCacheTTL = time.Hour
+
+// jwksMinRefresh limits refetches triggered by tokens signed with unknown
+// keys, so that garbage tokens cannot hammer the key server.
+const jwksMinRefresh = time.Minute
+
+// jwksSource loads a JSON Web Key Set from a URL or a local file and caches it.
+type jwksSource struct {
+	url    string
+	file   string
+	client httpClient
+	ttl    time.Duration
+	time   func() time.Time
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	fetched   time.Time
+	attempted time.Time
+}
+
+func newJWKSSource(url, file string, timeout, ttl time.Duration) (*jwksSource, error) {
+	if (url == "") == (file == "") {
+		return nil, fmt.Errorf("exactly one of a JWKS URL or a JWKS file is required")
+	}
+	if ttl <= 0 {
+		ttl = defaultJWKSCacheTTL
+	}
+	return &jwksSource{
+		url:    url,
+		file:   file,
+		client: &http.Client{Timeout: timeout},
+		ttl:    ttl,
+		time:   time.Now,
+	}, nil
+}
+
+func (s *jwksSource) load() (*jose.JSONWebKeySet, error) {
+	var b []byte
+	var err error
+	if s.file != "" {
+		b, err = os.ReadFile(s.file)
+	} else {
+		b, err = s.fetch()
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(b, keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *jwksSource) fetch() ([]byte, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("JWKS request returned status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// refresh reloads the key set. On failure the previous keys are kept.
+// Callers must hold s.mu.
+func (s *jwksSource) refresh(now time.Time) error {
+	s.attempted = now
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.fetched = now
+	return nil
+}
+
+// keysFor returns the verification keys matching kid, refreshing the set
+// when it is stale or does not contain kid.
+func (s *jwksSource) keysFor(kid string) ([]jose.JSONWebKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.time()
+
+	stale := now.Sub(s.fetched) >= s.ttl && now.Sub(s.attempted) >= jwksMinRefresh
+	if s.keys == nil || stale {
+		if err := s.refresh(now); err != nil {
+			if s.keys == nil {
+				return nil, fmt.Errorf("could not load JWKS: %v", err)
+			}
+			log.Printf("could not refresh JWKS, using cached keys: %v", err)
+		}
+	}
+	keys := s.match(kid)
+	if len(keys) == 0 && now.Sub(s.attempted) >= jwksMinRefresh {
+		if err := s.refresh(now); err != nil {
+			log.Printf("could not refresh JWKS: %v", err)
+		}
+		keys = s.match(kid)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no JWKS key found for key ID %q", kid)
+	}
+	return keys, nil
+}
+
+func (s *jwksSource) match(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return s.keys.Keys
+	}
+	return s.keys.Key(kid)
+}
+
+// jwtKeySource supplies the keys that may have signed a JWT.
+type jwtKeySource interface {
+	keysFor(kid string) ([]jose.JSONWebKey, error)
+}
+
+// verifyJWT checks the signature of token against keys and decodes its
+// claims into dest. The registered claims are returned for validation.
+func verifyJWT(token string, keys jwtKeySource, dest ...interface{}) (*jwt.Claims, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, fmt.Errorf("JWT must have exactly one signature")
+	}
+	candidates, err := keys.keysFor(tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+	claims := &jwt.Claims{}
+	for _, k := range candidates {
+		if !k.Valid() {
+			continue
+		}
+		if err := tok.Claims(k.Public().Key, append([]interface{}{claims}, dest...)...); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("JWT signature is invalid")
+}
+
+// validateJWTClaims checks the issuer, audience and validity period of
+// claims at now. Tokens without an expiry are rejected.
+func validateJWTClaims(claims *jwt.Claims, issuer, audience string, now time.Time, leeway time.Duration) error {
+	if claims.Expiry == nil {
+		return fmt.Errorf("JWT has no expiry")
+	}
+	expected := jwt.Expected{Issuer: issuer, Time: now}
+	if audience != "" {
+		expected.AnyAudience = jwt.Audience{audience}
+	}
+	return claims.ValidateWithLeeway(expected, leeway)
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pinterest/knox"
+)
+
+// JWTBundleSource locates the JWT bundle of one SPIFFE trust domain: a JWKS
+// document, such as a SPIFFE bundle endpoint or bundle file. Exactly one of
+// URL and File must be set.
+type JWTBundleSource struct {
+	URL  string
+	File string
+}
+
+// JWTSVIDProviderConfig configures a JWTSVIDProvider.
+type JWTSVIDProviderConfig struct {
+	// Bundles maps each trusted trust domain, such as "example.com", to the
+	// source of its JWT signing keys. Required.
+	Bundles map[string]JWTBundleSource
+
+	// Audience must be one of the "aud" claims of every JWT-SVID. Required.
+	Audience string
+
+	// KeyCacheTTL is how long bundles are cached. Defaults to one hour.
+	KeyCacheTTL time.Duration
+
+	// HTTPTimeout bounds requests to bundle URLs.
+	HTTPTimeout time.Duration
+
+	// Leeway allows for clock skew when checking expiry. Defaults to one minute.
+	Leeway time.Duration
+}
+
+// JWTSVIDProvider authenticates SPIFFE workloads by JWT-SVIDs sent in the
+// Authorization header, for workloads that cannot present an X.509-SVID
+// because TLS is terminated before knox.
+type JWTSVIDProvider struct {
+	bundles  map[string]jwtKeySource
+	audience string
+	leeway   time.Duration
+	time     func() time.Time
+}
+
+// NewJWTSVIDProvider builds a JWTSVIDProvider from the given configuration.
+func NewJWTSVIDProvider(cfg JWTSVIDProviderConfig) (*JWTSVIDProvider, error) {
+	if cfg.Audience == "" {
+		return nil, fmt.Errorf("jwt-svid provider requires an audience")
+	}
+	if len(cfg.Bundles) == 0 {
+		return nil, fmt.Errorf("jwt-svid provider requires at least one trust domain bundle")
+	}
+	bundles := map[string]jwtKeySource{}
+	for td, b := range cfg.Bundles {
+		src, err := newJWKSSource(b.URL, b.File, cfg.HTTPTimeout, cfg.KeyCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("trust domain %s: %v", td, err)
+		}
+		bundles[td] = jwtSVIDKeys{src}
+	}
+	leeway := cfg.Leeway
+	if leeway <= 0 {
+		leeway = defaultOIDCLeeway
+	}
+	return &JWTSVIDProvider{
+		bundles:  bundles,
+		audience: cfg.Audience,
+		leeway:   leeway,
+		time:     time.Now,
+	}, nil
+}
+
+// jwtSVIDKeys selects the JWT authorities from a SPIFFE bundle, which may also
+// hold X.509 authorities. Keys from plain JWKS documents are also accepted.
+type jwtSVIDKeys struct {
+	src jwtKeySource
+}
+
+func (k jwtSVIDKeys) keysFor(kid string) ([]jose.JSONWebKey, error) {
+	keys, err := k.src.keysFor(kid)
+	if err != nil {
+		return nil, err
+	}
+	authorities := []jose.JSONWebKey{}
+	for _, key := range keys {
+		if key.Use == "" || key.Use == "sig" || key.Use == "jwt-svid" {
+			authorities = append(authorities, key)
+		}
+	}
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("no JWT authority found for key ID %q", kid)
+	}
+	return authorities, nil
+}
+
+// Version is set to 0 for JWTSVIDProvider
+func (p *JWTSVIDProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *JWTSVIDProvider) Name() string {
+	return "spiffe-jwt"
+}
+
+// Type is set to j for JWTSVIDProvider
+func (p *JWTSVIDProvider) Type() byte {
+	return 'j'
+}
+
+// Schemes is set to Bearer for JWTSVIDProvider, as JWT-SVIDs are bearer
+// tokens verified locally.
+func (p *JWTSVIDProvider) Schemes() []string {
+	return []string{knox.BearerScheme}
+}
+
+// Authenticate verifies the JWT-SVID against the bundle of the trust domain
+// named in its subject and returns the service it identifies.
+func (p *JWTSVIDProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	// The subject selects the bundle, so it is read before verification.
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	unverified := jwt.Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, err
+	}
+	td, err := spiffeTrustDomain(unverified.Subject)
+	if err != nil {
+		return nil, err
+	}
+	bundle, ok := p.bundles[td]
+	if !ok {
+		return nil, fmt.Errorf("auth: trust domain %s is not trusted", td)
+	}
+
+	claims, err := verifyJWT(token, bundle)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateJWTClaims(claims, "", p.audience, p.time(), p.leeway); err != nil {
+		return nil, err
+	}
+	return spiffeToPrincipal([]string{claims.Subject})
+}
+
+// spiffeTrustDomain returns the trust domain of a SPIFFE ID.
+func spiffeTrustDomain(spiffeID string) (string, error) {
+	if !strings.HasPrefix(spiffeID, "spiffe://") {
+		return "", fmt.Errorf("auth: service identity is not a valid SPIFFE ID (bad prefix)")
+	}
+	td := strings.SplitN(spiffeID[len("spiffe://"):], "/", 2)[0]
+	if td == "" {
+		return "", fmt.Errorf("auth: service identity is not a valid SPIFFE ID (no trust domain)")
+	}
+	return td, nil
+}
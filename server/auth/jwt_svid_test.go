@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestJWTSVIDProvider(t *testing.T) {
+	exampleKey := newECSigningKey(t, "ex1")
+	otherKey := newRSASigningKey(t, "ot1")
+
+	// The example.com bundle is a SPIFFE bundle holding an X.509 authority
+	// under the same key ID as well as the JWT authority.
+	x509Authority := newECSigningKey(t, "ex2").jwk()
+	x509Authority.Use = "x509-svid"
+	jwtAuthority := exampleKey.jwk()
+	jwtAuthority.Use = "jwt-svid"
+	bundle, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwtAuthority, x509Authority}})
+	path := filepath.Join(t.TempDir(), "example.com.json")
+	if err := os.WriteFile(path, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksJSON(t, otherKey))
+	}))
+	defer srv.Close()
+
+	p, err := NewJWTSVIDProvider(JWTSVIDProviderConfig{
+		Audience: "knox",
+		Bundles: map[string]JWTBundleSource{
+			"example.com": {File: path},
+			"other.org":   {URL: srv.URL},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(sub string, aud ...string) jwt.Claims {
+		return jwt.Claims{
+			Subject:  sub,
+			Audience: aud,
+			Expiry:   jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+		}
+	}
+
+	principal, err := p.Authenticate(exampleKey.sign(t, claims("spiffe://example.com/team/app", "knox")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := NewServiceFromSpiffeID("spiffe://example.com/team/app")
+	if principal != expected || !IsService(principal) {
+		t.Fatalf("expected %v, got %v", expected, principal)
+	}
+	if _, err := p.Authenticate(otherKey.sign(t, claims("spiffe://other.org/app", "knox")), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := map[string]string{
+		"wrong audience":      exampleKey.sign(t, claims("spiffe://example.com/team/app", "other")),
+		"untrusted domain":    exampleKey.sign(t, claims("spiffe://evil.com/app", "knox")),
+		"cross-domain signer": otherKey.sign(t, claims("spiffe://example.com/team/app", "knox")),
+		"not spiffe":          exampleKey.sign(t, claims("alice", "knox")),
+		"no path":             exampleKey.sign(t, claims("spiffe://example.com", "knox")),
+		"x509 authority":      newECSigningKey(t, "ex2").sign(t, claims("spiffe://example.com/team/app", "knox")),
+		"expired": exampleKey.sign(t, jwt.Claims{
+			Subject:  "spiffe://example.com/team/app",
+			Audience: jwt.Audience{"knox"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		}),
+	}
+	for name, token := range bad {
+		if _, err := p.Authenticate(token, nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNewJWTSVIDProviderValidation(t *testing.T) {
+	cfgs := []JWTSVIDProviderConfig{
+		{Bundles: map[string]JWTBundleSource{"example.com": {File: "f"}}},
+		{Audience: "knox"},
+		{Audience: "knox", Bundles: map[string]JWTBundleSource{"example.com": {}}},
+	}
+	for _, cfg := range cfgs {
+		if _, err := NewJWTSVIDProvider(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// defaultKubernetesIDTemplate follows the SPIFFE IDs issued to pods by common
+// service meshes.
+const defaultKubernetesIDTemplate = "spiffe://cluster.local/ns/{namespace}/sa/{serviceaccount}"
+
+// serviceAccountPrefix prefixes the username of every service account.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// KubernetesProviderConfig configures a KubernetesProvider. Tokens are
+// checked either by the API server's TokenReview API, when TokenReviewURL is
+// set, or offline against the cluster's service account issuer keys, when
+// JWKSURL or JWKSFile is set. Exactly one mode must be configured.
+type KubernetesProviderConfig struct {
+	// TokenReviewURL is the TokenReview endpoint, such as
+	// https://kubernetes.default.svc/apis/authentication.k8s.io/v1/tokenreviews.
+	TokenReviewURL string
+
+	// BearerTokenFile holds the token knox presents to the TokenReview API.
+	// It is reread on every review so that rotated tokens are picked up.
+	BearerTokenFile string
+
+	// TLSConfig is used to connect to the TokenReview API.
+	TLSConfig *tls.Config
+
+	// Issuer must match the "iss" claim of every token. Required offline.
+	Issuer string
+
+	// JWKSURL or JWKSFile locates the service account issuer's signing keys.
+	JWKSURL  string
+	JWKSFile string
+
+	// KeyCacheTTL is how long signing keys are cached. Defaults to one hour.
+	KeyCacheTTL time.Duration
+
+	// Audience must be one of the audiences of every token. Tokens projected
+	// for knox should be requested with this audience. Required offline, where
+	// tokens issued for other services would otherwise be accepted; optional
+	// with TokenReview, which checks the API server's audiences by default.
+	Audience string
+
+	// IDTemplate builds the service ID from the placeholders {namespace} and
+	// {serviceaccount}, and must produce a SPIFFE ID. Defaults to
+	// spiffe://cluster.local/ns/{namespace}/sa/{serviceaccount}.
+	IDTemplate string
+
+	// HTTPTimeout bounds requests to the TokenReview API and JWKSURL.
+	HTTPTimeout time.Duration
+
+	// Leeway allows for clock skew when checking expiry. Defaults to one minute.
+	Leeway time.Duration
+}
+
+// KubernetesProvider authenticates pods by their service account tokens and
+// returns a service principal, so pods can be granted access with Service
+// and ServicePrefix ACL entries.
+type KubernetesProvider struct {
+	cfg    KubernetesProviderConfig
+	client httpClient
+	keys   jwtKeySource
+	time   func() time.Time
+}
+
+// NewKubernetesProvider builds a KubernetesProvider from the given configuration.
+func NewKubernetesProvider(cfg KubernetesProviderConfig) (*KubernetesProvider, error) {
+	offline := cfg.JWKSURL != "" || cfg.JWKSFile != ""
+	if (cfg.TokenReviewURL == "") == !offline {
+		return nil, fmt.Errorf("kubernetes provider requires exactly one of a TokenReview URL or issuer keys")
+	}
+	if cfg.IDTemplate == "" {
+		cfg.IDTemplate = defaultKubernetesIDTemplate
+	}
+	if _, err := NewServiceFromSpiffeID(kubernetesServiceID(cfg.IDTemplate, "ns", "sa")); err != nil {
+		return nil, fmt.Errorf("invalid ID template: %v", err)
+	}
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = defaultOIDCLeeway
+	}
+	p := &KubernetesProvider{cfg: cfg, time: time.Now}
+	if offline {
+		if cfg.Issuer == "" {
+			return nil, fmt.Errorf("kubernetes provider requires an issuer to verify tokens offline")
+		}
+		if cfg.Audience == "" {
+			return nil, fmt.Errorf("kubernetes provider requires an audience to verify tokens offline")
+		}
+		keys, err := newJWKSSource(cfg.JWKSURL, cfg.JWKSFile, cfg.HTTPTimeout, cfg.KeyCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = keys
+	} else {
+		p.client = &http.Client{
+			Timeout:   cfg.HTTPTimeout,
+			Transport: &http.Transport{TLSClientConfig: cfg.TLSConfig},
+		}
+	}
+	return p, nil
+}
+
+// Version is set to 0 for KubernetesProvider
+func (p *KubernetesProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *KubernetesProvider) Name() string {
+	return "kubernetes"
+}
+
+// Type is set to k for KubernetesProvider
+func (p *KubernetesProvider) Type() byte {
+	return 'k'
+}
+
+// Schemes is set to Knox-Kubernetes for KubernetesProvider. Bearer is not
+// accepted so that other tokens are never sent to the TokenReview API.
+func (p *KubernetesProvider) Schemes() []string {
+	return []string{knox.KubernetesScheme}
+}
+
+// Authenticate validates the service account token and returns the service
+// built from its namespace and service account.
+func (p *KubernetesProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	var username string
+	var err error
+	if p.keys != nil {
+		username, err = p.verifyOffline(token)
+	} else {
+		username, err = p.review(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	namespace, name, err := parseServiceAccount(username)
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceFromSpiffeID(kubernetesServiceID(p.cfg.IDTemplate, namespace, name))
+}
+
+func (p *KubernetesProvider) verifyOffline(token string) (string, error) {
+	claims, err := verifyJWT(token, p.keys)
+	if err != nil {
+		return "", err
+	}
+	if err := validateJWTClaims(claims, p.cfg.Issuer, p.cfg.Audience, p.time(), p.cfg.Leeway); err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+type tokenReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenReviewSpec    `json:"spec"`
+	Status     *tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	Audiences     []string `json:"audiences"`
+	Error         string   `json:"error"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// review asks the API server whether token is valid and returns its username.
+func (p *KubernetesProvider) review(token string) (string, error) {
+	review := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	}
+	if p.cfg.Audience != "" {
+		review.Spec.Audiences = []string{p.cfg.Audience}
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", p.cfg.TokenReviewURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.cfg.BearerTokenFile != "" {
+		b, err := os.ReadFile(p.cfg.BearerTokenFile)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(b)))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("TokenReview request returned status %s", resp.Status)
+	}
+	result := tokenReview{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Status == nil || !result.Status.Authenticated {
+		if result.Status != nil && result.Status.Error != "" {
+			return "", fmt.Errorf("token was not authenticated: %s", result.Status.Error)
+		}
+		return "", fmt.Errorf("token was not authenticated")
+	}
+	if p.cfg.Audience != "" && !containsString(result.Status.Audiences, p.cfg.Audience) {
+		return "", fmt.Errorf("token is not intended for audience %q", p.cfg.Audience)
+	}
+	return result.Status.User.Username, nil
+}
+
+// parseServiceAccount splits a username of the form
+// system:serviceaccount:<namespace>:<name>.
+func parseServiceAccount(username string) (namespace, name string, err error) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", "", fmt.Errorf("auth: %q is not a service account", username)
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("auth: malformed service account %q", username)
+	}
+	return parts[0], parts[1], nil
+}
+
+func kubernetesServiceID(template, namespace, name string) string {
+	return strings.NewReplacer("{namespace}", namespace, "{serviceaccount}", name).Replace(template)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
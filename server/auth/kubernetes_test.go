@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pinterest/knox"
+)
+
+func TestKubernetesProviderTokenReview(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("knox-sa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer knox-sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		review := tokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Kind != "TokenReview" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := &tokenReviewStatus{Audiences: review.Spec.Audiences}
+		switch review.Spec.Token {
+		case "pod-token":
+			status.Authenticated = true
+			status.User.Username = "system:serviceaccount:payments:api"
+		case "other-audience":
+			status.Authenticated = true
+			status.Audiences = []string{"vault"}
+			status.User.Username = "system:serviceaccount:payments:api"
+		case "user-token":
+			status.Authenticated = true
+			status.User.Username = "alice"
+		default:
+			status.Error = "invalid token"
+		}
+		review.Status = status
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer srv.Close()
+
+	p, err := NewKubernetesProvider(KubernetesProviderConfig{
+		TokenReviewURL:  srv.URL,
+		BearerTokenFile: tokenFile,
+		Audience:        "knox",
+		IDTemplate:      "spiffe://k8s.example.com/{namespace}/{serviceaccount}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := p.Authenticate("pod-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != "spiffe://k8s.example.com/payments/api" || !IsService(principal) {
+		t.Fatalf("unexpected principal %v", principal)
+	}
+	acl := knox.ACL{{Type: knox.ServicePrefix, ID: "spiffe://k8s.example.com/payments/", AccessType: knox.Read}}
+	if !principal.CanAccess(acl, knox.Read) {
+		t.Fatal("expected pod to be granted access by service prefix")
+	}
+
+	for _, token := range []string{"garbage", "other-audience", "user-token"} {
+		if _, err := p.Authenticate(token, nil); err == nil {
+			t.Errorf("%s: expected error", token)
+		}
+	}
+}
+
+func TestKubernetesProviderOffline(t *testing.T) {
+	key := newRSASigningKey(t, "sa1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksJSON(t, key))
+	}))
+	defer srv.Close()
+
+	issuer := "https://oidc.k8s.example.com"
+	p, err := NewKubernetesProvider(KubernetesProviderConfig{Issuer: issuer, JWKSURL: srv.URL, Audience: "knox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(sub, aud string) jwt.Claims {
+		return jwt.Claims{
+			Issuer:   issuer,
+			Subject:  sub,
+			Audience: jwt.Audience{aud},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}
+	}
+	principal, err := p.Authenticate(key.sign(t, claims("system:serviceaccount:default:builder", "knox")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != "spiffe://cluster.local/ns/default/sa/builder" || !IsService(principal) {
+		t.Fatalf("unexpected principal %v", principal)
+	}
+
+	bad := map[string]string{
+		"wrong audience": key.sign(t, claims("system:serviceaccount:default:builder", "vault")),
+		"not an account": key.sign(t, claims("system:node:worker-1", "knox")),
+		"malformed":      key.sign(t, claims("system:serviceaccount:default", "knox")),
+		"unknown key":    newRSASigningKey(t, "sa1").sign(t, claims("system:serviceaccount:default:builder", "knox")),
+	}
+	for name, token := range bad {
+		if _, err := p.Authenticate(token, nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNewKubernetesProviderValidation(t *testing.T) {
+	cfgs := []KubernetesProviderConfig{
+		{},
+		{TokenReviewURL: "u", JWKSFile: "f", Issuer: "iss"},
+		{JWKSFile: "f"},
+		{JWKSFile: "f", Issuer: "iss"},
+		{TokenReviewURL: "u", IDTemplate: "{namespace}/{serviceaccount}"},
+	}
+	for _, cfg := range cfgs {
+		if _, err := NewKubernetesProvider(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
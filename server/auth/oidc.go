@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// defaultOIDCLeeway allows for clock skew between knox and the identity provider.
+const defaultOIDCLeeway = time.Minute
+
+// OIDCProviderConfig configures an OIDCProvider.
+type OIDCProviderConfig struct {
+	// Issuer must match the "iss" claim of every token. Required.
+	Issuer string
+
+	// Audience must be one of the "aud" claims of every token, typically the
+	// client ID registered for knox. Required.
+	Audience string
+
+	// JWKSURL or JWKSFile locates the issuer's signing keys. Exactly one is
+	// required.
+	JWKSURL  string
+	JWKSFile string
+
+	// KeyCacheTTL is how long signing keys are cached. Defaults to one hour.
+	// Tokens signed by unknown keys trigger an earlier refetch.
+	KeyCacheTTL time.Duration
+
+	// HTTPTimeout bounds requests to JWKSURL.
+	HTTPTimeout time.Duration
+
+	// UserClaim names the claim holding the user ID. Defaults to "sub".
+	UserClaim string
+
+	// GroupsClaim names the claim holding the user's groups, either a string
+	// or a list of strings. If empty, users have no groups.
+	GroupsClaim string
+
+	// Leeway allows for clock skew when checking expiry. Defaults to one minute.
+	Leeway time.Duration
+}
+
+// OIDCProvider authenticates users by the OIDC ID or access tokens (JWTs)
+// issued by a single-sign-on identity provider.
+type OIDCProvider struct {
+	cfg  OIDCProviderConfig
+	keys jwtKeySource
+	time func() time.Time
+}
+
+// NewOIDCProvider builds an OIDCProvider from the given configuration.
+func NewOIDCProvider(cfg OIDCProviderConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" {
+		return nil, fmt.Errorf("oidc provider requires an issuer")
+	}
+	if cfg.Audience == "" {
+		return nil, fmt.Errorf("oidc provider requires an audience")
+	}
+	keys, err := newJWKSSource(cfg.JWKSURL, cfg.JWKSFile, cfg.HTTPTimeout, cfg.KeyCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = defaultOIDCLeeway
+	}
+	return &OIDCProvider{cfg: cfg, keys: keys, time: time.Now}, nil
+}
+
+// Version is set to 0 for OIDCProvider
+func (p *OIDCProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *OIDCProvider) Name() string {
+	return "oidc"
+}
+
+// Type is set to o for OIDCProvider
+func (p *OIDCProvider) Type() byte {
+	return 'o'
+}
+
+// Schemes is set to Bearer for OIDCProvider, as ID tokens are verified locally.
+func (p *OIDCProvider) Schemes() []string {
+	return []string{knox.BearerScheme}
+}
+
+// Authenticate verifies the token's signature, issuer, audience and expiry
+// and returns the user named by the configured claims.
+func (p *OIDCProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	custom := map[string]interface{}{}
+	claims, err := verifyJWT(token, p.keys, &custom)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateJWTClaims(claims, p.cfg.Issuer, p.cfg.Audience, p.time(), p.cfg.Leeway); err != nil {
+		return nil, err
+	}
+
+	id, ok := custom[p.cfg.UserClaim].(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("token has no %q claim", p.cfg.UserClaim)
+	}
+	groups, err := stringsClaim(custom, p.cfg.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+	return NewUser(id, groups), nil
+}
+
+// stringsClaim reads a claim that may be a single string or a list of strings.
+// A missing claim yields no values.
+func stringsClaim(claims map[string]interface{}, name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	switch v := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %q must contain only strings", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim %q must be a string or a list of strings", name)
+	}
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pinterest/knox"
+)
+
+type testSigningKey struct {
+	kid  string
+	alg  jose.SignatureAlgorithm
+	priv interface{}
+	pub  interface{}
+}
+
+func newRSASigningKey(t *testing.T, kid string) testSigningKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigningKey{kid: kid, alg: jose.RS256, priv: k, pub: &k.PublicKey}
+}
+
+func newECSigningKey(t *testing.T, kid string) testSigningKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigningKey{kid: kid, alg: jose.ES256, priv: k, pub: &k.PublicKey}
+}
+
+func (k testSigningKey) jwk() jose.JSONWebKey {
+	return jose.JSONWebKey{Key: k.pub, KeyID: k.kid, Algorithm: string(k.alg), Use: "sig"}
+}
+
+func (k testSigningKey) sign(t *testing.T, claims ...interface{}) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: k.alg, Key: jose.JSONWebKey{Key: k.priv, KeyID: k.kid}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := jwt.Signed(signer)
+	for _, c := range claims {
+		b = b.Claims(c)
+	}
+	s, err := b.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func jwksJSON(t *testing.T, keys ...testSigningKey) []byte {
+	set := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestOIDCProvider(t *testing.T) {
+	key := newRSASigningKey(t, "k1")
+	var fetches int32
+	jwks := atomic.Value{}
+	jwks.Store(jwksJSON(t, key))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(jwks.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	p, err := NewOIDCProvider(OIDCProviderConfig{
+		Issuer:      "https://sso.example.com",
+		Audience:    "knox",
+		JWKSURL:     srv.URL,
+		UserClaim:   "email",
+		GroupsClaim: "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	p.time = func() time.Time { return now }
+	p.keys.(*jwksSource).time = p.time
+
+	good := jwt.Claims{
+		Issuer:   "https://sso.example.com",
+		Subject:  "00u1",
+		Audience: jwt.Audience{"knox", "other"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(now),
+	}
+	extra := map[string]interface{}{"email": "alice@example.com", "groups": []string{"eng", "security"}}
+
+	principal, err := p.Authenticate(key.sign(t, good, extra), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != "alice@example.com" {
+		t.Fatalf("unexpected user %s", principal.GetID())
+	}
+	if !principal.CanAccess(knox.ACL{{Type: knox.UserGroup, ID: "security", AccessType: knox.Read}}, knox.Read) {
+		t.Fatal("expected groups from claim")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Authenticate(key.sign(t, good, extra), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f := atomic.LoadInt32(&fetches); f != 1 {
+		t.Fatalf("expected keys to be cached, got %d fetches", f)
+	}
+
+	bad := map[string]jwt.Claims{}
+	c := good
+	c.Issuer = "https://evil.example.com"
+	bad["issuer"] = c
+	c = good
+	c.Audience = jwt.Audience{"other"}
+	bad["audience"] = c
+	c = good
+	c.Expiry = jwt.NewNumericDate(now.Add(-2 * time.Minute))
+	bad["expired"] = c
+	c = good
+	c.Expiry = nil
+	bad["no expiry"] = c
+	for name, claims := range bad {
+		if _, err := p.Authenticate(key.sign(t, claims, extra), nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := p.Authenticate(key.sign(t, good), nil); err == nil {
+		t.Error("expected error for missing user claim")
+	}
+	if _, err := p.Authenticate(newRSASigningKey(t, "k1").sign(t, good, extra), nil); err == nil {
+		t.Error("expected error for token signed by a different key")
+	}
+	if _, err := p.Authenticate(key.sign(t, good, extra)+"x", nil); err == nil {
+		t.Error("expected error for tampered token")
+	}
+
+	// A rotated key is picked up without waiting for the cache to expire, but
+	// only once per refresh interval.
+	rotated := newECSigningKey(t, "k2")
+	jwks.Store(jwksJSON(t, key, rotated))
+	now = now.Add(2 * jwksMinRefresh)
+	if _, err := p.Authenticate(rotated.sign(t, good, extra), nil); err != nil {
+		t.Fatalf("expected rotated key to be fetched, got %v", err)
+	}
+	unknown := newECSigningKey(t, "k3")
+	p.Authenticate(unknown.sign(t, good, extra), nil)
+	p.Authenticate(unknown.sign(t, good, extra), nil)
+	if f := atomic.LoadInt32(&fetches); f != 2 {
+		t.Fatalf("expected unknown keys to be rate limited, got %d fetches", f)
+	}
+}
+
+func TestOIDCProviderJWKSFile(t *testing.T) {
+	key := newECSigningKey(t, "")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(t, key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewOIDCProvider(OIDCProviderConfig{Issuer: "iss", Audience: "knox", JWKSFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := key.sign(t, jwt.Claims{
+		Issuer:   "iss",
+		Subject:  "bob",
+		Audience: jwt.Audience{"knox"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	principal, err := p.Authenticate(token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != "bob" || !IsUser(principal) {
+		t.Fatalf("unexpected principal %v", principal)
+	}
+}
+
+func TestNewOIDCProviderValidation(t *testing.T) {
+	cfgs := []OIDCProviderConfig{
+		{Audience: "knox", JWKSFile: "f"},
+		{Issuer: "iss", JWKSFile: "f"},
+		{Issuer: "iss", Audience: "knox"},
+		{Issuer: "iss", Audience: "knox", JWKSFile: "f", JWKSURL: "u"},
+	}
+	for _, cfg := range cfgs {
+		if _, err := NewOIDCProvider(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestStringsClaim(t *testing.T) {
+	claims := map[string]interface{}{"one": "a", "many": []interface{}{"a", "b"}, "bad": []interface{}{1}, "num": 3.0}
+	if v, err := stringsClaim(claims, "one"); err != nil || len(v) != 1 {
+		t.Errorf("unexpected %v, %v", v, err)
+	}
+	if v, err := stringsClaim(claims, "many"); err != nil || len(v) != 2 {
+		t.Errorf("unexpected %v, %v", v, err)
+	}
+	if v, err := stringsClaim(claims, "missing"); err != nil || v != nil {
+		t.Errorf("unexpected %v, %v", v, err)
+	}
+	for _, name := range []string{"bad", "num"} {
+		if _, err := stringsClaim(claims, name); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
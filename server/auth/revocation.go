@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/internal/bounded"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrCertificateRevoked is returned (wrapped) when a client certificate or
+// one of its issuers has been revoked.
+var ErrCertificateRevoked = errors.New("auth: certificate has been revoked")
+
+// RevocationChecker checks whether cert, issued by issuer, has been revoked.
+// It returns an error wrapping ErrCertificateRevoked if so, or another error
+// if revocation status is required but could not be determined.
+type RevocationChecker interface {
+	Check(cert, issuer *x509.Certificate) error
+}
+
+// checkRevocation runs checkers over every certificate in chain but the root.
+func checkRevocation(chain []*x509.Certificate, checkers []RevocationChecker) error {
+	for i := 0; i+1 < len(chain); i++ {
+		for _, c := range checkers {
+			if err := c.Check(chain[i], chain[i+1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func revokedErr(cert *x509.Certificate) error {
+	return fmt.Errorf("%w: serial %s issued by %s", ErrCertificateRevoked, cert.SerialNumber, cert.Issuer)
+}
+
+// defaultCRLRefresh is used when NewCRLChecker is given no refresh interval.
+const defaultCRLRefresh = 5 * time.Minute
+
+// CRLChecker checks certificates against certificate revocation lists read
+// from local files, in PEM or DER form. The files are reread when they are
+// older than the refresh interval. Certificates whose issuer has no CRL pass.
+// A CRL past its next update time may no longer list every revocation, so
+// certificates whose issuer has only such lists are rejected unless FailOpen
+// is set.
+type CRLChecker struct {
+	// FailOpen accepts certificates whose issuer has only CRLs that are past
+	// their next update time. By default such certificates are rejected.
+	FailOpen bool
+
+	paths   []string
+	refresh time.Duration
+	time    func() time.Time
+
+	mu     sync.Mutex
+	loaded time.Time
+	crls   []*x509.RevocationList
+}
+
+// NewCRLChecker loads the CRLs at paths, rereading them every refresh.
+func NewCRLChecker(paths []string, refresh time.Duration) (*CRLChecker, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("at least one CRL file is required")
+	}
+	if refresh <= 0 {
+		refresh = defaultCRLRefresh
+	}
+	c := &CRLChecker{paths: paths, refresh: refresh, time: time.Now}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseCRLFile(path string) ([]*x509.RevocationList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	if bytes.Contains(b, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = [][]byte{b}
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("%s contains no CRL", path)
+	}
+	crls := make([]*x509.RevocationList, 0, len(ders))
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// reload rereads every CRL file. On error the previous CRLs are kept.
+func (c *CRLChecker) reload() error {
+	crls := []*x509.RevocationList{}
+	for _, path := range c.paths {
+		parsed, err := parseCRLFile(path)
+		if err != nil {
+			return err
+		}
+		crls = append(crls, parsed...)
+	}
+	c.crls = crls
+	c.loaded = c.time()
+	return nil
+}
+
+// Check reports whether cert appears on a CRL signed by issuer.
+func (c *CRLChecker) Check(cert, issuer *x509.Certificate) error {
+	now := c.time()
+	c.mu.Lock()
+	if now.Sub(c.loaded) >= c.refresh {
+		if err := c.reload(); err != nil {
+			log.Printf("could not reload CRLs, using previous lists: %v", err)
+			// Wait for the next interval rather than retrying on every request.
+			c.loaded = c.time()
+		}
+	}
+	crls := c.crls
+	c.mu.Unlock()
+
+	fresh, stale := false, false
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		// Only lists actually signed by the issuer are trusted.
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			continue
+		}
+		// Revocations on a stale list still stand.
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revokedErr(cert)
+			}
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			stale = true
+		} else {
+			fresh = true
+		}
+	}
+	if stale && !fresh {
+		if c.FailOpen {
+			log.Printf("CRL for %s is past its next update, accepting serial %s", issuer.Subject, cert.SerialNumber)
+			return nil
+		}
+		return fmt.Errorf("auth: could not check revocation status: CRL for %s is past its next update", issuer.Subject)
+	}
+	return nil
+}
+
+// defaultOCSPCacheTTL bounds how long an OCSP response without a next update
+// time is reused.
+const defaultOCSPCacheTTL = time.Hour
+
+// OCSPCheckerConfig configures an OCSPChecker.
+type OCSPCheckerConfig struct {
+	// ResponderURL overrides the responder named in each certificate.
+	ResponderURL string
+
+	// Timeout bounds each OCSP request.
+	Timeout time.Duration
+
+	// MaxCacheTTL bounds how long a response is reused, regardless of its
+	// next update time. Defaults to one hour.
+	MaxCacheTTL time.Duration
+
+	// FailOpen accepts certificates whose status cannot be determined, such
+	// as when the responder is unreachable or names no responder. By
+	// default such certificates are rejected.
+	FailOpen bool
+}
+
+type ocspCacheKey struct {
+	issuer string
+	serial string
+}
+
+type ocspCacheEntry struct {
+	status int
+	expiry time.Time
+}
+
+// maxOCSPCacheEntries bounds the memory used by an OCSPChecker.
+const maxOCSPCacheEntries = 10000
+
+// OCSPChecker checks certificates with their issuer's OCSP responder,
+// caching responses until their next update time.
+type OCSPChecker struct {
+	cfg    OCSPCheckerConfig
+	client httpClient
+	time   func() time.Time
+
+	mu    sync.Mutex
+	cache map[ocspCacheKey]ocspCacheEntry
+}
+
+// NewOCSPChecker builds an OCSPChecker from the given configuration.
+func NewOCSPChecker(cfg OCSPCheckerConfig) *OCSPChecker {
+	if cfg.MaxCacheTTL <= 0 {
+		cfg.MaxCacheTTL = defaultOCSPCacheTTL
+	}
+	return &OCSPChecker{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		time:   time.Now,
+		cache:  map[ocspCacheKey]ocspCacheEntry{},
+	}
+}
+
+// Check asks the OCSP responder whether cert has been revoked.
+func (o *OCSPChecker) Check(cert, issuer *x509.Certificate) error {
+	key := ocspCacheKey{string(issuer.RawSubject), cert.SerialNumber.String()}
+	now := o.time()
+	o.mu.Lock()
+	e, ok := o.cache[key]
+	o.mu.Unlock()
+	if !ok || !now.Before(e.expiry) {
+		resp, err := o.query(cert, issuer)
+		if err != nil {
+			if o.cfg.FailOpen {
+				log.Printf("OCSP check failed for serial %s, accepting: %v", cert.SerialNumber, err)
+				return nil
+			}
+			return fmt.Errorf("auth: could not check revocation status: %w", err)
+		}
+		e = ocspCacheEntry{status: resp.Status, expiry: now.Add(o.cfg.MaxCacheTTL)}
+		if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(e.expiry) {
+			e.expiry = resp.NextUpdate
+		}
+		o.store(key, e, now)
+	}
+
+	switch e.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return revokedErr(cert)
+	default:
+		if o.cfg.FailOpen {
+			return nil
+		}
+		return fmt.Errorf("auth: revocation status of serial %s is unknown", cert.SerialNumber)
+	}
+}
+
+func (o *OCSPChecker) store(key ocspCacheKey, e ocspCacheEntry, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !bounded.MakeRoom(o.cache, maxOCSPCacheEntries, func(v ocspCacheEntry) bool { return !now.Before(v.expiry) }) {
+		clear(o.cache)
+	}
+	o.cache[key] = e
+}
+
+func (o *OCSPChecker) query(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	url := o.cfg.ResponderURL
+	if url == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, fmt.Errorf("certificate names no OCSP responder")
+		}
+		url = cert.OCSPServer[0]
+	}
+	reqBytes, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("OCSP responder returned status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.SerialNumber == nil || parsed.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return nil, fmt.Errorf("OCSP response is for serial %v, not %s", parsed.SerialNumber, cert.SerialNumber)
+	}
+	if now := o.time(); !parsed.NextUpdate.IsZero() && now.After(parsed.NextUpdate) {
+		return nil, fmt.Errorf("OCSP response is stale")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeCRL writes a PEM CRL signed by ca revoking the given certificates.
+func (ca testCA) writeCRL(t *testing.T, path string, revoked ...*x509.Certificate) {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRLChecker(t *testing.T) {
+	ca, otherCA := newTestCA(t, "crl-ca"), newTestCA(t, "crl-other")
+	good := ca.issue(t, "spiffe://example.com/good")
+	revoked := ca.issue(t, "spiffe://example.com/revoked")
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, path, revoked)
+
+	checker, err := NewCRLChecker([]string{path}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	checker.time = func() time.Time { return now }
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	p := NewSpiffeAuthProvider(pool)
+	p.AddRevocationChecker(checker)
+
+	if _, err := p.Authenticate("", tlsRequest(good)); err != nil {
+		t.Fatalf("expected unrevoked certificate to be accepted, got %v", err)
+	}
+	_, err = p.Authenticate("", tlsRequest(revoked))
+	if !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected revoked error, got %v", err)
+	}
+
+	// A list from another CA cannot revoke this CA's certificates, even if
+	// the serial numbers match.
+	if err := checker.Check(revoked, otherCA.cert); err != nil {
+		t.Fatalf("expected CRL of another issuer to be ignored, got %v", err)
+	}
+
+	// Revoking the good certificate takes effect after the refresh interval,
+	// and a broken file keeps the previous lists.
+	ca.writeCRL(t, path, revoked, good)
+	if _, err := p.Authenticate("", tlsRequest(good)); err != nil {
+		t.Fatalf("expected CRL to be cached until refresh, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := p.Authenticate("", tlsRequest(good)); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected refreshed CRL to revoke certificate, got %v", err)
+	}
+	os.WriteFile(path, []byte("garbage"), 0600)
+	now = now.Add(time.Minute)
+	if _, err := p.Authenticate("", tlsRequest(good)); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected previous CRL to be kept, got %v", err)
+	}
+
+	// Once the list passes its next update time it can no longer vouch for
+	// certificates, though its revocations still stand.
+	unlisted := ca.issue(t, "spiffe://example.com/unlisted")
+	now = now.Add(2 * time.Hour)
+	if err := checker.Check(unlisted, ca.cert); errors.Is(err, ErrCertificateRevoked) || err == nil {
+		t.Fatalf("expected stale CRL to be refused, got %v", err)
+	}
+	checker.FailOpen = true
+	if err := checker.Check(unlisted, ca.cert); err != nil {
+		t.Fatalf("expected stale CRL to be accepted when failing open, got %v", err)
+	}
+	if err := checker.Check(good, ca.cert); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected stale CRL to keep its revocations, got %v", err)
+	}
+
+	if _, err := NewCRLChecker(nil, 0); err == nil {
+		t.Error("expected error for no CRL files")
+	}
+	if _, err := NewCRLChecker([]string{path}, 0); err == nil {
+		t.Error("expected error for malformed CRL")
+	}
+}
+
+func TestOCSPChecker(t *testing.T) {
+	ca := newTestCA(t, "ocsp-ca")
+	good := ca.issue(t, "spiffe://example.com/good")
+	revoked := ca.issue(t, "spiffe://example.com/revoked")
+
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tmpl := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(10 * time.Minute),
+		}
+		if req.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
+			tmpl.Status = ocsp.Revoked
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	checker := NewOCSPChecker(OCSPCheckerConfig{ResponderURL: srv.URL, Timeout: time.Second})
+	now := time.Now()
+	checker.time = func() time.Time { return now }
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	p := NewMTLSAuthProvider(pool)
+	p.AddRevocationChecker(checker)
+
+	// The MTLS provider matches the token against the certificate's names,
+	// so the checker is exercised directly for the SPIFFE certificates.
+	if err := checker.Check(good, ca.cert); err != nil {
+		t.Fatalf("expected good status, got %v", err)
+	}
+	if err := checker.Check(revoked, ca.cert); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected revoked error, got %v", err)
+	}
+	if _, err := p.Authenticate("", tlsRequest(revoked)); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected provider to reject revoked certificate, got %v", err)
+	}
+
+	// Responses are cached until their next update.
+	before := atomic.LoadInt32(&queries)
+	checker.Check(good, ca.cert)
+	if atomic.LoadInt32(&queries) != before {
+		t.Fatal("expected cached OCSP response to be used")
+	}
+	now = now.Add(11 * time.Minute)
+	checker.Check(good, ca.cert)
+	if atomic.LoadInt32(&queries) != before+1 {
+		t.Fatal("expected expired OCSP response to be refreshed")
+	}
+
+	// An unreachable responder fails closed unless configured to fail open.
+	closed := NewOCSPChecker(OCSPCheckerConfig{ResponderURL: "http://127.0.0.1:1", Timeout: time.Second})
+	if err := closed.Check(good, ca.cert); err == nil || errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("expected unknown status error, got %v", err)
+	}
+	open := NewOCSPChecker(OCSPCheckerConfig{ResponderURL: "http://127.0.0.1:1", Timeout: time.Second, FailOpen: true})
+	if err := open.Check(good, ca.cert); err != nil {
+		t.Fatalf("expected fail-open checker to accept, got %v", err)
+	}
+	// Without an override, the certificate must name a responder.
+	if err := NewOCSPChecker(OCSPCheckerConfig{}).Check(good, ca.cert); err == nil {
+		t.Fatal("expected error for certificate without OCSP responder")
+	}
+}
@@ -0,0 +1,407 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pinterest/knox"
+)
+
+// SessionProviderName is the name of the SessionTokenProvider.
+const SessionProviderName = "session"
+
+// sessionIssuer is the "iss" claim of Knox session tokens.
+const sessionIssuer = "knox"
+
+// defaultSessionTTL is how long session tokens are valid by default.
+const defaultSessionTTL = time.Hour
+
+// SessionSigningKey is a key that signs or verifies session tokens. Key may
+// be an ECDSA (P-256 or P-384), RSA or Ed25519 private key.
+type SessionSigningKey struct {
+	ID  string
+	Key crypto.Signer
+}
+
+// SessionRevocationStore records revoked session token IDs until the tokens
+// would have expired anyway.
+type SessionRevocationStore interface {
+	Revoke(id string, expiry time.Time) error
+	IsRevoked(id string) (bool, error)
+}
+
+// NewTempSessionRevocationStore creates an in memory SessionRevocationStore.
+// Like keydb.TempDB it does no replication across servers and is meant for
+// tests and single-server deployments.
+func NewTempSessionRevocationStore() SessionRevocationStore {
+	return &tempSessionRevocationStore{revoked: map[string]time.Time{}, time: time.Now}
+}
+
+type tempSessionRevocationStore struct {
+	sync.Mutex
+	revoked map[string]time.Time
+	time    func() time.Time
+}
+
+func (s *tempSessionRevocationStore) Revoke(id string, expiry time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	now := s.time()
+	for k, exp := range s.revoked {
+		if now.After(exp) {
+			delete(s.revoked, k)
+		}
+	}
+	s.revoked[id] = expiry
+	return nil
+}
+
+func (s *tempSessionRevocationStore) IsRevoked(id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.revoked[id]
+	return ok, nil
+}
+
+// SessionTokenConfig configures SessionTokens.
+type SessionTokenConfig struct {
+	// Keys sign and verify tokens. The first key signs new tokens; all of them
+	// verify, so a new key can be rolled out before it starts signing and an
+	// old one kept until its tokens expire. Required.
+	Keys []SessionSigningKey
+
+	// Revocations records revoked tokens. Required.
+	Revocations SessionRevocationStore
+
+	// TTL is how long tokens are valid. Defaults to one hour.
+	TTL time.Duration
+
+	// APIKeys holds the API keys that sessions may be issued for. Every
+	// session carrying an API key is checked against it, so that revoking
+	// or expiring the key also ends its sessions. If nil, no sessions are
+	// issued for API keys.
+	APIKeys APIKeyStore
+}
+
+// SessionTokens issues and verifies short-lived, signed Knox session tokens
+// that carry the principals resolved when the token was issued, so later
+// requests skip the original providers.
+type SessionTokens struct {
+	revocations SessionRevocationStore
+	apiKeys     APIKeyStore
+	ttl         time.Duration
+	time        func() time.Time
+
+	mu     sync.RWMutex
+	signer jose.Signer
+	verify map[string]jose.JSONWebKey
+}
+
+// NewSessionTokens builds SessionTokens from the given configuration.
+func NewSessionTokens(cfg SessionTokenConfig) (*SessionTokens, error) {
+	if cfg.Revocations == nil {
+		return nil, fmt.Errorf("session tokens require a revocation store")
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	s := &SessionTokens{revocations: cfg.Revocations, apiKeys: cfg.APIKeys, ttl: ttl, time: time.Now}
+	if err := s.SetKeys(cfg.Keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetKeys replaces the signing and verification keys, for rotation. The
+// first key signs new tokens.
+func (s *SessionTokens) SetKeys(keys []SessionSigningKey) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("session tokens require at least one signing key")
+	}
+	verify := map[string]jose.JSONWebKey{}
+	for _, k := range keys {
+		if k.ID == "" || k.Key == nil {
+			return fmt.Errorf("session signing keys require an ID and a key")
+		}
+		if _, ok := verify[k.ID]; ok {
+			return fmt.Errorf("duplicate session signing key ID %s", k.ID)
+		}
+		if _, err := sessionAlgorithm(k.Key); err != nil {
+			return fmt.Errorf("session signing key %s: %v", k.ID, err)
+		}
+		verify[k.ID] = jose.JSONWebKey{Key: k.Key.Public(), KeyID: k.ID}
+	}
+	alg, _ := sessionAlgorithm(keys[0].Key)
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: keys[0].Key, KeyID: keys[0].ID}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signer = signer
+	s.verify = verify
+	return nil
+}
+
+func sessionAlgorithm(k crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch pub := k.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve")
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", k.Public())
+}
+
+func (s *SessionTokens) keysFor(kid string) ([]jose.JSONWebKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown session signing key %q", kid)
+	}
+	return []jose.JSONWebKey{k}, nil
+}
+
+// sessionPrincipal is one principal carried in a session token.
+type sessionPrincipal struct {
+	Provider string   `json:"provider,omitempty"`
+	Type     string   `json:"type"`
+	ID       string   `json:"id"`
+	Groups   []string `json:"groups,omitempty"`
+	Team     string   `json:"team,omitempty"`
+}
+
+// sessionClaims are the Knox claims of a session token. The first principal
+// is the default.
+type sessionClaims struct {
+	Principals []sessionPrincipal `json:"knox_principals"`
+}
+
+func encodeSessionPrincipal(provider string, p knox.Principal) (sessionPrincipal, error) {
+	switch v := p.(type) {
+	case user:
+		groups := make([]string, 0, len(v.groups))
+		for g := range v.groups {
+			groups = append(groups, g)
+		}
+		return sessionPrincipal{Provider: provider, Type: v.Type(), ID: v.ID, Groups: groups}, nil
+	case machine, service:
+		return sessionPrincipal{Provider: provider, Type: v.Type(), ID: v.GetID()}, nil
+	case apiKey:
+		return sessionPrincipal{Provider: provider, Type: v.Type(), ID: v.id, Team: v.team}, nil
+	}
+	return sessionPrincipal{}, fmt.Errorf("principal %s of type %s cannot be carried in a session", p.GetID(), p.Type())
+}
+
+func encodeSessionPrincipals(p knox.Principal) ([]sessionPrincipal, error) {
+	mux, ok := p.(knox.PrincipalMux)
+	if !ok {
+		sp, err := encodeSessionPrincipal("", p)
+		return []sessionPrincipal{sp}, err
+	}
+	def := mux.Default()
+	var first *sessionPrincipal
+	rest := []sessionPrincipal{}
+	for provider, sub := range mux.PrincipalsByProvider() {
+		sp, err := encodeSessionPrincipal(provider, sub)
+		if err != nil {
+			return nil, err
+		}
+		// Principals need not be comparable, so the default is found by identity.
+		if first == nil && sub.GetID() == def.GetID() && sub.Type() == def.Type() {
+			first = &sp
+			continue
+		}
+		rest = append(rest, sp)
+	}
+	if first == nil {
+		return nil, fmt.Errorf("default principal is not among the muxed principals")
+	}
+	return append([]sessionPrincipal{*first}, rest...), nil
+}
+
+func (s *SessionTokens) decodeSessionPrincipal(sp sessionPrincipal) (knox.Principal, error) {
+	switch sp.Type {
+	case "user":
+		return NewUser(sp.ID, sp.Groups), nil
+	case "machine":
+		return NewMachine(sp.ID), nil
+	case "service":
+		return NewServiceFromSpiffeID(sp.ID)
+	case "apikey":
+		return s.currentAPIKey(sp.ID)
+	}
+	return nil, fmt.Errorf("unknown session principal type %q", sp.Type)
+}
+
+// currentAPIKey looks up an API key carried in a session, so that sessions
+// end with the key they were issued for.
+func (s *SessionTokens) currentAPIKey(id string) (knox.Principal, error) {
+	if s.apiKeys == nil {
+		return nil, fmt.Errorf("auth: session carries an API key, but no API key store is configured")
+	}
+	record, err := s.apiKeys.Get(id)
+	if err != nil {
+		if err == ErrAPIKeyNotFound {
+			return nil, fmt.Errorf("auth: session carries an unknown or revoked API key")
+		}
+		return nil, err
+	}
+	if record.Expiry != 0 && s.time().UnixNano() >= record.Expiry {
+		return nil, fmt.Errorf("auth: session carries expired API key %s", record.Name)
+	}
+	return NewAPIKey(record.ID, record.Team), nil
+}
+
+// Issue signs a session token for principal, keeping the provider names of
+// a PrincipalMux.
+func (s *SessionTokens) Issue(principal knox.Principal) (*knox.SessionToken, error) {
+	if s.apiKeys == nil && IsAPIKey(principal) {
+		return nil, fmt.Errorf("sessions for API keys require an API key store")
+	}
+	principals, err := encodeSessionPrincipals(principal)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := s.time()
+	expiry := now.Add(s.ttl)
+	claims := jwt.Claims{
+		ID:        hex.EncodeToString(id),
+		Issuer:    sessionIssuer,
+		Subject:   principal.GetID(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(expiry),
+	}
+	s.mu.RLock()
+	signer := s.signer
+	s.mu.RUnlock()
+	token, err := jwt.Signed(signer).Claims(claims).Claims(sessionClaims{Principals: principals}).Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return &knox.SessionToken{ID: claims.ID, Token: token, Expiry: expiry.UnixNano()}, nil
+}
+
+// Revoke stops the session token with the given ID from authenticating.
+func (s *SessionTokens) Revoke(id string) error {
+	if id == "" {
+		return fmt.Errorf("session token ID is required")
+	}
+	// No token with this ID outlives the TTL, so the record can go after it.
+	return s.revocations.Revoke(id, s.time().Add(s.ttl))
+}
+
+// ErrSessionRevoked is returned when a revoked session token is presented.
+var ErrSessionRevoked = errors.New("auth: session token has been revoked")
+
+// verifyToken checks token and returns the principals it carries.
+func (s *SessionTokens) verifyToken(token string) (knox.Principal, error) {
+	custom := sessionClaims{}
+	claims, err := verifyJWT(token, s, &custom)
+	if err != nil {
+		return nil, err
+	}
+	// Session tokens are minted here, so no clock skew is allowed for.
+	if err := validateJWTClaims(claims, sessionIssuer, "", s.time(), 0); err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("auth: session token has no ID")
+	}
+	revoked, err := s.revocations.IsRevoked(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrSessionRevoked
+	}
+	if len(custom.Principals) == 0 {
+		return nil, fmt.Errorf("auth: session token carries no principals")
+	}
+
+	first, err := s.decodeSessionPrincipal(custom.Principals[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(custom.Principals) == 1 && custom.Principals[0].Provider == "" {
+		return first, nil
+	}
+	all := map[string]knox.Principal{}
+	for i, sp := range custom.Principals {
+		p := first
+		if i > 0 {
+			if p, err = s.decodeSessionPrincipal(sp); err != nil {
+				return nil, err
+			}
+		}
+		all[sp.Provider] = p
+	}
+	return knox.NewPrincipalMux(first, all), nil
+}
+
+// SessionTokenProvider authenticates requests by Knox session tokens,
+// verifying them locally.
+type SessionTokenProvider struct {
+	tokens *SessionTokens
+}
+
+// NewSessionTokenProvider verifies tokens issued by tokens.
+func NewSessionTokenProvider(tokens *SessionTokens) *SessionTokenProvider {
+	return &SessionTokenProvider{tokens: tokens}
+}
+
+// Version is set to 0 for SessionTokenProvider
+func (p *SessionTokenProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *SessionTokenProvider) Name() string {
+	return SessionProviderName
+}
+
+// Type is set to x for SessionTokenProvider
+func (p *SessionTokenProvider) Type() byte {
+	return 'x'
+}
+
+// Schemes is set to Knox-Session for SessionTokenProvider
+func (p *SessionTokenProvider) Schemes() []string {
+	return []string{knox.SessionScheme}
+}
+
+// Authenticate verifies the session token's signature, expiry and revocation
+// status and returns the principals it carries. Principals that came from a
+// PrincipalMux are returned as one, keyed by their original providers.
+func (p *SessionTokenProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	return p.tokens.verifyToken(token)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func newSessionKey(t *testing.T, id string) SessionSigningKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SessionSigningKey{ID: id, Key: k}
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	tokens, err := NewSessionTokens(SessionTokenConfig{
+		Keys:        []SessionSigningKey{newSessionKey(t, "k1")},
+		Revocations: NewTempSessionRevocationStore(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewSessionTokenProvider(tokens)
+
+	u := NewUser("alice", []string{"admins", "eng"})
+	mux := knox.NewPrincipalMux(u, map[string]knox.Principal{
+		"github": u,
+		"mtls":   NewMachine("laptop01"),
+	})
+	session, err := tokens.Issue(mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := p.Authenticate(session.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := principal.(knox.PrincipalMux)
+	if !ok {
+		t.Fatalf("expected a PrincipalMux, got %T", principal)
+	}
+	if got.Default().GetID() != "alice" || !IsUser(got) || !IsMachine(got) {
+		t.Fatalf("unexpected principals %v", got.Raw())
+	}
+	byProvider := got.PrincipalsByProvider()
+	if byProvider["mtls"].GetID() != "laptop01" || byProvider["github"].GetID() != "alice" {
+		t.Fatalf("unexpected providers %v", byProvider)
+	}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "eng", AccessType: knox.Write}}
+	if !got.CanAccess(acl, knox.Write) {
+		t.Fatal("expected groups to be preserved")
+	}
+
+	// A principal that did not come from a mux is returned as is.
+	session, err = tokens.Issue(NewService("example.com", "serviceA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err = p.Authenticate(session.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsService(principal) || principal.GetID() != "spiffe://example.com/serviceA" {
+		t.Fatalf("unexpected principal %v", principal.Raw())
+	}
+}
+
+func TestSessionTokenRejections(t *testing.T) {
+	now := time.Now()
+	tokens, err := NewSessionTokens(SessionTokenConfig{
+		Keys:        []SessionSigningKey{newSessionKey(t, "k1")},
+		Revocations: NewTempSessionRevocationStore(),
+		TTL:         time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens.time = func() time.Time { return now }
+	p := NewSessionTokenProvider(tokens)
+
+	session, err := tokens.Issue(NewUser("alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate(session.Token, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(session.Token, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+	if _, err := p.Authenticate(tampered, nil); err == nil {
+		t.Fatal("expected tampered token to be rejected")
+	}
+
+	tokens.time = func() time.Time { return now.Add(2 * time.Minute) }
+	if _, err := p.Authenticate(session.Token, nil); err == nil {
+		t.Fatal("expected expired token to be rejected")
+	}
+	tokens.time = func() time.Time { return now }
+
+	if err := tokens.Revoke(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate(session.Token, nil); err != ErrSessionRevoked {
+		t.Fatalf("expected revoked token to be rejected, got %v", err)
+	}
+}
+
+func TestSessionTokenAPIKeys(t *testing.T) {
+	now := time.Now()
+	store := NewTempAPIKeyStore()
+	record, _, err := NewAPIKeyRecord(knox.APIKeyInfo{Name: "ci", Team: "eng", Expiry: now.Add(time.Hour).UnixNano()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(record); err != nil {
+		t.Fatal(err)
+	}
+	key := NewAPIKey(record.ID, "eng")
+
+	withoutStore, err := NewSessionTokens(SessionTokenConfig{
+		Keys:        []SessionSigningKey{newSessionKey(t, "k1")},
+		Revocations: NewTempSessionRevocationStore(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withoutStore.Issue(key); err == nil {
+		t.Fatal("expected sessions for API keys to require a store")
+	}
+
+	tokens, err := NewSessionTokens(SessionTokenConfig{
+		Keys:        []SessionSigningKey{newSessionKey(t, "k1")},
+		Revocations: NewTempSessionRevocationStore(),
+		TTL:         2 * time.Hour,
+		APIKeys:     store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens.time = func() time.Time { return now }
+	p := NewSessionTokenProvider(tokens)
+	session, err := tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := p.Authenticate(session.Token, nil); err != nil || !IsAPIKey(principal) {
+		t.Fatalf("expected the API key, got %v %v", principal, err)
+	}
+
+	// The session ends with the key, although the token has not expired.
+	tokens.time = func() time.Time { return now.Add(90 * time.Minute) }
+	if _, err := p.Authenticate(session.Token, nil); err == nil {
+		t.Fatal("expected a session for an expired API key to be rejected")
+	}
+	tokens.time = func() time.Time { return now }
+
+	if err := store.Remove(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate(session.Token, nil); err == nil {
+		t.Fatal("expected a session for a revoked API key to be rejected")
+	}
+}
+
+func TestSessionTokenKeyRotation(t *testing.T) {
+	oldKey, newKey := newSessionKey(t, "old"), newSessionKey(t, "new")
+	tokens, err := NewSessionTokens(SessionTokenConfig{
+		Keys:        []SessionSigningKey{oldKey},
+		Revocations: NewTempSessionRevocationStore(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewSessionTokenProvider(tokens)
+	oldSession, err := tokens.Issue(NewUser("alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key signs while the old one still verifies.
+	if err := tokens.SetKeys([]SessionSigningKey{newKey, oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	newSession, err := tokens.Issue(NewUser("alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*knox.SessionToken{oldSession, newSession} {
+		if _, err := p.Authenticate(s.Token, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tokens.SetKeys([]SessionSigningKey{newKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate(oldSession.Token, nil); err == nil {
+		t.Fatal("expected token signed by a retired key to be rejected")
+	}
+	if _, err := p.Authenticate(newSession.Token, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tokens.SetKeys(nil); err == nil {
+		t.Fatal("expected an empty key set to be rejected")
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"gopkg.in/fsnotify.v1"
+)
+
+// spiffeBundle is the SPIFFE trust bundle format: a JWKS whose X.509
+// authorities have use "x509-svid" and carry the CA certificate in x5c.
+type spiffeBundle struct {
+	Keys []json.RawMessage `json:"keys"`
+}
+
+// parseSpiffeBundle returns a pool of the X.509 authorities in a SPIFFE bundle.
+func parseSpiffeBundle(b []byte) (*x509.CertPool, error) {
+	bundle := spiffeBundle{}
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	n := 0
+	for _, raw := range bundle.Keys {
+		var use struct {
+			Use string `json:"use"`
+		}
+		if err := json.Unmarshal(raw, &use); err != nil {
+			return nil, err
+		}
+		if use.Use != "x509-svid" {
+			continue
+		}
+		key := jose.JSONWebKey{}
+		if err := key.UnmarshalJSON(raw); err != nil {
+			return nil, err
+		}
+		if len(key.Certificates) != 1 {
+			return nil, fmt.Errorf("x509-svid authority must have exactly one certificate")
+		}
+		pool.AddCert(key.Certificates[0])
+		n++
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("bundle has no X.509 authorities")
+	}
+	return pool, nil
+}
+
+// SpiffeBundleSet holds the X.509 CA bundle of each trusted SPIFFE trust
+// domain, loaded from files in the SPIFFE bundle format.
+type SpiffeBundleSet struct {
+	files map[string]string
+
+	mu    sync.RWMutex
+	pools map[string]*x509.CertPool
+}
+
+// NewSpiffeBundleSet loads the bundles in files, which maps each trust
+// domain, such as "example.com", to the path of its bundle.
+func NewSpiffeBundleSet(files map[string]string) (*SpiffeBundleSet, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("at least one trust domain bundle is required")
+	}
+	s := &SpiffeBundleSet{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload rereads every bundle. If any bundle fails to load, the previously
+// loaded bundles are all kept.
+func (s *SpiffeBundleSet) Reload() error {
+	pools := map[string]*x509.CertPool{}
+	for td, path := range s.files {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("trust domain %s: %v", td, err)
+		}
+		pool, err := parseSpiffeBundle(b)
+		if err != nil {
+			return fmt.Errorf("trust domain %s: %v", td, err)
+		}
+		pools[td] = pool
+	}
+	s.mu.Lock()
+	s.pools = pools
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the bundles whenever one of their files changes, until the
+// returned watcher is closed. Directories are watched rather than files so
+// that bundles replaced by rename are picked up.
+func (s *SpiffeBundleSet) Watch() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, path := range s.files {
+		path = filepath.Clean(path)
+		names[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !names[filepath.Clean(event.Name)] {
+					continue
+				}
+				if err := s.Reload(); err != nil {
+					log.Printf("could not reload SPIFFE bundles: %v", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("SPIFFE bundle watcher error: %v", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// pool returns the CA bundle of trust domain td, or nil if it is not trusted.
+func (s *SpiffeBundleSet) pool(td string) *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pools[td]
+}
+
+// NewFederatedSpiffeAuthProvider builds a SpiffeProvider that verifies each
+// client certificate against the bundle of the trust domain in its SPIFFE
+// ID, so a CA trusted for one domain cannot issue identities in another.
+func NewFederatedSpiffeAuthProvider(bundles *SpiffeBundleSet) *SpiffeProvider {
+	return &SpiffeProvider{
+		bundles: bundles,
+		time:    time.Now,
+	}
+}
+
+// authenticateFederated verifies the peer certificate against the bundle of
+// the trust domain it claims.
+func (p *SpiffeProvider) authenticateFederated(r *http.Request) (knox.Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("auth: no peer certs configured")
+	}
+	// The claimed identity selects the bundle, so it is read before the chain
+	// is verified. Verification against that bundle alone binds the two.
+	spiffeURIs, err := GetURINamesFromExtensions(&r.TLS.PeerCertificates[0].Extensions)
+	if err != nil {
+		return nil, err
+	}
+	principal, err := spiffeToPrincipal(spiffeURIs)
+	if err != nil {
+		return nil, err
+	}
+	td, err := spiffeTrustDomain(spiffeURIs[0])
+	if err != nil {
+		return nil, err
+	}
+	pool := p.bundles.pool(td)
+	if pool == nil {
+		return nil, fmt.Errorf("auth: trust domain %s is not trusted", td)
+	}
+	if _, err := verifyCertificate(r, pool, p.time, p.revocation); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert: cert, key: key}
+}
+
+// issue creates a client certificate for spiffeID signed by the CA.
+func (ca testCA) issue(t *testing.T, spiffeID string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(spiffeID)
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{u},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func writeSpiffeBundle(t *testing.T, path string, cas ...testCA) {
+	bundle := jose.JSONWebKeySet{}
+	for _, ca := range cas {
+		bundle.Keys = append(bundle.Keys, jose.JSONWebKey{
+			Key:          ca.cert.PublicKey,
+			Certificates: []*x509.Certificate{ca.cert},
+			Use:          "x509-svid",
+		})
+	}
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write and rename, as bundle distribution tools do.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tlsRequest(certs ...*x509.Certificate) *http.Request {
+	return &http.Request{TLS: &tls.ConnectionState{PeerCertificates: certs}}
+}
+
+func TestFederatedSpiffeProvider(t *testing.T) {
+	dir := t.TempDir()
+	exampleCA, otherCA := newTestCA(t, "example"), newTestCA(t, "other")
+	examplePath, otherPath := filepath.Join(dir, "example.com.json"), filepath.Join(dir, "other.org.json")
+	writeSpiffeBundle(t, examplePath, exampleCA)
+	writeSpiffeBundle(t, otherPath, otherCA)
+
+	bundles, err := NewSpiffeBundleSet(map[string]string{"example.com": examplePath, "other.org": otherPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewFederatedSpiffeAuthProvider(bundles)
+
+	for _, c := range []struct {
+		ca testCA
+		id string
+	}{{exampleCA, "spiffe://example.com/app"}, {otherCA, "spiffe://other.org/app"}} {
+		principal, err := p.Authenticate("", tlsRequest(c.ca.issue(t, c.id)))
+		if err != nil {
+			t.Fatalf("%s: %v", c.id, err)
+		}
+		if principal.GetID() != c.id || !IsService(principal) {
+			t.Fatalf("unexpected principal %v", principal)
+		}
+	}
+
+	// A CA trusted for one domain cannot vouch for another.
+	if _, err := p.Authenticate("", tlsRequest(otherCA.issue(t, "spiffe://example.com/app"))); err == nil {
+		t.Fatal("expected cross-domain certificate to be rejected")
+	}
+	if _, err := p.Authenticate("", tlsRequest(exampleCA.issue(t, "spiffe://evil.com/app"))); err == nil {
+		t.Fatal("expected untrusted trust domain to be rejected")
+	}
+	if _, err := p.Authenticate("", tlsRequest()); err == nil {
+		t.Fatal("expected error without certificates")
+	}
+
+	// Rotating the example.com CA takes effect on reload; a broken bundle
+	// leaves the current ones in place.
+	rotatedCA := newTestCA(t, "example-rotated")
+	writeSpiffeBundle(t, examplePath, rotatedCA)
+	if err := bundles.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate("", tlsRequest(rotatedCA.issue(t, "spiffe://example.com/app"))); err != nil {
+		t.Fatalf("expected rotated CA to be trusted, got %v", err)
+	}
+	if _, err := p.Authenticate("", tlsRequest(exampleCA.issue(t, "spiffe://example.com/app"))); err == nil {
+		t.Fatal("expected old CA to be dropped")
+	}
+	os.WriteFile(examplePath, []byte(`{"keys": []}`), 0600)
+	if err := bundles.Reload(); err == nil {
+		t.Fatal("expected error for bundle without authorities")
+	}
+	if _, err := p.Authenticate("", tlsRequest(rotatedCA.issue(t, "spiffe://example.com/app"))); err != nil {
+		t.Fatalf("expected previous bundles to be kept, got %v", err)
+	}
+}
+
+func TestSpiffeBundleSetWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.com.json")
+	writeSpiffeBundle(t, path, newTestCA(t, "example"))
+	bundles, err := NewSpiffeBundleSet(map[string]string{"example.com": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := bundles.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	p := NewFederatedSpiffeAuthProvider(bundles)
+	rotatedCA := newTestCA(t, "example-rotated")
+	writeSpiffeBundle(t, path, rotatedCA)
+	r := tlsRequest(rotatedCA.issue(t, "spiffe://example.com/app"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := p.Authenticate("", r); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bundle change was not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseSpiffeBundle(t *testing.T) {
+	if _, err := parseSpiffeBundle([]byte(`not json`)); err == nil {
+		t.Error("expected error for malformed bundle")
+	}
+	// JWT authorities alone do not make an X.509 bundle.
+	b := jwksJSON(t, newECSigningKey(t, "k1"))
+	if _, err := parseSpiffeBundle(b); err == nil {
+		t.Error("expected error for bundle without X.509 authorities")
+	}
+	if _, err := NewSpiffeBundleSet(nil); err == nil {
+		t.Error("expected error for no bundles")
+	}
+}
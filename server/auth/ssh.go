@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultSSHClockSkew is how far a token's timestamp may be from the server's
+// clock, and so how long the nonce of an accepted token is remembered.
+const defaultSSHClockSkew = time.Minute
+
+// maxSSHNonceLength bounds the nonce a client may choose.
+const maxSSHNonceLength = 64
+
+// maxSSHBodySize bounds the request bodies read to verify SSH authentication
+// tokens, matching the limit that http.Request.ParseForm applies.
+const maxSSHBodySize = 10 << 20
+
+// SSHCertProviderConfig configures an SSHCertProvider.
+type SSHCertProviderConfig struct {
+	// CAKeys are the certificate authorities trusted to sign user certificates.
+	CAKeys []ssh.PublicKey
+
+	// Audience is the name clients sign tokens for, normally the Knox host
+	// name, so that tokens made for other services are not accepted.
+	Audience string
+
+	// MaxClockSkew bounds the difference between a token's timestamp and the
+	// server's clock. Defaults to one minute.
+	MaxClockSkew time.Duration
+
+	// UseKeyID takes the user ID from the certificate's key ID instead of its
+	// first principal.
+	UseKeyID bool
+
+	// GroupPrincipalPrefix, if set, marks certificate principals that name
+	// groups, such as "group:". They become groups without the prefix and are
+	// never taken as the user ID.
+	GroupPrincipalPrefix string
+
+	// GroupsExtension, if set, names a certificate extension holding a comma
+	// separated list of groups.
+	GroupsExtension string
+
+	// SupportedCriticalOptions lists the critical options that may be ignored.
+	// Certificates with any other critical option, including source-address,
+	// are rejected.
+	SupportedCriticalOptions []string
+
+	// IsRevoked, if set, reports whether a certificate has been revoked.
+	IsRevoked func(cert *ssh.Certificate) bool
+}
+
+// ParseSSHCAKeys parses CA public keys in authorized_keys format, one per line.
+func ParseSSHCAKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no SSH CA keys found")
+	}
+	return keys, nil
+}
+
+// SSHCertProvider authenticates users by a signature made with the key of an
+// SSH user certificate issued by a trusted CA. See knox.NewSSHCertAuthToken
+// for the token format.
+//
+// Each token signs the method, URI and body of its request, so it cannot be
+// used for any other request. Each token is also accepted once: the nonces of
+// accepted tokens are remembered until their timestamps fall outside
+// MaxClockSkew. The record is held in memory, so a token captured in transit
+// can be replayed, for the same request only, once against each other server
+// behind the same audience.
+type SSHCertProvider struct {
+	cfg     SSHCertProviderConfig
+	checker *ssh.CertChecker
+	time    func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewSSHCertProvider builds an SSHCertProvider from the given configuration.
+func NewSSHCertProvider(cfg SSHCertProviderConfig) (*SSHCertProvider, error) {
+	if len(cfg.CAKeys) == 0 {
+		return nil, fmt.Errorf("SSH certificate provider requires at least one CA key")
+	}
+	if cfg.Audience == "" {
+		return nil, fmt.Errorf("SSH certificate provider requires an audience")
+	}
+	if cfg.MaxClockSkew <= 0 {
+		cfg.MaxClockSkew = defaultSSHClockSkew
+	}
+	p := &SSHCertProvider{cfg: cfg, time: time.Now, seen: map[string]time.Time{}}
+	p.checker = &ssh.CertChecker{
+		SupportedCriticalOptions: cfg.SupportedCriticalOptions,
+		IsRevoked:                cfg.IsRevoked,
+		Clock:                    func() time.Time { return p.time() },
+	}
+	return p, nil
+}
+
+// Version is set to 0 for SSHCertProvider
+func (p *SSHCertProvider) Version() byte {
+	return '0'
+}
+
+// Name is the name of the provider for logging
+func (p *SSHCertProvider) Name() string {
+	return "ssh"
+}
+
+// Type is set to h for SSHCertProvider
+func (p *SSHCertProvider) Type() byte {
+	return 'h'
+}
+
+// Schemes is set to Knox-SSH for SSHCertProvider
+func (p *SSHCertProvider) Schemes() []string {
+	return []string{knox.SSHScheme}
+}
+
+// Authenticate verifies the certificate and the signature over the token's
+// timestamp and nonce and over the request, refuses tokens it has already
+// accepted, and returns the certificate's user. The request body is read and
+// replaced with a copy.
+func (p *SSHCertProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	if r == nil {
+		return nil, fmt.Errorf("SSH authentication requires the request")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed SSH authentication token")
+	}
+	cert, err := parseSSHCert(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH authentication timestamp")
+	}
+	skew := p.time().Sub(time.Unix(timestamp, 0))
+	if skew > p.cfg.MaxClockSkew || skew < -p.cfg.MaxClockSkew {
+		return nil, fmt.Errorf("SSH authentication token is stale")
+	}
+	nonce := parts[2]
+	if nonce == "" || len(nonce) > maxSSHNonceLength {
+		return nil, fmt.Errorf("malformed SSH authentication nonce")
+	}
+	sig, err := parseSSHSignature(parts[3])
+	if err != nil {
+		return nil, err
+	}
+
+	id, groups := p.identity(cert)
+	if id == "" {
+		return nil, fmt.Errorf("SSH certificate names no user")
+	}
+	if err := p.checkCert(id, cert); err != nil {
+		return nil, err
+	}
+	digest, err := readBodyDigest(r)
+	if err != nil {
+		return nil, err
+	}
+	msg := knox.SSHAuthMessage(p.cfg.Audience, timestamp, nonce, r.Method, r.URL.RequestURI(), digest)
+	if err := cert.Key.Verify(msg, sig); err != nil {
+		return nil, fmt.Errorf("SSH authentication signature does not verify")
+	}
+	if !p.markSeen(ssh.FingerprintSHA256(cert.Key)+"."+parts[1]+"."+nonce, time.Unix(timestamp, 0).Add(p.cfg.MaxClockSkew)) {
+		return nil, fmt.Errorf("SSH authentication token has already been used")
+	}
+	return NewUser(id, groups), nil
+}
+
+// markSeen records the nonce key until expiry and reports whether it was new.
+// Expired nonces are dropped as new ones are recorded; tokens holding them
+// are refused as stale, so the record stays bounded by the rate of accepted
+// tokens over twice MaxClockSkew.
+func (p *SSHCertProvider) markSeen(key string, expiry time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.time()
+	if until, ok := p.seen[key]; ok && now.Before(until) {
+		return false
+	}
+	for k, until := range p.seen {
+		if !now.Before(until) {
+			delete(p.seen, k)
+		}
+	}
+	p.seen[key] = expiry
+	return true
+}
+
+// checkCert verifies that cert is a valid user certificate from a trusted CA.
+func (p *SSHCertProvider) checkCert(id string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("SSH certificate is not a user certificate")
+	}
+	trusted := false
+	for _, ca := range p.cfg.CAKeys {
+		if bytes.Equal(ca.Marshal(), cert.SignatureKey.Marshal()) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("SSH certificate is not signed by a trusted CA")
+	}
+	// CertChecker leaves source-address to SSH servers, so it is rejected
+	// here unless explicitly ignored.
+	if _, ok := cert.CriticalOptions["source-address"]; ok && !containsString(p.cfg.SupportedCriticalOptions, "source-address") {
+		return fmt.Errorf("unsupported critical option %q in SSH certificate", "source-address")
+	}
+	// With key IDs the user need not be a principal, but the certificate's
+	// principal restriction is still enforced against its first principal.
+	principal := id
+	if p.cfg.UseKeyID && len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	return p.checker.CheckCert(principal, cert)
+}
+
+// identity maps a certificate to a user ID and groups.
+func (p *SSHCertProvider) identity(cert *ssh.Certificate) (string, []string) {
+	var id string
+	var groups []string
+	if p.cfg.UseKeyID {
+		id = cert.KeyId
+	}
+	for _, principal := range cert.ValidPrincipals {
+		if prefix := p.cfg.GroupPrincipalPrefix; prefix != "" && strings.HasPrefix(principal, prefix) {
+			if g := strings.TrimPrefix(principal, prefix); g != "" {
+				groups = append(groups, g)
+			}
+			continue
+		}
+		if id == "" {
+			id = principal
+		}
+	}
+	if p.cfg.GroupsExtension != "" {
+		for _, g := range strings.Split(cert.Extensions[p.cfg.GroupsExtension], ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return id, groups
+}
+
+// readBodyDigest hashes the body of r, replacing it with a copy so that it
+// can still be parsed.
+func readBodyDigest(r *http.Request) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxSSHBodySize+1))
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxSSHBodySize {
+			return nil, fmt.Errorf("request body is too large for SSH authentication")
+		}
+		body = b
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	digest := sha256.Sum256(body)
+	return digest[:], nil
+}
+
+func parseSSHCert(s string) (*ssh.Certificate, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH certificate")
+	}
+	key, err := ssh.ParsePublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH certificate: %v", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("SSH key is not a certificate")
+	}
+	return cert, nil
+}
+
+func parseSSHSignature(s string) (*ssh.Signature, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH signature")
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(b, sig); err != nil {
+		return nil, fmt.Errorf("malformed SSH signature: %v", err)
+	}
+	// SHA-1 RSA signatures are too weak to accept.
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, fmt.Errorf("unsupported SSH signature algorithm %q", sig.Format)
+	}
+	return sig, nil
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newSSHCert(t *testing.T, ca, user ssh.Signer, modify func(*ssh.Certificate)) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             user.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@example.com",
+		ValidPrincipals: []string{"alice", "group:security"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-pty": "", "groups@example.com": "eng, oncall"},
+		},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newSSHRequest builds the request that tokens in these tests authenticate.
+func newSSHRequest(t *testing.T, method, uri, body string) *http.Request {
+	r, err := http.NewRequest(method, "https://knox"+uri, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSSHCertProvider(t *testing.T) {
+	ca, user := newSSHSigner(t), newSSHSigner(t)
+	p, err := NewSSHCertProvider(SSHCertProviderConfig{
+		CAKeys:               []ssh.PublicKey{ca.PublicKey()},
+		Audience:             "knox",
+		GroupPrincipalPrefix: "group:",
+		GroupsExtension:      "groups@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := newSSHCert(t, ca, user, nil)
+	r := newSSHRequest(t, "POST", "/v0/keys/a1/versions/", "data=MQ%3D%3D")
+	token, err := knox.NewSSHCertAuthToken(cert, user, "knox", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := p.Authenticate(token, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.GetID() != "alice" || !IsUser(principal) {
+		t.Fatalf("unexpected principal %v", principal.Raw())
+	}
+	// The body is left for the handler to parse.
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("data") != "MQ==" {
+		t.Fatalf("expected the body to be restored, got %v %v", r.PostForm, err)
+	}
+	if _, err := p.Authenticate(token, newSSHRequest(t, "POST", "/v0/keys/a1/versions/", "data=MQ%3D%3D")); err == nil {
+		t.Fatal("expected a replayed token to be rejected")
+	}
+	for _, g := range []string{"security", "eng", "oncall"} {
+		acl := knox.ACL{{Type: knox.UserGroup, ID: g, AccessType: knox.Read}}
+		if !principal.CanAccess(acl, knox.Read) {
+			t.Errorf("expected user to be in group %s", g)
+		}
+	}
+
+	// Key IDs can name the user instead.
+	p.cfg.UseKeyID = true
+	r = newSSHRequest(t, "GET", "/v0/keys/a1/", "")
+	token, err = knox.NewSSHCertAuthToken(cert, user, "knox", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := p.Authenticate(token, r); err != nil || principal.GetID() != "alice@example.com" {
+		t.Fatalf("unexpected principal %v, %v", principal, err)
+	}
+	p.cfg.UseKeyID = false
+
+	p.time = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := p.Authenticate(token, newSSHRequest(t, "GET", "/v0/keys/a1/", "")); err == nil {
+		t.Fatal("expected stale token to be rejected")
+	}
+	p.time = time.Now
+
+	if _, err := knox.NewSSHCertAuthToken(cert, newSSHSigner(t), "knox", r); err == nil {
+		t.Fatal("expected a signer that does not match the certificate to be refused")
+	}
+}
+
+func TestSSHCertProviderRejections(t *testing.T) {
+	ca, user := newSSHSigner(t), newSSHSigner(t)
+	p, err := NewSSHCertProvider(SSHCertProviderConfig{
+		CAKeys:    []ssh.PublicKey{ca.PublicKey()},
+		Audience:  "knox",
+		IsRevoked: func(cert *ssh.Certificate) bool { return cert.Serial == 13 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() *http.Request {
+		return newSSHRequest(t, "PUT", "/v0/keys/a1/access/", "acl=%5B%5D")
+	}
+	sign := func(cert *ssh.Certificate, audience string) string {
+		token, err := knox.NewSSHCertAuthToken(cert, user, audience, request())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	good := sign(newSSHCert(t, ca, user, nil), "knox")
+	parts := strings.Split(good, ".")
+	ts, _ := strconv.ParseInt(parts[1], 10, 64)
+
+	cases := map[string]string{
+		"untrusted CA":    sign(newSSHCert(t, newSSHSigner(t), user, nil), "knox"),
+		"host cert":       sign(newSSHCert(t, ca, user, func(c *ssh.Certificate) { c.CertType = ssh.HostCert }), "knox"),
+		"expired":         sign(newSSHCert(t, ca, user, func(c *ssh.Certificate) { c.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix()) }), "knox"),
+		"revoked":         sign(newSSHCert(t, ca, user, func(c *ssh.Certificate) { c.Serial = 13 }), "knox"),
+		"no principals":   sign(newSSHCert(t, ca, user, func(c *ssh.Certificate) { c.ValidPrincipals = nil }), "knox"),
+		"source-address":  sign(newSSHCert(t, ca, user, func(c *ssh.Certificate) { c.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"} }), "knox"),
+		"other audience":  sign(newSSHCert(t, ca, user, nil), "other-service"),
+		"changed nonce":   strings.Join([]string{parts[0], parts[1], "0000", parts[3]}, "."),
+		"changed time":    strings.Join([]string{parts[0], strconv.FormatInt(ts+1, 10), parts[2], parts[3]}, "."),
+		"missing section": strings.Join(parts[:3], "."),
+		"garbage":         "not.a.valid.token",
+	}
+	for name, token := range cases {
+		if _, err := p.Authenticate(token, request()); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// Tokens are bound to the request they were signed for.
+	for name, r := range map[string]*http.Request{
+		"other method": newSSHRequest(t, "POST", "/v0/keys/a1/access/", "acl=%5B%5D"),
+		"other path":   newSSHRequest(t, "PUT", "/v0/keys/a2/access/", "acl=%5B%5D"),
+		"other query":  newSSHRequest(t, "PUT", "/v0/keys/a1/access/?x=1", "acl=%5B%5D"),
+		"other body":   newSSHRequest(t, "PUT", "/v0/keys/a1/access/", "acl=%5B1%5D"),
+	} {
+		if _, err := p.Authenticate(good, r); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := p.Authenticate(good, request()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sshTestServer authenticates requests as a Knox server would.
+type sshTestServer struct {
+	t        *testing.T
+	provider *SSHCertProvider
+	user     string
+}
+
+func (s *sshTestServer) Do(r *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), knox.SSHScheme+" ")
+	principal, err := s.provider.Authenticate(token, r)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.user = principal.GetID()
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func TestSSHCertAuthHandler(t *testing.T) {
+	ca, user := newSSHSigner(t), newSSHSigner(t)
+	p, err := NewSSHCertProvider(SSHCertProviderConfig{CAKeys: []ssh.PublicKey{ca.PublicKey()}, Audience: "knox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &sshTestServer{t: t, provider: p}
+	handler := knox.NewSSHCertAuthHandler(newSSHCert(t, ca, user, nil), user, "knox", server)
+
+	authorization, _, client := handler()
+	if authorization == "" || client == nil {
+		t.Fatal("expected the handler to override the client")
+	}
+	r := newSSHRequest(t, "POST", "/v0/keys/", "id=a1&data=MQ%3D%3D")
+	r.Header.Set("Authorization", authorization)
+	if _, err := client.Do(r); err != nil {
+		t.Fatal(err)
+	}
+	if server.user != "alice" {
+		t.Fatalf("expected the request to be signed for alice, got %q", server.user)
+	}
+}
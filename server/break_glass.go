@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// defaultBreakGlassDuration is used when BreakGlassConfig.Duration is unset.
+const defaultBreakGlassDuration = time.Hour
+
+// ErrBreakGlassGrantNotFound is returned by a BreakGlassStore when a user
+// holds no grant on a key.
+var ErrBreakGlassGrantNotFound = fmt.Errorf("Break-glass grant not found")
+
+// BreakGlassStore persists break-glass grants, so that a grant issued by one
+// server is honored by the others.
+//
+// Add replaces any grant the same user holds on the same key. Get may return
+// expired grants, which BreakGlass ignores.
+type BreakGlassStore interface {
+	Add(g knox.BreakGlassGrant) error
+	Get(keyID, userID string) (*knox.BreakGlassGrant, error)
+}
+
+// NewTempBreakGlassStore creates an in memory BreakGlassStore. Like
+// keydb.TempDB it does no replication across servers and is meant for tests
+// and single-server deployments.
+func NewTempBreakGlassStore() BreakGlassStore {
+	return &tempBreakGlassStore{grants: map[string]map[string]knox.BreakGlassGrant{}, time: time.Now}
+}
+
+type tempBreakGlassStore struct {
+	sync.Mutex
+	// grants is indexed by key ID, then by user ID.
+	grants map[string]map[string]knox.BreakGlassGrant
+	time   func() time.Time
+}
+
+func (s *tempBreakGlassStore) Add(g knox.BreakGlassGrant) error {
+	s.Lock()
+	defer s.Unlock()
+	now := s.time().UnixNano()
+	for keyID, users := range s.grants {
+		for userID, existing := range users {
+			if now >= existing.Expiry {
+				delete(users, userID)
+			}
+		}
+		if len(users) == 0 {
+			delete(s.grants, keyID)
+		}
+	}
+	if s.grants[g.KeyID] == nil {
+		s.grants[g.KeyID] = map[string]knox.BreakGlassGrant{}
+	}
+	s.grants[g.KeyID][g.Principal] = g
+	return nil
+}
+
+func (s *tempBreakGlassStore) Get(keyID, userID string) (*knox.BreakGlassGrant, error) {
+	s.Lock()
+	defer s.Unlock()
+	g, ok := s.grants[keyID][userID]
+	if !ok {
+		return nil, ErrBreakGlassGrantNotFound
+	}
+	return &g, nil
+}
+
+// BreakGlassConfig configures emergency access to keys.
+type BreakGlassConfig struct {
+	// Groups lists the user groups whose members may request break-glass access.
+	Groups []string
+
+	// Duration is how long a grant lasts. Defaults to one hour.
+	Duration time.Duration
+
+	// Logger receives a JSON event for every grant and every use of a grant.
+	Logger *log.Logger
+
+	// Store holds grants. Defaults to an in memory store, whose grants are
+	// only honored by the server that issued them.
+	Store BreakGlassStore
+}
+
+// BreakGlass grants short-lived read access to keys for members of designated
+// groups who supply a justification.
+type BreakGlass struct {
+	groups   knox.ACL
+	duration time.Duration
+	logger   *log.Logger
+	store    BreakGlassStore
+	time     func() time.Time
+}
+
+type breakGlassLog struct {
+	Type           string               `json:"type"`
+	Event          string               `json:"event"`
+	ReviewRequired bool                 `json:"review_required"`
+	Grant          knox.BreakGlassGrant `json:"grant"`
+}
+
+// NewBreakGlass builds a BreakGlass from the given configuration.
+func NewBreakGlass(cfg BreakGlassConfig) (*BreakGlass, error) {
+	if len(cfg.Groups) == 0 {
+		return nil, fmt.Errorf("break glass requires at least one group")
+	}
+	if cfg.Logger == nil {
+		return nil, fmt.Errorf("break glass requires a logger")
+	}
+	duration := cfg.Duration
+	if duration <= 0 {
+		duration = defaultBreakGlassDuration
+	}
+	store := cfg.Store
+	if store == nil {
+		store = NewTempBreakGlassStore()
+	}
+	groups := knox.ACL{}
+	for _, g := range cfg.Groups {
+		groups = append(groups, knox.Access{Type: knox.UserGroup, ID: g, AccessType: knox.Read})
+	}
+	return &BreakGlass{
+		groups:   groups,
+		duration: duration,
+		logger:   cfg.Logger,
+		store:    store,
+		time:     time.Now,
+	}, nil
+}
+
+// breakGlass is consulted by authorizeRequest when set. When nil (the
+// default), break-glass access is disabled.
+var breakGlass *BreakGlass
+
+// SetBreakGlass enables break-glass access. Pass nil to disable it.
+func SetBreakGlass(b *BreakGlass) {
+	breakGlass = b
+}
+
+// Grant records a read grant on keyID for every user identity of principal.
+// It fails if the principal is not in one of the configured groups or the
+// justification is blank.
+func (b *BreakGlass) Grant(principal knox.Principal, keyID, justification string) (*knox.BreakGlassGrant, error) {
+	justification = strings.TrimSpace(justification)
+	if justification == "" {
+		return nil, fmt.Errorf("a justification is required for break-glass access")
+	}
+	if !principal.CanAccess(b.groups, knox.Read) {
+		return nil, fmt.Errorf("principal %s is not permitted to use break-glass access", principal.GetID())
+	}
+
+	expiry := b.time().Add(b.duration).UnixNano()
+	var granted *knox.BreakGlassGrant
+	for _, raw := range principal.Raw() {
+		if raw.Type != "user" {
+			continue
+		}
+		g := knox.BreakGlassGrant{
+			KeyID:         keyID,
+			Principal:     raw.ID,
+			Justification: justification,
+			Expiry:        expiry,
+		}
+		if err := b.store.Add(g); err != nil {
+			return nil, err
+		}
+		b.logger.OutputJSON(breakGlassLog{Type: "break_glass", Event: "grant", ReviewRequired: true, Grant: g})
+		granted = &g
+	}
+	if granted == nil {
+		return nil, fmt.Errorf("principal %s has no user identity", principal.GetID())
+	}
+	return granted, nil
+}
+
+// allows reports whether principal holds an unexpired grant on keyID, logging
+// the use if so.
+func (b *BreakGlass) allows(keyID string, principal knox.Principal) bool {
+	return b.check(keyID, principal, true)
+}
+
+// check reports whether principal holds an unexpired grant on keyID. Grants
+// that cannot be read from the store are not honored.
+func (b *BreakGlass) check(keyID string, principal knox.Principal, logUse bool) bool {
+	now := b.time().UnixNano()
+	for _, raw := range principal.Raw() {
+		if raw.Type != "user" {
+			continue
+		}
+		g, err := b.store.Get(keyID, raw.ID)
+		if err != nil {
+			if err != ErrBreakGlassGrantNotFound {
+				log.Printf("failed to read break-glass grant on %s for %s: %v", keyID, raw.ID, err)
+			}
+			continue
+		}
+		if now >= g.Expiry {
+			continue
+		}
+		if logUse {
+			b.logger.OutputJSON(breakGlassLog{Type: "break_glass", Event: "use", ReviewRequired: true, Grant: *g})
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestBreakGlass(t *testing.T) {
+	var buf bytes.Buffer
+	b, err := NewBreakGlass(BreakGlassConfig{
+		Groups:   []string{"security-team"},
+		Duration: time.Minute,
+		Logger:   log.New(&buf, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	b.time = func() time.Time { return now }
+	SetBreakGlass(b)
+	defer SetBreakGlass(nil)
+
+	m, _ := makeDB()
+	owner := auth.NewUser("owner", []string{})
+	if _, err := postKeysHandler(m, owner, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	responder := auth.NewUser("responder", []string{"security-team"})
+	outsider := auth.NewUser("outsider", []string{"eng"})
+
+	if _, err := getKeyHandler(m, responder, map[string]string{"keyID": "a1"}); err == nil {
+		t.Fatal("expected responder to be denied before break glass")
+	}
+
+	_, httpErr := postBreakGlassHandler(m, responder, map[string]string{"keyID": "a1"})
+	if httpErr == nil || httpErr.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("expected missing justification error, got %+v", httpErr)
+	}
+	_, httpErr = postBreakGlassHandler(m, responder, map[string]string{"keyID": "nope", "justification": "INC-1"})
+	if httpErr == nil || httpErr.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("expected missing key error, got %+v", httpErr)
+	}
+	_, httpErr = postBreakGlassHandler(m, outsider, map[string]string{"keyID": "a1", "justification": "INC-1"})
+	if httpErr == nil || httpErr.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected outsider to be rejected, got %+v", httpErr)
+	}
+
+	i, httpErr := postBreakGlassHandler(m, responder, map[string]string{"keyID": "a1", "justification": "INC-1"})
+	if httpErr != nil {
+		t.Fatalf("%+v is not nil", httpErr)
+	}
+	grant := i.(*knox.BreakGlassGrant)
+	if grant.Principal != "responder" || grant.Justification != "INC-1" {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+
+	if _, err := getKeyHandler(m, responder, map[string]string{"keyID": "a1"}); err != nil {
+		t.Fatalf("expected break-glass read to succeed, got %+v", err)
+	}
+	if _, err := postVersionHandler(m, responder, map[string]string{"keyID": "a1", "data": "Mg=="}); err == nil {
+		t.Fatal("break glass must not grant write access")
+	}
+	if _, err := getKeyHandler(m, outsider, map[string]string{"keyID": "a1"}); err == nil {
+		t.Fatal("grant must not extend to other principals")
+	}
+
+	logged := buf.String()
+	if strings.Count(logged, `"review_required":true`) != 2 || !strings.Contains(logged, `"event":"grant"`) || !strings.Contains(logged, `"event":"use"`) {
+		t.Fatalf("expected grant and use to be logged for review, got %s", logged)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := getKeyHandler(m, responder, map[string]string{"keyID": "a1"}); err == nil {
+		t.Fatal("expected grant to expire")
+	}
+}
+
+func TestBreakGlassSharedStore(t *testing.T) {
+	store := NewTempBreakGlassStore()
+	newBreakGlass := func() *BreakGlass {
+		b, err := NewBreakGlass(BreakGlassConfig{
+			Groups: []string{"security-team"},
+			Logger: log.New(&bytes.Buffer{}, "", 0),
+			Store:  store,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first, second := newBreakGlass(), newBreakGlass()
+
+	responder := auth.NewUser("responder", []string{"security-team"})
+	if _, err := first.Grant(responder, "a1", "INC-1"); err != nil {
+		t.Fatal(err)
+	}
+	if !second.allows("a1", responder) {
+		t.Fatal("expected a grant to be honored by every server sharing the store")
+	}
+	if second.allows("a2", responder) {
+		t.Fatal("grant must not extend to other keys")
+	}
+}
+
+func TestTempBreakGlassStorePrunes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewTempBreakGlassStore()
+	store.(*tempBreakGlassStore).time = func() time.Time { return now }
+
+	if err := store.Add(knox.BreakGlassGrant{KeyID: "a1", Principal: "alice", Expiry: now.Add(time.Minute).UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := store.Add(knox.BreakGlassGrant{KeyID: "a2", Principal: "bob", Expiry: now.Add(time.Minute).UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a1", "alice"); err != ErrBreakGlassGrantNotFound {
+		t.Fatalf("expected the expired grant to be pruned, got %v", err)
+	}
+	if _, err := store.Get("a2", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.(*tempBreakGlassStore).grants); n != 1 {
+		t.Fatalf("expected one key with grants, got %d", n)
+	}
+}
+
+func TestNewBreakGlassValidation(t *testing.T) {
+	if _, err := NewBreakGlass(BreakGlassConfig{Logger: log.New(&bytes.Buffer{}, "", 0)}); err == nil {
+		t.Fatal("expected error without groups")
+	}
+	if _, err := NewBreakGlass(BreakGlassConfig{Groups: []string{"g"}}); err == nil {
+		t.Fatal("expected error without logger")
+	}
+}
+
+func TestBreakGlassDisabled(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("responder", []string{"security-team"})
+	_, err := postBreakGlassHandler(m, u, map[string]string{"keyID": "a1", "justification": "INC-1"})
+	if err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented error, got %+v", err)
+	}
+}
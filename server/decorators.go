@@ -1,9 +1,11 @@
 package server
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/gorilla/context"
 	"github.com/pinterest/knox"
@@ -19,6 +21,8 @@ const (
 	paramsContext
 	dbContext
 	idContext
+	realPrincipalContext
+	versionContext
 )
 
 // GetAPIError gets the HTTP error that will be returned from the server.
@@ -91,6 +95,19 @@ func setRouteID(r *http.Request, val string) {
 	context.Set(r, idContext, val)
 }
 
+// getAPIVersion gets the API version of the route being called, which selects
+// the format of error responses.
+func getAPIVersion(r *http.Request) int {
+	if rv := context.Get(r, versionContext); rv != nil {
+		return rv.(int)
+	}
+	return 0
+}
+
+func setAPIVersion(r *http.Request, val int) {
+	context.Set(r, versionContext, val)
+}
+
 // AddHeader adds a HTTP header to the response
 func AddHeader(k, v string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(f http.HandlerFunc) http.HandlerFunc {
@@ -121,7 +138,7 @@ func Logger(logger *log.Logger) func(http.HandlerFunc) http.HandlerFunc {
 			}
 			if apiError != nil {
 				e.Code = apiError.Subcode
-				e.StatusCode = HTTPErrMap[apiError.Subcode].Code
+				e.StatusCode = errStatus(apiError.Subcode, getAPIVersion(r))
 				e.Msg = apiError.Message
 			}
 			logger.OutputJSON(e)
@@ -145,6 +162,8 @@ type request struct {
 	ParsedQuery        map[string]string `json:"parsed_query_string"`
 	Principal          string            `json:"principal"`
 	FallbackPrincipals []string          `json:"fallback_principals"`
+	RealPrincipal      string            `json:"real_principal,omitempty"`
+	RealPrincipals     []string          `json:"real_principals,omitempty"`
 	AuthType           string            `json:"auth_type"`
 	RequestURI         string            `json:"request_uri"`
 	RemoteAddr         string            `json:"remote_addr"`
@@ -160,6 +179,10 @@ func scrub(params map[string]string) map[string]string {
 	if _, ok := params["data"]; ok {
 		params["data"] = "<DATA>"
 	}
+	// JSON request bodies may carry key data among other fields.
+	if _, ok := params["body"]; ok {
+		params["body"] = "<BODY>"
+	}
 	return params
 }
 
@@ -194,6 +217,13 @@ func buildRequest(req *http.Request, p knox.Principal, params map[string]string)
 		r.Principal = ""
 		r.AuthType = ""
 	}
+	// Impersonated requests also record who made them.
+	if real := GetRealPrincipal(req); real != nil {
+		r.RealPrincipal = real.GetID()
+		if mux, ok := real.(knox.PrincipalMux); ok {
+			r.RealPrincipals = mux.GetIDs()
+		}
+	}
 	if req.TLS != nil {
 		r.TLSServer = req.TLS.ServerName
 		r.TLSCipher = req.TLS.CipherSuite
@@ -214,7 +244,7 @@ type ProviderMatcher func(provider auth.Provider, request *http.Request) (provid
 // Authentication sets the principal or returns an error if the principal cannot be authenticated.
 func Authentication(providers []auth.Provider, matcher ProviderMatcher) func(http.HandlerFunc) http.HandlerFunc {
 	if matcher == nil {
-		matcher = providerMatch
+		matcher = SchemeProviderMatch
 	}
 
 	return func(f http.HandlerFunc) http.HandlerFunc {
@@ -223,35 +253,116 @@ func Authentication(providers []auth.Provider, matcher ProviderMatcher) func(htt
 			allPrincipals := map[string]knox.Principal{}
 			errReturned := fmt.Errorf("no matching authentication providers found")
 
+			type match struct {
+				provider auth.Provider
+				payload  string
+			}
+			var matches []match
 			for _, p := range providers {
-				if match, payload := matcher(p, r); match {
-					principal, errAuthenticate := p.Authenticate(payload, r)
-					if errAuthenticate != nil {
-						errReturned = errAuthenticate
-						continue
-					}
+				if ok, payload := matcher(p, r); ok {
+					matches = append(matches, match{p, payload})
+				}
+			}
+
+			// Locked out sources and credentials are refused before any
+			// provider runs, so that guesses are neither checked nor cost
+			// calls to external services. Requests without any credentials
+			// for the providers are not throttled.
+			throttle := authThrottle
+			var source string
+			var credential [sha256.Size]byte
+			if throttle != nil && len(matches) > 0 {
+				source, credential = throttleKeys(r, providers)
+				if d := throttle.blocked(source, credential); d > 0 {
+					w.Header().Set("Retry-After", retryAfter(d))
+					WriteErr(errF(knox.TooManyRequestsCode, "Too many failed authentication attempts, retry later"))(w, r)
+					return
+				}
+			}
+
+			for _, m := range matches {
+				p := m.provider
+				principal, errAuthenticate := p.Authenticate(m.payload, r)
+				if errAuthenticate != nil {
+					errReturned = errAuthenticate
+					continue
+				}
+				// Providers such as session tokens may return several principals.
+				// These are flattened into this mux, named after both providers.
+				if mux, ok := principal.(knox.PrincipalMux); ok {
 					if defaultPrincipal == nil {
-						// First match is considered the default principal to use.
-						defaultPrincipal = principal
+						defaultPrincipal = mux.Default()
+					}
+					for name, sub := range mux.PrincipalsByProvider() {
+						allPrincipals[p.Name()+"/"+name] = sub
 					}
+					continue
+				}
 
-					// We record the name of the provider to be used in logging, so we can record
-					// information about which provider authenticated which principal later on.
-					allPrincipals[p.Name()] = principal
+				if defaultPrincipal == nil {
+					// First match is considered the default principal to use.
+					defaultPrincipal = principal
 				}
+
+				// We record the name of the provider to be used in logging, so we can record
+				// information about which provider authenticated which principal later on.
+				allPrincipals[p.Name()] = principal
 			}
 			if defaultPrincipal == nil {
+				if throttle != nil && len(matches) > 0 {
+					throttle.fail(source, credential)
+				}
 				WriteErr(errF(knox.UnauthenticatedCode, errReturned.Error()))(w, r)
 				return
 			}
+			if throttle != nil {
+				throttle.succeed(credential)
+			}
 
-			SetPrincipal(r, knox.NewPrincipalMux(defaultPrincipal, allPrincipals))
+			principal := knox.NewPrincipalMux(defaultPrincipal, allPrincipals)
+			impersonated, httpErr := impersonate(principal, r)
+			if httpErr != nil {
+				WriteErr(httpErr)(w, r)
+				return
+			}
+			if impersonated != nil {
+				setRealPrincipal(r, principal)
+				principal = knox.NewPrincipalMux(impersonated, map[string]knox.Principal{impersonationProvider: impersonated})
+			}
+
+			SetPrincipal(r, principal)
 			f(w, r)
 			return
 		}
 	}
 }
 
+// SchemeProviderMatch is the default ProviderMatcher. Providers implementing
+// auth.HeaderProvider match requests carrying their header, and providers
+// implementing auth.SchemeProvider match Authorization headers of the form
+// "<scheme> <credentials>". Otherwise the legacy two byte prefix is matched.
+func SchemeProviderMatch(provider auth.Provider, request *http.Request) (providerSupportsRequest bool, payload string) {
+	if hp, ok := provider.(auth.HeaderProvider); ok {
+		if v := request.Header.Get(hp.Header()); v != "" {
+			return true, v
+		}
+	}
+	if sp, ok := provider.(auth.SchemeProvider); ok {
+		scheme, credentials, found := strings.Cut(request.Header.Get("Authorization"), " ")
+		credentials = strings.TrimSpace(credentials)
+		if found && credentials != "" {
+			for _, s := range sp.Schemes() {
+				if strings.EqualFold(scheme, s) {
+					return true, credentials
+				}
+			}
+		}
+	}
+	return providerMatch(provider, request)
+}
+
+// providerMatch matches the Version and Type bytes of provider against the
+// first two bytes of the Authorization header.
 func providerMatch(provider auth.Provider, request *http.Request) (providerSupportsRequest bool, payload string) {
 	authorizationHeaderValue := request.Header.Get("Authorization")
 
@@ -270,17 +381,21 @@ func parseParams(parameters []Parameter) func(http.HandlerFunc) http.HandlerFunc
 					ps[p.Name()] = s
 				}
 			}
+			if ip := clientIP(r); ip != nil {
+				ps[clientIPParameter] = ip.String()
+			}
 			setParams(r, ps)
 			f(w, r)
 		}
 	}
 }
 
-func setupRoute(id string, m KeyManager) func(http.HandlerFunc) http.HandlerFunc {
+func setupRoute(id string, version int, m KeyManager) func(http.HandlerFunc) http.HandlerFunc {
 	return func(f http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			setDB(r, m)
 			setRouteID(r, id)
+			setAPIVersion(r, version)
 			f(w, r)
 		}
 	}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// ServiceDelegation restricts the ACL changes services may make to keys they
+// administer: a service may only grant or revoke Service and ServicePrefix
+// access within its own SPIFFE namespace.
+type ServiceDelegation struct {
+	depth int
+}
+
+// NewServiceDelegation builds a ServiceDelegation. A service's namespace is
+// its trust domain and the first depth segments of its path, so with a depth
+// of 2 the service spiffe://example.com/team/app/worker may delegate within
+// spiffe://example.com/team/app/. A depth of 0 uses all but the last segment.
+func NewServiceDelegation(depth int) (*ServiceDelegation, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("service delegation depth must not be negative")
+	}
+	return &ServiceDelegation{depth: depth}, nil
+}
+
+// serviceDelegation is consulted by putAccessHandler when set. When nil (the
+// default), services administering a key may grant access to anyone.
+var serviceDelegation *ServiceDelegation
+
+// SetServiceDelegation enables delegated grants for services. Pass nil to
+// disable it.
+func SetServiceDelegation(d *ServiceDelegation) {
+	serviceDelegation = d
+}
+
+// namespace returns the SPIFFE prefix that spiffeID may delegate within.
+func (d *ServiceDelegation) namespace(spiffeID string) string {
+	rest := strings.TrimPrefix(spiffeID, "spiffe://")
+	parts := strings.Split(rest, "/")
+	domain, segments := parts[0], parts[1:]
+	n := d.depth
+	if n == 0 || n > len(segments)-1 {
+		n = len(segments) - 1
+	}
+	if n < 1 {
+		// A service directly under the trust domain only delegates to itself
+		// and services beneath it.
+		n = len(segments)
+	}
+	return "spiffe://" + domain + "/" + strings.Join(segments[:n], "/") + "/"
+}
+
+// check rejects changes that principal may not make under delegation. Only
+// principals without a user identity are restricted.
+func (d *ServiceDelegation) check(principal knox.Principal, changes []knox.Access) *HTTPError {
+	if auth.IsUser(principal) || !auth.IsService(principal) {
+		return nil
+	}
+	var namespaces []string
+	for _, raw := range principal.Raw() {
+		if raw.Type == "service" {
+			namespaces = append(namespaces, d.namespace(raw.ID))
+		}
+	}
+	for _, a := range changes {
+		if a.Type != knox.Service && a.Type != knox.ServicePrefix {
+			return errF(knox.UnauthorizedCode, fmt.Sprintf("Service %s may only change service access", principal.GetID()))
+		}
+		inside := false
+		for _, ns := range namespaces {
+			inside = inside || strings.HasPrefix(a.ID, ns)
+		}
+		if !inside {
+			return errF(knox.UnauthorizedCode, fmt.Sprintf("Service %s may not change access for %s outside %s", principal.GetID(), a.ID, strings.Join(namespaces, ", ")))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestServiceDelegationNamespace(t *testing.T) {
+	d, _ := NewServiceDelegation(0)
+	cases := map[string]string{
+		"spiffe://example.com/team/app/worker": "spiffe://example.com/team/app/",
+		"spiffe://example.com/team/app":        "spiffe://example.com/team/",
+		"spiffe://example.com/app":             "spiffe://example.com/app/",
+	}
+	for id, expected := range cases {
+		if ns := d.namespace(id); ns != expected {
+			t.Errorf("%s: expected %s, got %s", id, expected, ns)
+		}
+	}
+	d, _ = NewServiceDelegation(1)
+	if ns := d.namespace("spiffe://example.com/team/app/worker"); ns != "spiffe://example.com/team/" {
+		t.Errorf("unexpected namespace %s", ns)
+	}
+	if _, err := NewServiceDelegation(-1); err == nil {
+		t.Error("expected error for negative depth")
+	}
+}
+
+func TestPutAccessServiceDelegation(t *testing.T) {
+	m, _ := makeDB()
+	svc := auth.NewService("example.com", "team/app/worker")
+	acl := `[{"type":"Service","id":"spiffe://example.com/team/app/worker","access":"Admin"}]`
+	if _, err := postKeysHandler(m, auth.NewUser("alice", nil), map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	d, _ := NewServiceDelegation(0)
+	SetServiceDelegation(d)
+	defer SetServiceDelegation(nil)
+
+	allowed := []string{
+		`{"type":"Service","id":"spiffe://example.com/team/app/api","access":"Read"}`,
+		`{"type":"ServicePrefix","id":"spiffe://example.com/team/app/batch/","access":"Read"}`,
+		`{"type":"Service","id":"spiffe://example.com/team/app/api","access":"None"}`,
+	}
+	for _, access := range allowed {
+		if _, err := putAccessHandler(m, svc, map[string]string{"keyID": "a1", "access": access}); err != nil {
+			t.Fatalf("expected %s to be allowed, got %+v", access, err)
+		}
+	}
+
+	denied := []string{
+		`{"type":"Service","id":"spiffe://example.com/other/app","access":"Read"}`,
+		`{"type":"Service","id":"spiffe://evil.com/team/app/api","access":"Read"}`,
+		`{"type":"ServicePrefix","id":"spiffe://example.com/team/","access":"Read"}`,
+		`{"type":"Machine","id":"web001","access":"Read"}`,
+		`{"type":"User","id":"alice","access":"None"}`,
+	}
+	for _, access := range denied {
+		_, err := putAccessHandler(m, svc, map[string]string{"keyID": "a1", "access": access})
+		if err == nil || err.Subcode != knox.UnauthorizedCode {
+			t.Fatalf("expected %s to be denied, got %+v", access, err)
+		}
+	}
+
+	// Humans administering the key are not restricted.
+	if _, err := putAccessHandler(m, auth.NewUser("alice", nil), map[string]string{"keyID": "a1", "access": denied[3]}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
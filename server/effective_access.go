@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// PrincipalInventory lists principals known to exist (e.g. from a host
+// inventory or service registry), so that prefix ACL entries can be expanded
+// into the concrete principals they match.
+type PrincipalInventory interface {
+	Machines() ([]string, error)
+	Services() ([]string, error)
+}
+
+// principalInventory is used by effective access reports when set.
+var principalInventory PrincipalInventory
+
+// SetPrincipalInventory installs the inventory used to expand prefix entries
+// in effective access reports. Pass nil to disable expansion (the default).
+func SetPrincipalInventory(i PrincipalInventory) {
+	principalInventory = i
+}
+
+var auditGroup string
+
+// SetAuditGroup allows members of the user group to call the routes that
+// report on the ACLs of every key. An empty group (the default) disables them.
+func SetAuditGroup(group string) {
+	auditGroup = group
+}
+
+// authorizeAudit refuses principals outside the audit group.
+func authorizeAudit(principal knox.Principal) *HTTPError {
+	if auditGroup == "" {
+		return errF(knox.NotYetImplementedCode, "Reports across all keys require an audit group")
+	}
+	if !auth.IsUser(principal) || !principal.CanAccess(knox.ACL{{Type: knox.UserGroup, ID: auditGroup, AccessType: knox.Read}}, knox.Read) {
+		return errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not a member of the audit group", principal.GetID()))
+	}
+	return nil
+}
+
+// describeAccess returns a human readable explanation of who an entry matches.
+func describeAccess(a knox.Access) string {
+	who := describePrincipal(a)
+	if a.Networks != "" {
+		return fmt.Sprintf("%s, from %s", who, strings.Join(a.Networks.List(), ", "))
+	}
+	return who
+}
+
+func describePrincipal(a knox.Access) string {
+	switch a.Type {
+	case knox.User:
+		return fmt.Sprintf("user %s", a.ID)
+	case knox.UserGroup:
+		return fmt.Sprintf("members of group %s", a.ID)
+	case knox.Machine:
+		return fmt.Sprintf("machine %s", a.ID)
+	case knox.MachinePrefix:
+		return fmt.Sprintf("machines whose hostname begins with %q", a.ID)
+	case knox.MachinePattern:
+		return fmt.Sprintf("machines whose hostname matches %q", a.ID)
+	case knox.Service:
+		return fmt.Sprintf("service %s", a.ID)
+	case knox.ServicePrefix:
+		return fmt.Sprintf("services under %s", a.ID)
+	case knox.APIKey:
+		return fmt.Sprintf("API key %s", a.ID)
+	default:
+		return fmt.Sprintf("unknown principal type for %s", a.ID)
+	}
+}
+
+func isDefaultAccess(a knox.Access) bool {
+	for _, d := range defaultAccess {
+		if d.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPrefix lists the inventory principals that a prefix entry matches.
+func expandPrefix(a knox.Access) ([]string, error) {
+	if principalInventory == nil {
+		return nil, nil
+	}
+	var ids []string
+	var err error
+	var build func(string) (knox.Principal, error)
+	switch a.Type {
+	case knox.MachinePrefix, knox.MachinePattern:
+		ids, err = principalInventory.Machines()
+		build = func(id string) (knox.Principal, error) { return auth.NewMachine(id), nil }
+	case knox.ServicePrefix:
+		ids, err = principalInventory.Services()
+		build = auth.NewServiceFromSpiffeID
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	for _, id := range ids {
+		p, err := build(id)
+		if err != nil {
+			// Skip malformed inventory entries rather than failing the report.
+			continue
+		}
+		if p.CanAccess(knox.ACL{a}, a.AccessType) {
+			matches = append(matches, id)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// principalFromReportParams builds the principal to evaluate in a what-can
+// report. Groups only apply to users.
+func principalFromReportParams(id, typeStr, groups string) (knox.Principal, *HTTPError) {
+	if id == "" {
+		return nil, errF(knox.BadPrincipalIdentifier, "Missing parameter 'principal'")
+	}
+	var pt knox.PrincipalType
+	pt.UnmarshalJSON([]byte(`"` + typeStr + `"`))
+	switch pt {
+	case knox.User:
+		var gs []string
+		if groups != "" {
+			gs = strings.Split(groups, ",")
+		}
+		return auth.NewUser(id, gs), nil
+	case knox.Machine:
+		return auth.NewMachine(id), nil
+	case knox.Service:
+		p, err := auth.NewServiceFromSpiffeID(id)
+		if err != nil {
+			return nil, errF(knox.BadPrincipalIdentifier, err.Error())
+		}
+		return p, nil
+	default:
+		return nil, errF(knox.BadRequestDataCode, "Parameter 'type' must be one of User, Machine or Service")
+	}
+}
+
+// principalKeyAccess returns the access p has to key through its ACL, along
+// with the entries that grant it, or nil if it has none.
+func principalKeyAccess(key *knox.Key, p knox.Principal) *knox.PrincipalKeyAccess {
+	result := &knox.PrincipalKeyAccess{KeyID: key.ID, AccessType: knox.None, Entries: []knox.Access{}}
+	for _, a := range key.ACL {
+		if p.CanAccess(knox.ACL{a}, a.AccessType) {
+			result.Entries = append(result.Entries, a)
+			if a.AccessType > result.AccessType {
+				result.AccessType = a.AccessType
+			}
+		}
+	}
+	if len(result.Entries) == 0 {
+		return nil
+	}
+	return result
+}
+
+// isMidTokenMatch reports whether prefix matches hostname but ends in the
+// middle of a run of letters or a run of digits, which is usually unintended:
+// "auth" matching "authz01", or "web1" matching "web12".
+func isMidTokenMatch(prefix, hostname string) bool {
+	if prefix == "" || len(hostname) <= len(prefix) || !strings.HasPrefix(hostname, prefix) {
+		return false
+	}
+	last, next := prefix[len(prefix)-1], hostname[len(prefix)]
+	isLetter := func(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	return (isLetter(last) && isLetter(next)) || (isDigit(last) && isDigit(next))
+}
+
+// auditMachinePrefixes finds MachinePrefix entries across all keys that match
+// inventory hosts in the middle of a name.
+func auditMachinePrefixes(m KeyManager) ([]knox.MachinePrefixFinding, error) {
+	hosts, err := principalInventory.Machines()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	keys, err := m.GetAllKeyACLs()
+	if err != nil {
+		return nil, err
+	}
+	findings := []knox.MachinePrefixFinding{}
+	for _, key := range keys {
+		for _, a := range key.ACL {
+			if a.Type != knox.MachinePrefix {
+				continue
+			}
+			unintended := []string{}
+			for _, h := range hosts {
+				if isMidTokenMatch(a.ID, h) {
+					unintended = append(unintended, h)
+				}
+			}
+			if len(unintended) > 0 {
+				findings = append(findings, knox.MachinePrefixFinding{KeyID: key.ID, Entry: a, Unintended: unintended})
+			}
+		}
+	}
+	return findings, nil
+}
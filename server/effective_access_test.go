@@ -0,0 +1,160 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+type mockInventory struct{}
+
+func (mockInventory) Machines() ([]string, error) {
+	return []string{"auth001", "authz-evil01", "web001"}, nil
+}
+
+func (mockInventory) Services() ([]string, error) {
+	return []string{"spiffe://example.com/team/a", "spiffe://example.com/other/b", "not-spiffe"}, nil
+}
+
+func TestGetEffectiveAccess(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", []string{})
+	acl := `[{"type":"MachinePrefix","id":"auth","access":"Read"},{"type":"ServicePrefix","id":"spiffe://example.com/team/","access":"Write"}]`
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	i, err := getEffectiveAccessHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	grants := i.([]knox.EffectiveGrant)
+	if len(grants) != 3 {
+		t.Fatalf("expected 3 grants, got %+v", grants)
+	}
+	for _, g := range grants {
+		if g.Description == "" || g.Matches != nil {
+			t.Fatalf("unexpected grant without inventory %+v", g)
+		}
+	}
+
+	SetPrincipalInventory(mockInventory{})
+	defer SetPrincipalInventory(nil)
+	i, _ = getEffectiveAccessHandler(m, u, map[string]string{"keyID": "a1"})
+	grants = i.([]knox.EffectiveGrant)
+	if !reflect.DeepEqual(grants[0].Matches, []string{"auth001", "authz-evil01"}) {
+		t.Fatalf("unexpected machine matches %v", grants[0].Matches)
+	}
+	if !reflect.DeepEqual(grants[1].Matches, []string{"spiffe://example.com/team/a"}) {
+		t.Fatalf("unexpected service matches %v", grants[1].Matches)
+	}
+
+	if _, err := getEffectiveAccessHandler(m, u, map[string]string{"keyID": "nope"}); err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("expected missing key, got %+v", err)
+	}
+}
+
+func TestGetPrincipalAccess(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": `[{"type":"UserGroup","id":"eng","access":"Read"},{"type":"User","id":"bob","access":"Write"}]`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a2", "data": "MQ==", "acl": `[{"type":"MachinePrefix","id":"web","access":"Read"}]`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Only the audit group may report across all keys.
+	params := map[string]string{"principal": "bob", "type": "User", "groups": "eng"}
+	if _, err := getPrincipalAccessHandler(m, u, params); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented without an audit group, got %+v", err)
+	}
+	SetAuditGroup("security")
+	defer SetAuditGroup("")
+	if _, err := getPrincipalAccessHandler(m, u, params); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+	u = auth.NewUser("alice", []string{"security"})
+
+	i, err := getPrincipalAccessHandler(m, u, params)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	accesses := i.([]knox.PrincipalKeyAccess)
+	if len(accesses) != 1 || accesses[0].KeyID != "a1" || accesses[0].AccessType != knox.Write || len(accesses[0].Entries) != 2 {
+		t.Fatalf("unexpected access %+v", accesses)
+	}
+
+	i, _ = getPrincipalAccessHandler(m, u, map[string]string{"principal": "web001", "type": "Machine"})
+	accesses = i.([]knox.PrincipalKeyAccess)
+	if len(accesses) != 1 || accesses[0].KeyID != "a2" || accesses[0].AccessType != knox.Read {
+		t.Fatalf("unexpected access %+v", accesses)
+	}
+
+	i, _ = getPrincipalAccessHandler(m, u, map[string]string{"principal": "alice", "type": "User"})
+	if len(i.([]knox.PrincipalKeyAccess)) != 2 {
+		t.Fatalf("expected creator to administer both keys, got %+v", i)
+	}
+
+	for _, params := range []map[string]string{
+		{"type": "User"},
+		{"principal": "bob", "type": "Bogus"},
+		{"principal": "not-spiffe", "type": "Service"},
+	} {
+		if _, err := getPrincipalAccessHandler(m, u, params); err == nil {
+			t.Fatalf("expected error for %v", params)
+		}
+	}
+}
+
+func TestAuditMachinePrefixes(t *testing.T) {
+	m, _ := makeDB()
+	if _, err := getMachinePrefixAuditHandler(m, auth.NewUser("alice", []string{}), nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented without an audit group, got %+v", err)
+	}
+	SetAuditGroup("security")
+	defer SetAuditGroup("")
+	if _, err := getMachinePrefixAuditHandler(m, auth.NewUser("bob", []string{}), nil); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+
+	u := auth.NewUser("alice", []string{"security"})
+	if _, err := getMachinePrefixAuditHandler(m, u, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented without inventory, got %+v", err)
+	}
+
+	acl := `[{"type":"MachinePrefix","id":"auth","access":"Read"},{"type":"MachinePrefix","id":"web","access":"Read"}]`
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	SetPrincipalInventory(mockInventory{})
+	defer SetPrincipalInventory(nil)
+	i, err := getMachinePrefixAuditHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	findings := i.([]knox.MachinePrefixFinding)
+	if len(findings) != 1 || findings[0].Entry.ID != "auth" || !reflect.DeepEqual(findings[0].Unintended, []string{"authz-evil01"}) {
+		t.Fatalf("unexpected findings %+v", findings)
+	}
+}
+
+func TestIsMidTokenMatch(t *testing.T) {
+	cases := map[[2]string]bool{
+		{"auth", "auth001"}:      false,
+		{"auth", "authz-evil01"}: true,
+		{"web1", "web12"}:        true,
+		{"web1", "web1-a"}:       false,
+		{"web-", "web-a"}:        false,
+		{"auth", "auth"}:         false,
+		{"auth", "db01"}:         false,
+	}
+	for c, expected := range cases {
+		if isMidTokenMatch(c[0], c[1]) != expected {
+			t.Errorf("%s matching %s: expected %v", c[0], c[1], expected)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"sort"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// explainRequest evaluates principal's request for access to key the same
+// way authorizeRequest does, recording which ACL entries, default access,
+// access callback or break-glass grant produced the decision. Nothing is
+// logged as a break-glass use.
+func explainRequest(key *knox.Key, principal knox.Principal, access knox.AccessType, origin net.IP) knox.AuthorizationExplanation {
+	result := knox.AuthorizationExplanation{
+		KeyID:      key.ID,
+		AccessType: access,
+		Principals: []knox.PrincipalDecision{},
+	}
+	if origin != nil {
+		result.Origin = origin.String()
+	}
+
+	subPrincipals := map[string]knox.Principal{"": principal}
+	if mux, ok := principal.(knox.PrincipalMux); ok {
+		subPrincipals = mux.PrincipalsByProvider()
+	}
+	for provider, p := range subPrincipals {
+		d := knox.PrincipalDecision{
+			Provider:  provider,
+			Principal: p.Raw(),
+			Entries:   []knox.EffectiveGrant{},
+		}
+		for _, a := range key.ACL {
+			if !a.AccessType.CanAccess(access) || !p.CanAccess(knox.ACL{a}, access) {
+				continue
+			}
+			grant := knox.EffectiveGrant{
+				Entry:       a,
+				Description: describeAccess(a),
+				Default:     isDefaultAccess(a),
+			}
+			if !a.AllowsOrigin(origin) {
+				d.OutsideNetworks = append(d.OutsideNetworks, grant)
+				continue
+			}
+			d.Allowed = true
+			d.Entries = append(d.Entries, grant)
+		}
+		if d.Allowed && !result.Allowed {
+			result.Allowed = true
+			result.Source = knox.DecisionSourceACL
+		}
+		result.Principals = append(result.Principals, d)
+	}
+	sort.Slice(result.Principals, func(i, j int) bool {
+		return result.Principals[i].Provider < result.Principals[j].Provider
+	})
+
+	if result.Allowed {
+		return result
+	}
+
+	allow, err := runAccessCallback(key, principal, access)
+	if err != nil {
+		// The callback's error may describe its internals, so it is only logged.
+		log.Printf("access callback failed explaining access to %s: %v", key.ID, err)
+		result.CallbackError = "The access callback failed"
+		return result
+	}
+	if allow {
+		result.Allowed = true
+		result.Source = knox.DecisionSourceAccessCallback
+		return result
+	}
+
+	if access == knox.Read && breakGlass != nil && breakGlass.check(key.ID, principal, false) {
+		result.Allowed = true
+		result.Source = knox.DecisionSourceBreakGlass
+	}
+	return result
+}
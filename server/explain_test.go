@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestExplainRequest(t *testing.T) {
+	key := &knox.Key{ID: "k1", ACL: knox.ACL{
+		{Type: knox.UserGroup, ID: "eng", AccessType: knox.Read},
+		{Type: knox.User, ID: "alice", AccessType: knox.Admin},
+		{Type: knox.MachinePrefix, ID: "web", AccessType: knox.Write},
+	}}
+	alice := auth.NewUser("alice", []string{"eng"})
+	machine := auth.NewMachine("web001")
+	mux := knox.NewPrincipalMux(alice, map[string]knox.Principal{"github": alice, "mtls": machine})
+
+	e := explainRequest(key, mux, knox.Read, nil)
+	if !e.Allowed || e.Source != knox.DecisionSourceACL || len(e.Principals) != 2 {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	if e.Principals[0].Provider != "github" || len(e.Principals[0].Entries) != 2 {
+		t.Fatalf("expected both user entries to grant read, got %+v", e.Principals[0])
+	}
+	if e.Principals[1].Provider != "mtls" || len(e.Principals[1].Entries) != 1 || e.Principals[1].Entries[0].Entry.Type != knox.MachinePrefix {
+		t.Fatalf("expected machine prefix to grant read, got %+v", e.Principals[1])
+	}
+
+	e = explainRequest(key, mux, knox.Admin, nil)
+	if !e.Allowed || !e.Principals[0].Allowed || e.Principals[1].Allowed {
+		t.Fatalf("expected only the user to be admin, got %+v", e)
+	}
+
+	bob := auth.NewUser("bob", nil)
+	e = explainRequest(key, bob, knox.Read, nil)
+	if e.Allowed || e.Source != "" || e.Principals[0].Provider != "" {
+		t.Fatalf("expected denial, got %+v", e)
+	}
+
+	SetAccessCallback(func(input knox.AccessCallbackInput) (bool, error) { return true, nil })
+	e = explainRequest(key, bob, knox.Read, nil)
+	if !e.Allowed || e.Source != knox.DecisionSourceAccessCallback {
+		t.Fatalf("expected callback to allow, got %+v", e)
+	}
+	SetAccessCallback(func(input knox.AccessCallbackInput) (bool, error) { return false, fmt.Errorf("boom") })
+	e = explainRequest(key, bob, knox.Read, nil)
+	if e.Allowed || e.CallbackError != "The access callback failed" {
+		t.Fatalf("expected callback error, got %+v", e)
+	}
+	SetAccessCallback(nil)
+}
+
+func TestGetAuthorizationHandler(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", nil)
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": `[{"type":"Machine","id":"web001","access":"Read"}]`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	i, err := getAuthorizationHandler(m, u, map[string]string{"keyID": "a1", "access": "Admin"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if !i.(knox.AuthorizationExplanation).Allowed {
+		t.Fatal("expected caller to be allowed")
+	}
+
+	i, err = getAuthorizationHandler(m, u, map[string]string{"keyID": "a1", "access": "Write", "principal": "web001", "type": "Machine"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if i.(knox.AuthorizationExplanation).Allowed {
+		t.Fatal("expected machine to be denied write")
+	}
+
+	// Other principals' access is only explained to admins and auditors.
+	bob := auth.NewUser("bob", []string{"audit"})
+	params := map[string]string{"keyID": "a1", "access": "Read", "principal": "web001", "type": "Machine"}
+	if _, err := getAuthorizationHandler(m, bob, params); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+	if _, err := getAuthorizationHandler(m, bob, map[string]string{"keyID": "a1", "access": "Read"}); err != nil {
+		t.Fatalf("expected callers to explain their own access, got %+v", err)
+	}
+	SetAuditGroup("audit")
+	defer SetAuditGroup("")
+	if i, err := getAuthorizationHandler(m, bob, params); err != nil || !i.(knox.AuthorizationExplanation).Allowed {
+		t.Fatalf("expected auditors to explain other principals' access, got %+v %+v", i, err)
+	}
+
+	for _, params := range []map[string]string{
+		{"keyID": "a1", "access": "None"},
+		{"keyID": "a1"},
+		{"keyID": "a1", "access": "Read", "principal": "x", "type": "Bogus"},
+		{"keyID": "nope", "access": "Read"},
+	} {
+		if _, err := getAuthorizationHandler(m, u, params); err == nil {
+			t.Fatalf("expected error for %v", params)
+		}
+	}
+}
@@ -484,3 +484,181 @@ func TestKeyAccessUpdatesWithPrincipalValidation(t *testing.T) {
 	access = knox.Access{ID: "https://ahoy", Type: knox.Service, AccessType: knox.Read}
 	putAccessExpectedFailure(t, keyID, &access, "Service prefix is invalid URL, must conform to 'spiffe://<domain>/<path>/' format.")
 }
+
+// getV1Data sends body as JSON to a v1 route and decodes the response into
+// data, or into the returned error if the request failed.
+func getV1Data(t *testing.T, method string, path string, body interface{}, data interface{}) (int, *knox.APIError) {
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, reqErr := http.NewRequest(method, path, &b)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	r.Header.Set("Authorization", "0u"+"testuser")
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	getRouter().ServeHTTP(w, r)
+	if w.Code >= 300 {
+		resp := &knox.ErrorResponse{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatalf("%s %s: %d response is not an error response: %v", method, path, w.Code, err)
+		}
+		return w.Code, &resp.Error
+	}
+	if data != nil {
+		if err := json.NewDecoder(w.Body).Decode(data); err != nil {
+			t.Fatal(err)
+		}
+	} else if w.Body.Len() != 0 {
+		t.Fatalf("%s %s: unexpected body %s", method, path, w.Body.String())
+	}
+	return w.Code, nil
+}
+
+func TestV1Keys(t *testing.T) {
+	keyID := "testv1keys"
+	var key knox.Key
+	code, apiErr := getV1Data(t, "POST", "/v1/keys/", knox.KeyCreateRequest{ID: keyID, Data: []byte("first")}, &key)
+	if code != http.StatusCreated || apiErr != nil {
+		t.Fatalf("expected 201, got %d %+v", code, apiErr)
+	}
+	if key.ID != keyID || len(key.VersionList) != 1 || key.VersionList[0].Data != nil {
+		t.Fatalf("expected the created key without its data, got %+v", key)
+	}
+
+	code, apiErr = getV1Data(t, "POST", "/v1/keys/", knox.KeyCreateRequest{ID: keyID, Data: []byte("again")}, nil)
+	if code != http.StatusConflict || apiErr == nil || apiErr.Type != "key_exists" || apiErr.Code != knox.KeyIdentifierExistsCode {
+		t.Fatalf("expected a key_exists conflict, got %d %+v", code, apiErr)
+	}
+	code, apiErr = getV1Data(t, "POST", "/v1/keys/", map[string]string{"id": "testv1typo", "dta": "Zmlyc3Q="}, nil)
+	if code != http.StatusBadRequest || apiErr == nil || apiErr.Type != "bad_request" {
+		t.Fatalf("expected unknown fields to be refused, got %d %+v", code, apiErr)
+	}
+
+	var ids []string
+	if code, apiErr = getV1Data(t, "GET", "/v1/keys/", nil, &ids); apiErr != nil {
+		t.Fatalf("%d %+v", code, apiErr)
+	}
+	found := false
+	for _, id := range ids {
+		found = found || id == keyID
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", keyID, ids)
+	}
+	// As in v0, the query string selects the keys whose hash has changed.
+	if code, apiErr = getV1Data(t, "GET", "/v1/keys/?"+keyID+"="+key.VersionHash, nil, &ids); apiErr != nil || len(ids) != 0 {
+		t.Fatalf("expected no changed keys, got %d %+v %v", code, apiErr, ids)
+	}
+	if code, apiErr = getV1Data(t, "GET", "/v1/keys/?"+keyID+"=stale", nil, &ids); apiErr != nil || len(ids) != 1 || ids[0] != keyID {
+		t.Fatalf("expected %s to have changed, got %d %+v %v", keyID, code, apiErr, ids)
+	}
+
+	// Keys created through either version are visible through the other.
+	if v0 := getKey(t, keyID); v0.VersionHash != key.VersionHash {
+		t.Fatalf("expected hash %s, got %s", key.VersionHash, v0.VersionHash)
+	}
+
+	var version knox.KeyVersion
+	path := "/v1/keys/" + keyID + "/versions/"
+	code, apiErr = getV1Data(t, "POST", path, knox.VersionCreateRequest{Data: []byte("second")}, &version)
+	if code != http.StatusCreated || apiErr != nil || version.Status != knox.Active || version.Data != nil {
+		t.Fatalf("expected an active version without its data, got %d %+v %+v", code, apiErr, version)
+	}
+	versionPath := path + strconv.FormatUint(version.ID, 10) + "/"
+	code, apiErr = getV1Data(t, "PUT", versionPath, map[string]string{}, nil)
+	if code != http.StatusBadRequest || apiErr == nil {
+		t.Fatalf("expected a missing status to be refused, got %d %+v", code, apiErr)
+	}
+	primary := knox.Primary
+	code, apiErr = getV1Data(t, "PUT", versionPath, knox.VersionUpdateRequest{Status: &primary}, nil)
+	if code != http.StatusNoContent || apiErr != nil {
+		t.Fatalf("expected 204, got %d %+v", code, apiErr)
+	}
+	code, apiErr = getV1Data(t, "PUT", path+"12345/", knox.VersionUpdateRequest{Status: &primary}, nil)
+	if code != http.StatusNotFound || apiErr == nil || apiErr.Type != "key_version_not_found" {
+		t.Fatalf("expected key_version_not_found, got %d %+v", code, apiErr)
+	}
+
+	if code, apiErr = getV1Data(t, "GET", "/v1/keys/"+keyID+"/", nil, &key); apiErr != nil {
+		t.Fatalf("%d %+v", code, apiErr)
+	}
+	if p := key.VersionList.GetPrimary(); p == nil || p.ID != version.ID {
+		t.Fatalf("expected version %d to be primary, got %+v", version.ID, key.VersionList)
+	}
+
+	accessPath := "/v1/keys/" + keyID + "/access/"
+	entry := knox.Access{Type: knox.Machine, ID: "v1host", AccessType: knox.Read}
+	code, apiErr = getV1Data(t, "PUT", accessPath, knox.ACL{entry}, nil)
+	if code != http.StatusNoContent || apiErr != nil {
+		t.Fatalf("expected 204, got %d %+v", code, apiErr)
+	}
+	code, apiErr = getV1Data(t, "PUT", accessPath, knox.ACL{{Type: knox.User, ID: "", AccessType: knox.Read}}, nil)
+	if code != http.StatusBadRequest || apiErr == nil || apiErr.Type != "bad_principal" {
+		t.Fatalf("expected bad_principal, got %d %+v", code, apiErr)
+	}
+	var acl knox.ACL
+	if code, apiErr = getV1Data(t, "GET", accessPath, nil, &acl); apiErr != nil {
+		t.Fatalf("%d %+v", code, apiErr)
+	}
+	found = false
+	for _, a := range acl {
+		found = found || a.Equal(entry)
+	}
+	if !found {
+		t.Fatalf("expected %+v in %+v", entry, acl)
+	}
+
+	// Changes held for approval are accepted with the pending change.
+	approval, err := NewTwoPersonApproval(ApprovalConfig{Store: NewTempPendingChangeStore(), Label: "v1-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddKeyLabel(keyID, "v1-test")
+	SetTwoPersonApproval(approval)
+	var pending knox.PendingChange
+	code, apiErr = getV1Data(t, "DELETE", "/v1/keys/"+keyID+"/", nil, &pending)
+	SetTwoPersonApproval(nil)
+	if code != http.StatusAccepted || apiErr != nil {
+		t.Fatalf("expected 202, got %d %+v", code, apiErr)
+	}
+	if pending.ID == "" || pending.Expiry == 0 || pending.KeyID != keyID || pending.Operation != OperationDeleteKey {
+		t.Fatalf("expected the pending change, got %+v", pending)
+	}
+	if code, apiErr = getV1Data(t, "GET", "/v1/keys/"+keyID+"/", nil, &key); apiErr != nil {
+		t.Fatalf("expected the key to remain until approved, got %d %+v", code, apiErr)
+	}
+
+	code, apiErr = getV1Data(t, "DELETE", "/v1/keys/"+keyID+"/", nil, nil)
+	if code != http.StatusNoContent || apiErr != nil {
+		t.Fatalf("expected 204, got %d %+v", code, apiErr)
+	}
+	code, apiErr = getV1Data(t, "GET", "/v1/keys/"+keyID+"/", nil, nil)
+	if code != http.StatusNotFound || apiErr == nil || apiErr.Type != "key_not_found" {
+		t.Fatalf("expected key_not_found, got %d %+v", code, apiErr)
+	}
+}
+
+func TestV1Unauthenticated(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/keys/", nil)
+	w := httptest.NewRecorder()
+	getRouter().ServeHTTP(w, r)
+	resp := &knox.ErrorResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnauthorized || resp.Error.Type != "unauthenticated" {
+		t.Fatalf("expected a typed unauthenticated error, got %d %+v", w.Code, resp)
+	}
+}
+
+func TestV1NotFound(t *testing.T) {
+	code, apiErr := getV1Data(t, "GET", "/v1/nothing/", nil, nil)
+	if code != http.StatusNotFound || apiErr == nil || apiErr.Type != "route_not_found" {
+		t.Fatalf("expected route_not_found, got %d %+v", code, apiErr)
+	}
+}
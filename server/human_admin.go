@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// humanAdminOverride lists the user groups allowed to leave a key without a
+// human admin.
+var humanAdminOverride knox.ACL
+
+// AddHumanAdminOverrideGroup allows members of group (typically the security
+// team) to make ACL changes that leave a key with no user or user group admin.
+func AddHumanAdminOverrideGroup(group string) {
+	humanAdminOverride = append(humanAdminOverride, knox.Access{Type: knox.UserGroup, ID: group, AccessType: knox.Admin})
+}
+
+// checkHumanAdmin rejects changes to key's ACL that would leave it without a
+// human admin, unless principal may override the requirement.
+func checkHumanAdmin(key *knox.Key, changes []knox.Access, principal knox.Principal) *HTTPError {
+	// Add may remove entries in place, so work on a copy.
+	acl := make(knox.ACL, len(key.ACL))
+	copy(acl, key.ACL)
+	for _, a := range changes {
+		acl = acl.Add(a)
+	}
+	if acl.HasHumanAdmin() {
+		return nil
+	}
+	if len(humanAdminOverride) > 0 && principal.CanAccess(humanAdminOverride, knox.Admin) {
+		log.Printf("principal %s overrode the human admin requirement on %s", principal.GetID(), key.ID)
+		return nil
+	}
+	return errF(knox.BadRequestDataCode, knox.ErrACLNoHumanAdmin.Error())
+}
+
+// findOrphanedKeys lists keys with no user or user group admin.
+func findOrphanedKeys(m KeyManager) ([]knox.OrphanedKey, error) {
+	keys, err := m.GetAllKeyACLs()
+	if err != nil {
+		return nil, err
+	}
+	orphans := []knox.OrphanedKey{}
+	for _, key := range keys {
+		if key.ACL.HasHumanAdmin() {
+			continue
+		}
+		admins := []knox.Access{}
+		for _, a := range key.ACL {
+			if a.AccessType == knox.Admin {
+				admins = append(admins, a)
+			}
+		}
+		orphans = append(orphans, knox.OrphanedKey{KeyID: key.ID, Admins: admins})
+	}
+	return orphans, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestPutAccessKeepsHumanAdmin(t *testing.T) {
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", nil)
+	acl := `[{"type":"Machine","id":"web001","access":"Admin"},{"type":"User","id":"bob","access":"Admin"}]`
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Removing one of two human admins is fine.
+	if _, err := putAccessHandler(m, alice, map[string]string{"keyID": "a1", "access": `{"type":"User","id":"bob","access":"None"}`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Removing or demoting the last one is not.
+	for _, access := range []string{
+		`{"type":"User","id":"alice","access":"None"}`,
+		`{"type":"User","id":"alice","access":"Write"}`,
+	} {
+		_, err := putAccessHandler(m, alice, map[string]string{"keyID": "a1", "access": access})
+		if err == nil || err.Subcode != knox.BadRequestDataCode {
+			t.Fatalf("expected rejection for %s, got %+v", access, err)
+		}
+	}
+
+	// Swapping in a group admin in the same request is fine.
+	swap := `[{"type":"User","id":"alice","access":"None"},{"type":"UserGroup","id":"eng","access":"Admin"}]`
+	if _, err := putAccessHandler(m, alice, map[string]string{"keyID": "a1", "acl": swap}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	orphans, err := findOrphanedKeys(m)
+	if err != nil || len(orphans) != 0 {
+		t.Fatalf("expected no orphans, got %v, %v", orphans, err)
+	}
+}
+
+func TestHumanAdminOverride(t *testing.T) {
+	defer func() { humanAdminOverride = nil }()
+	AddHumanAdminOverrideGroup("security")
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", nil)
+	acl := `[{"type":"Machine","id":"web001","access":"Admin"}]`
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postKeysHandler(m, alice, map[string]string{"id": "a2", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	removeAlice := map[string]string{"keyID": "a1", "access": `{"type":"User","id":"alice","access":"None"}`}
+	if _, err := putAccessHandler(m, alice, removeAlice); err == nil {
+		t.Fatal("expected rejection without override")
+	}
+	if _, err := putAccessHandler(m, auth.NewUser("alice", []string{"security"}), removeAlice); err != nil {
+		t.Fatalf("expected security team override, got %+v", err)
+	}
+
+	orphans, err := findOrphanedKeys(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].KeyID != "a1" || len(orphans[0].Admins) != 1 || orphans[0].Admins[0].ID != "web001" {
+		t.Fatalf("unexpected orphans %+v", orphans)
+	}
+	if _, err := getOrphanedKeysHandler(m, alice, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented without an audit group, got %+v", err)
+	}
+	SetAuditGroup("security")
+	defer SetAuditGroup("")
+	if _, err := getOrphanedKeysHandler(m, alice, nil); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", err)
+	}
+	if i, err := getOrphanedKeysHandler(m, auth.NewUser("alice", []string{"security"}), nil); err != nil || len(i.([]knox.OrphanedKey)) != 1 {
+		t.Fatalf("unexpected report %v, %+v", i, err)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// ImpersonationHeader names the principal a request is made as, in the
+// form "<type>:<id>" where type is User, Machine, Service or APIKey, such as
+// "Service:spiffe://example.com/serviceX".
+const ImpersonationHeader = "X-Knox-Impersonate"
+
+// impersonationProvider is the provider name of impersonated principals.
+const impersonationProvider = "impersonation"
+
+// impersonationRoutes are the IDs of the routes that may be called while
+// impersonating. None of them return key data, so impersonation shows what a
+// principal can access without disclosing any secrets.
+var impersonationRoutes = map[string]bool{
+	"getkeys":            true,
+	"getaccess":          true,
+	"geteffectiveaccess": true,
+	"getprincipalaccess": true,
+	"getauthorization":   true,
+}
+
+var impersonationGroup string
+
+// SetImpersonationGroup allows members of the user group to make requests as
+// another principal by setting ImpersonationHeader, to reproduce what that
+// principal can access. Only routes that return no key data may be called
+// while impersonating, and the groups of impersonated users are looked up
+// with the configured auth.GroupResolver, without which users cannot be
+// impersonated. An empty group disables impersonation.
+func SetImpersonationGroup(group string) {
+	impersonationGroup = group
+}
+
+// GetRealPrincipal gets the principal that authenticated a request made as
+// another principal, or nil if the request does not use impersonation.
+func GetRealPrincipal(r *http.Request) knox.Principal {
+	if rv := context.Get(r, realPrincipalContext); rv != nil {
+		return rv.(knox.Principal)
+	}
+	return nil
+}
+
+func setRealPrincipal(r *http.Request, val knox.Principal) {
+	context.Set(r, realPrincipalContext, val)
+}
+
+// impersonate returns the principal the request impersonates, or nil if it
+// does not set ImpersonationHeader.
+func impersonate(real knox.Principal, r *http.Request) (knox.Principal, *HTTPError) {
+	target := r.Header.Get(ImpersonationHeader)
+	if target == "" {
+		return nil, nil
+	}
+	if impersonationGroup == "" {
+		return nil, errF(knox.UnauthorizedCode, "Impersonation is not enabled")
+	}
+	if !inTeam(real, impersonationGroup) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a member of %s to impersonate", impersonationGroup))
+	}
+	if !impersonationRoutes[GetRouteID(r)] {
+		return nil, errF(knox.UnauthorizedCode, "Impersonation is not allowed for this operation")
+	}
+	principal, err := parseImpersonatedPrincipal(target)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return principal, nil
+}
+
+// parseImpersonatedPrincipal builds the principal named by the value of
+// ImpersonationHeader.
+func parseImpersonatedPrincipal(target string) (knox.Principal, error) {
+	typ, id, ok := strings.Cut(target, ":")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("%s must be of the form <type>:<id>", ImpersonationHeader)
+	}
+	var pt knox.PrincipalType
+	if err := json.Unmarshal([]byte(fmt.Sprintf("%q", typ)), &pt); err != nil {
+		return nil, fmt.Errorf("unknown principal type %q", typ)
+	}
+	if err := pt.IsValidPrincipal(id, nil); err != nil {
+		return nil, err
+	}
+	switch pt {
+	case knox.User:
+		// Users take their groups from the resolver rather than from the
+		// request, which the real principal controls.
+		if auth.GetGroupResolver() == nil {
+			return nil, fmt.Errorf("users cannot be impersonated without a group resolver")
+		}
+		return auth.NewUser(id, nil), nil
+	case knox.Machine:
+		return auth.NewMachine(id), nil
+	case knox.Service:
+		return auth.NewServiceFromSpiffeID(id)
+	case knox.APIKey:
+		return auth.NewAPIKey(id, ""), nil
+	}
+	return nil, fmt.Errorf("principals of type %s cannot be impersonated", typ)
+}
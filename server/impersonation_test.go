@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+type mapGroupResolver map[string][]string
+
+func (m mapGroupResolver) Groups(userID string) ([]string, error) {
+	return m[userID], nil
+}
+
+func TestImpersonation(t *testing.T) {
+	SetImpersonationGroup("testgroup")
+	defer SetImpersonationGroup("")
+
+	var principal, real knox.Principal
+	var logged request
+	h := Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil)(func(w http.ResponseWriter, r *http.Request) {
+		principal = GetPrincipal(r)
+		real = GetRealPrincipal(r)
+		logged = buildRequest(r, principal, map[string]string{})
+	})
+	do := func(routeID, target string) int {
+		principal, real = nil, nil
+		r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+		r.Header.Set("Authorization", "0utoken")
+		if target != "" {
+			r.Header.Set(ImpersonationHeader, target)
+		}
+		w := httptest.NewRecorder()
+		setupRoute(routeID, 0, nil)(h)(w, r)
+		return w.Code
+	}
+
+	if code := do("getkey", ""); code != http.StatusOK || real != nil || logged.RealPrincipal != "" {
+		t.Fatalf("unexpected impersonation without header: %d %v", code, real)
+	}
+
+	if code := do("getauthorization", "Service:spiffe://example.com/serviceX"); code != http.StatusOK {
+		t.Fatalf("expected impersonation to succeed, got %d", code)
+	}
+	if !auth.IsService(principal) || principal.GetID() != "spiffe://example.com/serviceX" || auth.IsUser(principal) {
+		t.Fatalf("unexpected impersonated principal %v", principal.Raw())
+	}
+	if real == nil || real.GetID() != "testuser" {
+		t.Fatalf("unexpected real principal %v", real)
+	}
+	if logged.Principal != "spiffe://example.com/serviceX" || logged.RealPrincipal != "testuser" {
+		t.Fatalf("expected both principals to be logged, got %+v", logged)
+	}
+
+	// Users can only be impersonated with their groups from a resolver.
+	if code := do("getauthorization", "User:alice"); code != http.StatusBadRequest || principal != nil {
+		t.Fatalf("expected users not to be impersonated without a group resolver, got %d", code)
+	}
+	auth.SetGroupResolver(mapGroupResolver{"alice": {"eng", "ops"}, "testuser": {"testgroup"}})
+	defer auth.SetGroupResolver(nil)
+	if code := do("getauthorization", "User:alice"); code != http.StatusOK {
+		t.Fatalf("expected impersonation to succeed, got %d", code)
+	}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "ops", AccessType: knox.Read}}
+	if principal.GetID() != "alice" || !principal.CanAccess(acl, knox.Read) {
+		t.Fatalf("unexpected impersonated user %v", principal.Raw())
+	}
+	// The impersonated principal does not keep the admin's access.
+	acl = knox.ACL{{Type: knox.UserGroup, ID: "testgroup", AccessType: knox.Read}}
+	if principal.CanAccess(acl, knox.Read) {
+		t.Fatal("expected impersonated user not to inherit the real principal's groups")
+	}
+
+	// Routes that return key data or change anything cannot be impersonated.
+	for _, c := range []struct {
+		routeID, target string
+		code            int
+	}{
+		{"getkey", "User:alice", http.StatusForbidden},
+		{"postversion", "User:alice", http.StatusForbidden},
+		{"deletekey", "User:alice", http.StatusForbidden},
+		{"", "User:alice", http.StatusForbidden},
+		{"getaccess", "alice", http.StatusBadRequest},
+		{"getaccess", "UserGroup:eng", http.StatusBadRequest},
+		{"getaccess", "Service:not-spiffe", http.StatusBadRequest},
+	} {
+		if code := do(c.routeID, c.target); code != c.code || principal != nil {
+			t.Errorf("%s %s: expected %d, got %d", c.routeID, c.target, c.code, code)
+		}
+	}
+
+	SetImpersonationGroup("security-team")
+	if code := do("getaccess", "User:alice"); code != http.StatusForbidden {
+		t.Fatalf("expected non-members to be refused, got %d", code)
+	}
+	SetImpersonationGroup("")
+	if code := do("getaccess", "User:alice"); code != http.StatusForbidden {
+		t.Fatalf("expected impersonation to be disabled, got %d", code)
+	}
+}
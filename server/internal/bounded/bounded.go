@@ -0,0 +1,19 @@
+// Package bounded limits the size of in-memory maps used as caches.
+package bounded
+
+// MakeRoom prepares m to take one more entry without exceeding max entries.
+// Once m is full it deletes the entries for which expired returns true, and it
+// reports whether there is room left. Callers decide what to do when there is
+// not: caches usually clear the map, while records that must not be lost
+// refuse the new entry.
+func MakeRoom[K comparable, V any](m map[K]V, max int, expired func(V) bool) bool {
+	if len(m) < max {
+		return true
+	}
+	for k, v := range m {
+		if expired(v) {
+			delete(m, k)
+		}
+	}
+	return len(m) < max
+}
@@ -0,0 +1,17 @@
+package bounded
+
+import "testing"
+
+func TestMakeRoom(t *testing.T) {
+	m := map[string]int{"a": 1, "b": 2}
+	expired := func(v int) bool { return v < 2 }
+	if !MakeRoom(m, 3, expired) || len(m) != 2 {
+		t.Fatalf("expected nothing to be evicted below the limit, got %v", m)
+	}
+	if !MakeRoom(m, 2, expired) || len(m) != 1 || m["b"] != 2 {
+		t.Fatalf("expected expired entries to be evicted, got %v", m)
+	}
+	if MakeRoom(m, 1, expired) || len(m) != 1 {
+		t.Fatalf("expected no room when nothing has expired, got %v", m)
+	}
+}
@@ -11,6 +11,7 @@ import (
 type KeyManager interface {
 	GetAllKeyIDs() ([]string, error)
 	GetUpdatedKeyIDs(map[string]string) ([]string, error)
+	GetAllKeyACLs() ([]knox.Key, error)
 	GetKey(id string, status knox.VersionStatus) (*knox.Key, error)
 	AddNewKey(*knox.Key) error
 	DeleteKey(id string) error
@@ -55,6 +56,20 @@ func (m *keyManager) GetUpdatedKeyIDs(versions map[string]string) ([]string, err
 	return output, nil
 }
 
+// GetAllKeyACLs returns the ID, ACL and version hash of every key without
+// decrypting any key data, so the keys returned have no versions.
+func (m *keyManager) GetAllKeyACLs() ([]knox.Key, error) {
+	keys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	output := make([]knox.Key, 0, len(keys))
+	for _, k := range keys {
+		output = append(output, knox.Key{ID: k.ID, ACL: k.ACL, VersionHash: k.VersionHash})
+	}
+	return output, nil
+}
+
 func (m *keyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
 	encK, err := m.db.Get(id)
 	if err != nil {
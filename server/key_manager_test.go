@@ -102,6 +102,30 @@ func TestGetAllKeyIDs(t *testing.T) {
 	}
 }
 
+func TestGetAllKeyACLs(t *testing.T) {
+	db := keydb.NewTempDB()
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	u := auth.NewUser("test", []string{})
+	acl := knox.ACL{{Type: knox.User, ID: "test", AccessType: knox.Admin}}
+	key := newKey("id1", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatal(err)
+	}
+
+	// ACLs are read without decrypting, even with the wrong key.
+	wrong := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("wrongwrongwrongw")), db)
+	if _, err := wrong.GetKey("id1", knox.Primary); err == nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+	keys, err := wrong.GetAllKeyACLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != "id1" || len(keys[0].ACL) != 1 || len(keys[0].VersionList) != 0 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+}
+
 func TestGetUpdatedKeyIDs(t *testing.T) {
 	m, u, acl := GetMocks()
 	keys, err := m.GetUpdatedKeyIDs(map[string]string{})
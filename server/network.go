@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPParameter is the handler parameter holding the resolved address of
+// the client. It is set for every route after the route's own parameters, so
+// it cannot be supplied by the caller.
+const clientIPParameter = "clientIP"
+
+// trustedProxies lists the networks whose X-Forwarded-For headers are believed.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the CIDR ranges of load balancers and proxies in
+// front of knox. When a request arrives from one of them, the client address
+// is taken from the X-Forwarded-For header, skipping any other trusted hops.
+// By default no proxies are trusted and the connection's address is used.
+func SetTrustedProxies(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy network %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the address the request originated from, or nil if it
+// cannot be determined.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Walk the forwarded chain from the nearest hop outwards. The first
+	// address not belonging to a trusted proxy is the client; anything to its
+	// left could have been forged by the client.
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// requestOrigin returns the client address recorded in the handler parameters.
+func requestOrigin(parameters map[string]string) net.IP {
+	return net.ParseIP(parameters[clientIPParameter])
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		// Direct connections ignore forwarded headers.
+		{"192.168.1.5:4000", []string{"1.2.3.4"}, "192.168.1.5"},
+		{"192.168.1.5", nil, "192.168.1.5"},
+		// A trusted proxy supplies the client address.
+		{"10.0.0.1:4000", []string{"1.2.3.4"}, "1.2.3.4"},
+		// Addresses left of the first untrusted hop may be forged.
+		{"10.0.0.1:4000", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"10.0.0.1:4000", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		// A proxy without a forwarded header is the client.
+		{"10.0.0.1:4000", nil, "10.0.0.1"},
+		// Garbage in the chain leaves the origin unknown.
+		{"10.0.0.1:4000", []string{"not-an-ip"}, "<nil>"},
+		{"unknown", nil, "<nil>"},
+	}
+	for _, c := range cases {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: http.Header{}}
+		for _, f := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if ip := clientIP(r).String(); ip != c.expected {
+			t.Errorf("%s %v: expected %s, got %s", c.remoteAddr, c.forwarded, c.expected, ip)
+		}
+	}
+
+	if err := SetTrustedProxies([]string{"10.0.0.1"}); err == nil {
+		t.Error("expected error for address without prefix length")
+	}
+}
+
+func TestNetworkRestrictedAccess(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("alice", nil)
+	acl := `[{"type":"Machine","id":"web001","access":"Read","networks":["10.0.0.0/8"]}]`
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	machine := auth.NewMachine("web001")
+
+	// Malformed networks are the client's error, whether creating or updating.
+	bad := `[{"type":"Machine","id":"web002","access":"Read","networks":["10.0.0.0"]}]`
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a2", "data": "MQ==", "acl": bad}); err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("expected bad request, got %+v", err)
+	}
+	if _, err := putAccessHandler(m, u, map[string]string{"keyID": "a1", "acl": bad}); err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("expected bad request, got %+v", err)
+	}
+	// Only networks are validated on update: entries are applied in order, so
+	// repeated entries are still accepted and the last one wins.
+	repeated := `[{"type":"Machine","id":"web003","access":"Read"},{"type":"Machine","id":"web003","access":"Write"}]`
+	if _, err := putAccessHandler(m, u, map[string]string{"keyID": "a1", "acl": repeated}); err != nil {
+		t.Fatalf("expected repeated entries to be accepted, got %+v", err)
+	}
+	if key, _ := m.GetKey("a1", knox.Primary); !auth.NewMachine("web003").CanAccess(key.ACL, knox.Write) {
+		t.Fatal("expected the last repeated entry to apply")
+	}
+
+	if _, err := getKeyHandler(m, machine, map[string]string{"keyID": "a1", clientIPParameter: "10.1.2.3"}); err != nil {
+		t.Fatalf("expected access from inside the network, got %+v", err)
+	}
+	for _, params := range []map[string]string{
+		{"keyID": "a1", clientIPParameter: "203.0.113.9"},
+		{"keyID": "a1"},
+	} {
+		_, err := getKeyHandler(m, machine, params)
+		if err == nil || err.Subcode != knox.UnauthorizedCode {
+			t.Fatalf("expected unauthorized for %v, got %+v", params, err)
+		}
+	}
+
+	e, err := getAuthorizationHandler(m, machine, map[string]string{"keyID": "a1", "access": "Read", clientIPParameter: "203.0.113.9"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	explanation := e.(knox.AuthorizationExplanation)
+	if explanation.Allowed || explanation.Origin != "203.0.113.9" || len(explanation.Principals[0].OutsideNetworks) != 1 {
+		t.Fatalf("expected denial outside network, got %+v", explanation)
+	}
+	e, err = getAuthorizationHandler(m, machine, map[string]string{"keyID": "a1", "access": "Read", "origin": "10.9.9.9", clientIPParameter: "203.0.113.9"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if explanation = e.(knox.AuthorizationExplanation); !explanation.Allowed {
+		t.Fatalf("expected explicit origin to be evaluated, got %+v", explanation)
+	}
+	if _, err = getAuthorizationHandler(m, machine, map[string]string{"keyID": "a1", "access": "Read", "origin": "nope"}); err == nil {
+		t.Fatal("expected error for invalid origin")
+	}
+}
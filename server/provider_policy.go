@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// routeProviders maps route IDs to the providers acceptable for them.
+var routeProviders = map[string][]string{}
+
+// RequireProviders limits the route with the given ID to principals
+// authenticated by one of the named providers (see auth.Provider.Name), such
+// as "oidc" for admin operations or "mtls" for machine reads. Principals from
+// other providers are ignored for the route, and requests with none from the
+// named providers are refused. Principals carried by session tokens are named
+// "session/<provider>" and must be listed as such to be accepted.
+//
+// When several providers authenticated the request, the principal of the
+// first named provider becomes the default. Calling RequireProviders again
+// for a route replaces its providers, and naming none removes the requirement.
+func RequireProviders(routeID string, providers ...string) {
+	if len(providers) == 0 {
+		delete(routeProviders, routeID)
+		return
+	}
+	routeProviders[routeID] = providers
+}
+
+// checkProviders returns principal restricted to the providers acceptable
+// for the route, or an error if it has none of them.
+func checkProviders(routeID string, principal knox.Principal) (knox.Principal, *HTTPError) {
+	providers, ok := routeProviders[routeID]
+	if !ok {
+		return principal, nil
+	}
+	notAccepted := errF(knox.UnauthenticatedCode, fmt.Sprintf("This operation requires authentication by one of: %s", strings.Join(providers, ", ")))
+	mux, ok := principal.(knox.PrincipalMux)
+	if !ok {
+		// Without provider names the principal cannot be shown to qualify.
+		return nil, notAccepted
+	}
+	byProvider := mux.PrincipalsByProvider()
+	var first knox.Principal
+	accepted := map[string]knox.Principal{}
+	for _, name := range providers {
+		if p, ok := byProvider[name]; ok {
+			if first == nil {
+				first = p
+			}
+			accepted[name] = p
+		}
+	}
+	if first == nil {
+		return nil, notAccepted
+	}
+	return knox.NewPrincipalMux(first, accepted), nil
+}
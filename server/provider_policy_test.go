@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestRequireProviders(t *testing.T) {
+	RequireProviders("putaccess", "oidc")
+	RequireProviders("getkey", "mtls", "spiffe")
+	defer func() {
+		RequireProviders("putaccess")
+		RequireProviders("getkey")
+	}()
+
+	alice := auth.NewUser("alice", []string{"admins"})
+	host := auth.NewMachine("host01")
+	mux := knox.NewPrincipalMux(alice, map[string]knox.Principal{"github": alice, "mtls": host})
+
+	if p, err := checkProviders("getkeys", mux); err != nil || p.GetID() != "alice" {
+		t.Fatalf("expected routes without requirements to be unaffected, got %v %+v", p, err)
+	}
+	if _, err := checkProviders("putaccess", mux); err == nil || err.Subcode != knox.UnauthenticatedCode {
+		t.Fatalf("expected other providers to be refused, got %+v", err)
+	}
+
+	// Only the accepted provider's principal remains, so the GitHub user's
+	// groups no longer grant access.
+	p, err := checkProviders("getkey", mux)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if p.GetID() != "host01" || auth.IsUser(p) {
+		t.Fatalf("unexpected principal %v", p.Raw())
+	}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "admins", AccessType: knox.Read}}
+	if p.CanAccess(acl, knox.Read) {
+		t.Fatal("expected principals of other providers to be ignored")
+	}
+
+	// Session-derived principals must be named as such.
+	session := knox.NewPrincipalMux(alice, map[string]knox.Principal{"session/oidc": alice})
+	if _, err := checkProviders("putaccess", session); err == nil {
+		t.Fatal("expected session principals not to satisfy oidc")
+	}
+	RequireProviders("putaccess", "oidc", "session/oidc")
+	if p, err := checkProviders("putaccess", session); err != nil || p.GetID() != "alice" {
+		t.Fatalf("expected listed session provider to be accepted, got %v %+v", p, err)
+	}
+
+	if _, err := checkProviders("putaccess", alice); err == nil {
+		t.Fatal("expected principals without providers to be refused")
+	}
+}
+
+func TestRequireProvidersRoute(t *testing.T) {
+	route := mockRoute()
+	route.Id = "mockroute"
+	var principal knox.Principal
+	route.Handler = func(m KeyManager, p knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+		principal = p
+		return nil, nil
+	}
+	h := Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil)(route.ServeHTTP)
+	do := func() int {
+		principal = nil
+		r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+		r.Header.Set("Authorization", "0utoken")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	RequireProviders("mockroute", "mtls")
+	defer RequireProviders("mockroute")
+	if code := do(); code != http.StatusUnauthorized || principal != nil {
+		t.Fatalf("expected the handler not to run, got %d", code)
+	}
+	RequireProviders("mockroute", "mtls", "github")
+	if code := do(); code != http.StatusOK || principal == nil || principal.GetID() != "testuser" {
+		t.Fatalf("expected the handler to run, got %d", code)
+	}
+}
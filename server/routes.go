@@ -4,8 +4,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/log"
@@ -62,6 +65,54 @@ var routes = [...]Route{
 			UrlParameter("keyID"),
 		},
 	},
+	{
+		Method:  "GET",
+		Id:      "geteffectiveaccess",
+		Path:    "/v0/keys/{keyID}/access/effective/",
+		Handler: getEffectiveAccessHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getprincipalaccess",
+		Path:    "/v0/access/",
+		Handler: getPrincipalAccessHandler,
+		Parameters: []Parameter{
+			QueryParameter("principal"),
+			QueryParameter("type"),
+			QueryParameter("groups"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getauthorization",
+		Path:    "/v0/keys/{keyID}/authorization/",
+		Handler: getAuthorizationHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			QueryParameter("access"),
+			QueryParameter("principal"),
+			QueryParameter("type"),
+			QueryParameter("groups"),
+			QueryParameter("origin"),
+		},
+	},
+	{
+		Method:     "GET",
+		Id:         "getmachineprefixaudit",
+		Path:       "/v0/audit/machineprefixes/",
+		Handler:    getMachinePrefixAuditHandler,
+		Parameters: []Parameter{},
+	},
+	{
+		Method:     "GET",
+		Id:         "getorphanedkeys",
+		Path:       "/v0/audit/orphanedkeys/",
+		Handler:    getOrphanedKeysHandler,
+		Parameters: []Parameter{},
+	},
 	{
 		Method:  "PUT",
 		Id:      "putaccess",
@@ -94,6 +145,190 @@ var routes = [...]Route{
 			PostParameter("status"),
 		},
 	},
+	{
+		Method:  "POST",
+		Id:      "postbreakglass",
+		Path:    "/v0/keys/{keyID}/breakglass/",
+		Handler: postBreakGlassHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			PostParameter("justification"),
+		},
+	},
+	{
+		Method:     "GET",
+		Id:         "getpendingchanges",
+		Path:       "/v0/pending/",
+		Handler:    getPendingChangesHandler,
+		Parameters: []Parameter{},
+	},
+	{
+		Method:  "POST",
+		Id:      "approvependingchange",
+		Path:    "/v0/pending/{changeID}/approve/",
+		Handler: approvePendingChangeHandler,
+		Parameters: []Parameter{
+			UrlParameter("changeID"),
+		},
+	},
+	{
+		Method:  "POST",
+		Id:      "rejectpendingchange",
+		Path:    "/v0/pending/{changeID}/reject/",
+		Handler: rejectPendingChangeHandler,
+		Parameters: []Parameter{
+			UrlParameter("changeID"),
+		},
+	},
+	{
+		Method:  "POST",
+		Id:      "postapikey",
+		Path:    "/v0/apikeys/",
+		Handler: postAPIKeyHandler,
+		Parameters: []Parameter{
+			PostParameter("name"),
+			PostParameter("team"),
+			PostParameter("ttl"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getapikeys",
+		Path:    "/v0/apikeys/",
+		Handler: getAPIKeysHandler,
+		Parameters: []Parameter{
+			QueryParameter("team"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Id:      "deleteapikey",
+		Path:    "/v0/apikeys/{apiKeyID}/",
+		Handler: deleteAPIKeyHandler,
+		Parameters: []Parameter{
+			UrlParameter("apiKeyID"),
+		},
+	},
+	{
+		Method:     "POST",
+		Id:         "postsession",
+		Path:       "/v0/sessions/",
+		Handler:    postSessionHandler,
+		Parameters: []Parameter{},
+	},
+	{
+		Method:  "DELETE",
+		Id:      "deletesession",
+		Path:    "/v0/sessions/{sessionID}/",
+		Handler: deleteSessionHandler,
+		Parameters: []Parameter{
+			UrlParameter("sessionID"),
+		},
+	},
+	{
+		Method:     "POST",
+		Id:         enrollTOTPRouteID,
+		Path:       "/v0/totp/",
+		Handler:    postTOTPHandler,
+		Parameters: []Parameter{},
+	},
+	{
+		Method:  "POST",
+		Id:      enrollUserTOTPRouteID,
+		Path:    "/v0/totp/{userID}/",
+		Handler: postUserTOTPHandler,
+		Parameters: []Parameter{
+			UrlParameter("userID"),
+		},
+	},
+
+	// The v1 key routes take JSON request bodies and share the Ids of the v0
+	// routes for the same operations.
+	{
+		Method:  "GET",
+		Id:      "getkeys",
+		Version: 1,
+		Path:    "/v1/keys/",
+		Handler: getKeysHandler,
+		Parameters: []Parameter{
+			RawQueryParameter("queryString"),
+		},
+	},
+	{
+		Method:  "POST",
+		Id:      "postkeys",
+		Version: 1,
+		Path:    "/v1/keys/",
+		Handler: postKeysV1Handler,
+		Parameters: []Parameter{
+			JSONBodyParameter("body"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getkey",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/",
+		Handler: getKeyHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			QueryParameter("status"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Id:      "deletekey",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/",
+		Handler: deleteKeyHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getaccess",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/access/",
+		Handler: getAccessHandler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Id:      "putaccess",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/access/",
+		Handler: putAccessV1Handler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			JSONBodyParameter("body"),
+		},
+	},
+	{
+		Method:  "POST",
+		Id:      "postversion",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/versions/",
+		Handler: postVersionV1Handler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			JSONBodyParameter("body"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Id:      "putversion",
+		Version: 1,
+		Path:    "/v1/keys/{keyID}/versions/{versionID}/",
+		Handler: putVersionV1Handler,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			UrlParameter("versionID"),
+			JSONBodyParameter("body"),
+		},
+	},
 }
 
 // getKeysHandler is a handler that gets key IDs specified in the request.
@@ -147,19 +382,9 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		return nil, errF(knox.NoKeyIDCode, "Missing parameter 'id'")
 	}
 
-	var extraAdmins []knox.Access
-	if !auth.IsUser(principal) {
-		if serviceKeyCreationAuthorizer == nil {
-			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a user to create keys, principal is %s", principal.GetID()))
-		}
-		owner, ok := serviceKeyCreationAuthorizer.Authorize(principal, keyID)
-		if !ok {
-			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not authorized to create keys", principal.GetID()))
-		}
-		if owner.ID == "" {
-			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is authorized but has no owner configured", principal.GetID()))
-		}
-		extraAdmins = append(extraAdmins, owner)
+	extraAdmins, httpErr := authorizeKeyCreation(principal, keyID)
+	if httpErr != nil {
+		return nil, httpErr
 	}
 
 	data, dataOK := parameters["data"]
@@ -184,7 +409,38 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
 	}
 
-	key := newKey(keyID, acl, decodedData, principal, extraAdmins...)
+	key, httpErr := createKey(m, principal, keyID, acl, decodedData, extraAdmins)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return key.VersionList[0].ID, nil
+}
+
+// authorizeKeyCreation checks that principal may create keyID, and returns the
+// admins that must be added to the key besides principal.
+func authorizeKeyCreation(principal knox.Principal, keyID string) ([]knox.Access, *HTTPError) {
+	if auth.IsUser(principal) {
+		return nil, nil
+	}
+	if serviceKeyCreationAuthorizer == nil {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a user to create keys, principal is %s", principal.GetID()))
+	}
+	owner, ok := serviceKeyCreationAuthorizer.Authorize(principal, keyID)
+	if !ok {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not authorized to create keys", principal.GetID()))
+	}
+	if owner.ID == "" {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is authorized but has no owner configured", principal.GetID()))
+	}
+	return []knox.Access{owner}, nil
+}
+
+// createKey stores a new key created by principal.
+func createKey(m KeyManager, principal knox.Principal, keyID string, acl knox.ACL, data []byte, extraAdmins []knox.Access) (*knox.Key, *HTTPError) {
+	if err := acl.Validate(); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	key := newKey(keyID, acl, data, principal, extraAdmins...)
 	err := m.AddNewKey(&key)
 	if err != nil {
 		if err == knox.ErrKeyExists {
@@ -196,7 +452,7 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
-	return key.VersionList[0].ID, nil
+	return &key, nil
 }
 
 // getKeyHandler gets the key matching the keyID in the request.
@@ -224,7 +480,7 @@ func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string
 	}
 
 	// Authorize access to data
-	authorized, authzErr := authorizeRequest(key, principal, knox.Read)
+	authorized, authzErr := authorizeRequest(key, principal, knox.Read, requestOrigin(parameters))
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -253,7 +509,7 @@ func deleteKeyHandler(m KeyManager, principal knox.Principal, parameters map[str
 	}
 
 	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Admin)
+	authorized, authzErr := authorizeRequest(key, principal, knox.Admin, requestOrigin(parameters))
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -262,6 +518,10 @@ func deleteKeyHandler(m KeyManager, principal knox.Principal, parameters map[str
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to delete %s", principal.GetID(), keyID))
 	}
 
+	if requiresApproval(keyID) {
+		return pendingResult(twoPersonApproval.submit(principal, knox.PendingChange{KeyID: keyID, Operation: OperationDeleteKey}))
+	}
+
 	// Delete the key
 	err := m.DeleteKey(keyID)
 	if err != nil {
@@ -291,6 +551,149 @@ func getAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 	return key.ACL, nil
 }
 
+// getEffectiveAccessHandler explains each entry in the ACL of a specific Key,
+// including the known principals matched by prefix entries.
+// The route for this handler is GET /v0/keys/<key_id>/access/effective/
+// There are no authorization constraints on this route, as with getAccessHandler.
+func getEffectiveAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	grants := []knox.EffectiveGrant{}
+	for _, a := range key.ACL {
+		matches, err := expandPrefix(a)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		grants = append(grants, knox.EffectiveGrant{
+			Entry:       a,
+			Description: describeAccess(a),
+			Default:     isDefaultAccess(a),
+			Matches:     matches,
+		})
+	}
+	return grants, nil
+}
+
+// getPrincipalAccessHandler lists every key that a given principal can access
+// through key ACLs, with the entries responsible. Access callbacks are not
+// evaluated, since they may depend on more than the principal and the ACL.
+// The route for this handler is GET /v0/access/?principal=<id>&type=<type>&groups=<g1,g2>
+// The principal needs to be in the audit group.
+func getPrincipalAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if httpErr := authorizeAudit(principal); httpErr != nil {
+		return nil, httpErr
+	}
+	subject, httpErr := principalFromReportParams(parameters["principal"], parameters["type"], parameters["groups"])
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	keys, err := m.GetAllKeyACLs()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	result := []knox.PrincipalKeyAccess{}
+	for i := range keys {
+		if access := principalKeyAccess(&keys[i], subject); access != nil {
+			result = append(result, *access)
+		}
+	}
+	return result, nil
+}
+
+// getAuthorizationHandler explains whether a principal would be granted a type
+// of access to a key, and why, without performing the access. The caller's own
+// principal is evaluated unless another is given in the parameters.
+// The route for this handler is GET /v0/keys/<key_id>/authorization/?access=<access>
+// Any principal may explain its own access. Explaining another principal's
+// access consults the access callback on its behalf, so the caller must have
+// admin access to the key or be in the audit group.
+func getAuthorizationHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+
+	var access knox.AccessType
+	if err := access.UnmarshalJSON([]byte(`"` + parameters["access"] + `"`)); err != nil || access == knox.None {
+		return nil, errF(knox.BadRequestDataCode, "Parameter 'access' must be one of Read, Write or Admin")
+	}
+
+	subject := principal
+	_, otherPrincipal := parameters["principal"]
+	if otherPrincipal {
+		var httpErr *HTTPError
+		subject, httpErr = principalFromReportParams(parameters["principal"], parameters["type"], parameters["groups"])
+		if httpErr != nil {
+			return nil, httpErr
+		}
+	}
+
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	if otherPrincipal && authorizeAudit(principal) != nil {
+		authorized, authzErr := authorizeRequest(key, principal, knox.Admin, requestOrigin(parameters))
+		if authzErr != nil {
+			return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+		}
+		if !authorized {
+			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to explain other principals' access to %s", principal.GetID(), keyID))
+		}
+	}
+
+	origin := requestOrigin(parameters)
+	if o, ok := parameters["origin"]; ok {
+		if origin = net.ParseIP(o); origin == nil {
+			return nil, errF(knox.BadRequestDataCode, "Parameter 'origin' must be an IP address")
+		}
+	}
+
+	return explainRequest(key, subject, access, origin), nil
+}
+
+// getOrphanedKeysHandler reports keys that no user or user group can administer.
+// The route for this handler is GET /v0/audit/orphanedkeys/
+// The principal needs to be in the audit group.
+func getOrphanedKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if httpErr := authorizeAudit(principal); httpErr != nil {
+		return nil, httpErr
+	}
+	orphans, err := findOrphanedKeys(m)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return orphans, nil
+}
+
+// getMachinePrefixAuditHandler reports MachinePrefix entries on any key that
+// match hosts from the principal inventory in the middle of a name.
+// The route for this handler is GET /v0/audit/machineprefixes/
+// The principal needs to be in the audit group.
+func getMachinePrefixAuditHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if httpErr := authorizeAudit(principal); httpErr != nil {
+		return nil, httpErr
+	}
+	if principalInventory == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Machine prefix audit requires a principal inventory")
+	}
+	findings, err := auditMachinePrefixes(m)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return findings, nil
+}
+
 // putAccessHandler adds or updates the existing ACL with an Access object
 // This object is input as base64 encoded json encoded form data
 // access is used for a single access rule and acl is used for multiple rules
@@ -328,6 +731,21 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 		return nil, errF(knox.BadRequestDataCode, "Missing acl and access parameters")
 	}
 
+	return pendingResult(updateAccess(m, principal, keyID, acl, requestOrigin(parameters)))
+}
+
+// updateAccess applies the changes in acl to the ACL of keyID on behalf of
+// principal, or submits them for approval if the key requires it.
+func updateAccess(m KeyManager, principal knox.Principal, keyID string, acl knox.ACL, origin net.IP) (*knox.PendingChange, *HTTPError) {
+	// Only networks are validated here. Changes are applied one entry at a
+	// time, so the duplicates and None entries that ACL.Validate refuses
+	// remain allowed, as they always have been.
+	for _, a := range acl {
+		if err := a.Networks.Validate(); err != nil {
+			return nil, errF(knox.BadRequestDataCode, err.Error())
+		}
+	}
+
 	// Get the Key
 	key, getErr := m.GetKey(keyID, knox.Primary)
 	if getErr != nil {
@@ -338,7 +756,7 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 	}
 
 	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Admin)
+	authorized, authzErr := authorizeRequest(key, principal, knox.Admin, origin)
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -347,6 +765,12 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update access for %s", principal.GetID(), keyID))
 	}
 
+	if serviceDelegation != nil {
+		if httpErr := serviceDelegation.check(principal, acl); httpErr != nil {
+			return nil, httpErr
+		}
+	}
+
 	for _, access := range acl {
 		// If access type change is not "None" (i.e. we're adding, not deleting, an ACL entry) then
 		// we apply validation on the ID string to make sure it conforms to the expectations of the
@@ -360,6 +784,14 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 		}
 	}
 
+	if httpErr := checkHumanAdmin(key, acl, principal); httpErr != nil {
+		return nil, httpErr
+	}
+
+	if requiresApproval(keyID) {
+		return twoPersonApproval.submit(principal, knox.PendingChange{KeyID: keyID, Operation: OperationPutAccess, ACL: acl})
+	}
+
 	// Update Access
 	updateErr := m.UpdateAccess(keyID, acl...)
 	if updateErr != nil {
@@ -390,6 +822,15 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 		return nil, errF(knox.BadRequestDataCode, "Parameter 'data' decoded to nil")
 	}
 
+	version, httpErr := addVersion(m, principal, keyID, decodedData, requestOrigin(parameters))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return version.ID, nil
+}
+
+// addVersion adds data to keyID as a new Active version on behalf of principal.
+func addVersion(m KeyManager, principal knox.Principal, keyID string, data []byte, origin net.IP) (*knox.KeyVersion, *HTTPError) {
 	// Get the key
 	key, getErr := m.GetKey(keyID, knox.Inactive)
 	if getErr != nil {
@@ -400,7 +841,7 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 	}
 
 	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Write)
+	authorized, authzErr := authorizeRequest(key, principal, knox.Write, origin)
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -410,14 +851,14 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 	}
 
 	// Create and add the new version
-	version := newKeyVersion(decodedData, knox.Active)
+	version := newKeyVersion(data, knox.Active)
 
 	err := m.AddVersion(keyID, &version)
 
 	if err != nil {
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
-	return version.ID, nil
+	return &version, nil
 }
 
 // putVersionsHandler rotates key versions by changing the version status.
@@ -452,6 +893,12 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 		return nil, errF(knox.BadRequestDataCode, intErr.Error())
 	}
 
+	return pendingResult(updateVersion(m, principal, keyID, id, status, requestOrigin(parameters)))
+}
+
+// updateVersion changes the status of a version of keyID on behalf of
+// principal, or submits the change for approval if the key requires it.
+func updateVersion(m KeyManager, principal knox.Principal, keyID string, id uint64, status knox.VersionStatus, origin net.IP) (*knox.PendingChange, *HTTPError) {
 	// Get the key
 	key, getErr := m.GetKey(keyID, knox.Inactive)
 	if getErr != nil {
@@ -462,7 +909,7 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 	}
 
 	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Write)
+	authorized, authzErr := authorizeRequest(key, principal, knox.Write, origin)
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -471,21 +918,177 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to write %s", principal.GetID(), keyID))
 	}
 
-	err := m.UpdateVersion(keyID, id, status)
+	if requiresApproval(keyID) {
+		return twoPersonApproval.submit(principal, knox.PendingChange{KeyID: keyID, Operation: OperationPutVersion, VersionID: id, Status: &status})
+	}
+
+	return nil, updateVersionErr(m.UpdateVersion(keyID, id, status))
+}
 
+// updateVersionErr maps errors from KeyManager.UpdateVersion to HTTP errors.
+func updateVersionErr(err error) *HTTPError {
 	switch err {
 	case nil:
-		return nil, nil
+		return nil
 	case knox.ErrKeyVersionNotFound:
-		return nil, errF(knox.KeyVersionDoesNotExistCode, err.Error())
+		return errF(knox.KeyVersionDoesNotExistCode, err.Error())
 	case knox.ErrPrimaryToInactive, knox.ErrPrimaryToActive, knox.ErrInactiveToPrimary:
-		return nil, errF(knox.BadRequestDataCode, err.Error())
+		return errF(knox.BadRequestDataCode, err.Error())
 	default:
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+}
+
+// postBreakGlassHandler grants the principal short-lived read access to a key
+// it is not otherwise authorized for. A justification is required and every
+// grant is logged for review.
+// The route for this handler is POST /v0/keys/<key_id>/breakglass/
+// The principal must be a member of a configured break-glass group.
+func postBreakGlassHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if breakGlass == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Break-glass access is not enabled")
+	}
+
+	keyID := parameters["keyID"]
+	justification, justificationOK := parameters["justification"]
+	if !justificationOK || strings.TrimSpace(justification) == "" {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'justification'")
+	}
+
+	// Make sure the key exists before granting anything on it.
+	_, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	grant, err := breakGlass.Grant(principal, keyID, justification)
+	if err != nil {
+		return nil, errF(knox.UnauthorizedCode, err.Error())
+	}
+	return grant, nil
+}
+
+// getPendingChangesHandler lists the changes awaiting approval.
+// The route for this handler is GET /v0/pending/
+// There are no authorization constraints on this route, in the same way that
+// key ACLs are readable by anyone.
+func getPendingChangesHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if twoPersonApproval == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Two-person approval is not enabled")
+	}
+	changes, err := twoPersonApproval.list()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return changes, nil
+}
+
+// approvePendingChangeHandler applies a pending change.
+// The route for this handler is POST /v0/pending/<change_id>/approve/
+// The principal needs Admin access to the key, even for version changes, and
+// must not share an identity with the principal that requested it.
+func approvePendingChangeHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	change, httpErr := getPendingChangeForReview(m, principal, parameters["changeID"], requestOrigin(parameters))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if isRequester(principal, change) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s requested change %s and cannot approve it", principal.GetID(), change.ID))
+	}
+	if change.Operation == OperationPutAccess {
+		// The ACL may have changed since the request was made.
+		key, getErr := m.GetKey(change.KeyID, knox.Primary)
+		if getErr != nil {
+			return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+		}
+		if httpErr := checkHumanAdmin(key, change.ACL, principal); httpErr != nil {
+			return nil, httpErr
+		}
+	}
+
+	// Removing first ensures concurrent approvals apply the change only once.
+	if err := twoPersonApproval.store.Remove(change.ID); err != nil {
+		if err == ErrPendingChangeNotFound {
+			return nil, errF(knox.PendingChangeDoesNotExistCode, fmt.Sprintf("No such pending change %s", change.ID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	if httpErr := applyPendingChange(m, change); httpErr != nil {
+		return nil, httpErr
+	}
+	return nil, nil
+}
+
+// rejectPendingChangeHandler discards a pending change.
+// The route for this handler is POST /v0/pending/<change_id>/reject/
+// The principal needs Admin access to the key. Requesters may reject
+// (withdraw) their own changes.
+func rejectPendingChangeHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	change, httpErr := getPendingChangeForReview(m, principal, parameters["changeID"], requestOrigin(parameters))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if err := twoPersonApproval.store.Remove(change.ID); err != nil {
+		if err == ErrPendingChangeNotFound {
+			return nil, errF(knox.PendingChangeDoesNotExistCode, fmt.Sprintf("No such pending change %s", change.ID))
+		}
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
+	return nil, nil
 }
 
-func authorizeRequest(key *knox.Key, principal knox.Principal, access knox.AccessType) (allow bool, err error) {
+// getPendingChangeForReview loads a pending change and checks that principal
+// has Admin access to its key, whatever the operation.
+func getPendingChangeForReview(m KeyManager, principal knox.Principal, changeID string, origin net.IP) (*knox.PendingChange, *HTTPError) {
+	if twoPersonApproval == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Two-person approval is not enabled")
+	}
+	change, err := twoPersonApproval.get(changeID)
+	if err != nil {
+		if err == ErrPendingChangeNotFound {
+			return nil, errF(knox.PendingChangeDoesNotExistCode, fmt.Sprintf("No such pending change %s", changeID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+
+	key, getErr := m.GetKey(change.KeyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", change.KeyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	authorized, authzErr := authorizeRequest(key, principal, knox.Admin, origin)
+	if authzErr != nil {
+		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+	}
+	if !authorized {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to review changes to %s", principal.GetID(), change.KeyID))
+	}
+	return change, nil
+}
+
+func authorizeRequest(key *knox.Key, principal knox.Principal, access knox.AccessType, origin net.IP) (allow bool, err error) {
+	allow = principal.CanAccess(key.ACL.ForOrigin(origin), access)
+
+	if !allow {
+		allow, err = runAccessCallback(key, principal, access)
+	}
+
+	if !allow && err == nil && access == knox.Read && breakGlass != nil {
+		allow = breakGlass.allows(key.ID, principal)
+	}
+
+	return
+}
+
+// runAccessCallback consults the access callback, if one is set, recovering
+// from any panic inside it.
+func runAccessCallback(key *knox.Key, principal knox.Principal, access knox.AccessType) (allow bool, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("recovered from panic in access callback: %v", r)
@@ -494,15 +1097,236 @@ func authorizeRequest(key *knox.Key, principal knox.Principal, access knox.Acces
 		}
 	}()
 
-	allow = principal.CanAccess(key.ACL, access)
+	if accessCallback == nil {
+		return false, nil
+	}
+	return accessCallback(knox.AccessCallbackInput{
+		Key:        *key,
+		Principals: principal.Raw(),
+		AccessType: access,
+	})
+}
 
-	if !allow && accessCallback != nil {
-		allow, err = accessCallback(knox.AccessCallbackInput{
-			Key:        *key,
-			Principals: principal.Raw(),
-			AccessType: access,
-		})
+// postAPIKeyHandler issues a new API key. The optional ttl is a duration such
+// as "720h"; keys without one never expire.
+// It returns the key's details, including the token, which is not stored.
+// The route for this handler is POST /v0/apikeys/
+// The principal must be a user in the owning team.
+func postAPIKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if apiKeyStore == nil {
+		return nil, errF(knox.NotYetImplementedCode, "API keys are not enabled")
+	}
+	var ttl time.Duration
+	if s := parameters["ttl"]; s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 {
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid ttl %q", s))
+		}
+	}
+	key, httpErr := createAPIKey(principal, parameters["name"], parameters["team"], ttl, time.Now())
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return key, nil
+}
+
+// getAPIKeysHandler lists the API keys of the principal's teams, or of one
+// team if the team parameter is set. Tokens are never returned.
+// The route for this handler is GET /v0/apikeys/
+func getAPIKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if apiKeyStore == nil {
+		return nil, errF(knox.NotYetImplementedCode, "API keys are not enabled")
+	}
+	keys, err := listAPIKeys(principal, parameters["team"])
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
+	return keys, nil
+}
 
-	return
+// deleteAPIKeyHandler revokes an API key, which stops authenticating at once.
+// The route for this handler is DELETE /v0/apikeys/<api_key_id>/
+// The principal must be a user in the owning team.
+func deleteAPIKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if apiKeyStore == nil {
+		return nil, errF(knox.NotYetImplementedCode, "API keys are not enabled")
+	}
+	if httpErr := revokeAPIKey(principal, parameters["apiKeyID"]); httpErr != nil {
+		return nil, httpErr
+	}
+	return nil, nil
+}
+
+// postSessionHandler exchanges the caller's credentials for a short-lived
+// session token carrying the principals they authenticated as.
+// The route for this handler is POST /v0/sessions/
+// Any principal may get a session, except with a session token, which would
+// let sessions be extended indefinitely.
+func postSessionHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if sessionTokens == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Session tokens are not enabled")
+	}
+	if fromSession(principal) {
+		return nil, errF(knox.UnauthorizedCode, "Session tokens cannot be exchanged for new sessions")
+	}
+	token, err := sessionTokens.Issue(principal)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return token, nil
+}
+
+// deleteSessionHandler revokes a session token by its ID.
+// The route for this handler is DELETE /v0/sessions/<session_id>/
+// Session IDs are random and only known to the token's holder, so any
+// principal may revoke a session given its ID.
+func deleteSessionHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if sessionTokens == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Session tokens are not enabled")
+	}
+	if err := sessionTokens.Revoke(parameters["sessionID"]); err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return nil, nil
+}
+
+// postTOTPHandler replaces the TOTP second factor of the calling user.
+// The route for this handler is POST /v0/totp/
+// Only users may enroll, and only with a code from their current second
+// factor; the first one is enrolled by an administrator.
+func postTOTPHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if stepUp == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Step-up authentication is not enabled")
+	}
+	if !auth.IsUser(principal) {
+		return nil, errF(knox.UnauthorizedCode, "Only users may enroll a second factor")
+	}
+	enrollment, err := stepUp.Enroll(principal.GetID())
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return enrollment, nil
+}
+
+// postUserTOTPHandler enrolls a new TOTP second factor for another user, for
+// an administrator to hand over to them.
+// The route for this handler is POST /v0/totp/<user_id>/
+// The principal must be a user in the step-up admin group, and presents a
+// code from their own second factor.
+func postUserTOTPHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	if stepUp == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Step-up authentication is not enabled")
+	}
+	if stepUp.adminGroup == "" || !auth.IsUser(principal) || !inTeam(principal, stepUp.adminGroup) {
+		return nil, errF(knox.UnauthorizedCode, "Only step-up administrators may enroll second factors for other users")
+	}
+	userID := parameters["userID"]
+	if userID == principal.GetID() {
+		return nil, errF(knox.UnauthorizedCode, "Administrators cannot enroll their own second factor")
+	}
+	if err := knox.PrincipalType(knox.User).IsValidPrincipal(userID, extraPrincipalValidators); err != nil {
+		return nil, errF(knox.BadPrincipalIdentifier, err.Error())
+	}
+	enrollment, err := stepUp.Enroll(userID)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return enrollment, nil
+}
+
+// postKeysV1Handler creates a new key from a knox.KeyCreateRequest body.
+// It returns the created key without its version data.
+// The route for this handler is POST /v1/keys/
+// Authorization is as for postKeysHandler.
+func postKeysV1Handler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	var req knox.KeyCreateRequest
+	if httpErr := decodeJSONBody(parameters, "body", &req); httpErr != nil {
+		return nil, httpErr
+	}
+	if req.ID == "" {
+		return nil, errF(knox.NoKeyIDCode, "Missing field 'id'")
+	}
+	extraAdmins, httpErr := authorizeKeyCreation(principal, req.ID)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if len(req.Data) == 0 {
+		return nil, errF(knox.NoKeyDataCode, "Missing field 'data'")
+	}
+	if req.ACL == nil {
+		req.ACL = knox.ACL{}
+	}
+	key, httpErr := createKey(m, principal, req.ID, req.ACL, req.Data, extraAdmins)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	key.VersionList = withoutData(key.VersionList)
+	return key, nil
+}
+
+// withoutData returns copies of versions with their data removed, so that
+// responses describing new versions never carry secrets.
+func withoutData(versions knox.KeyVersionList) knox.KeyVersionList {
+	stripped := make(knox.KeyVersionList, len(versions))
+	for i, v := range versions {
+		v.Data = nil
+		stripped[i] = v
+	}
+	return stripped
+}
+
+// putAccessV1Handler applies the ACL entries in the request body, a JSON
+// array of knox.Access, to the ACL of a key. As with putAccessHandler,
+// existing entries are only changed by entries with the same Type and ID.
+// The route for this handler is PUT /v1/keys/<key_id>/access/
+// The principal needs Admin access.
+func putAccessV1Handler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	var acl knox.ACL
+	if httpErr := decodeJSONBody(parameters, "body", &acl); httpErr != nil {
+		return nil, httpErr
+	}
+	if len(acl) == 0 {
+		return nil, errF(knox.BadRequestDataCode, "No access entries given")
+	}
+	return pendingResult(updateAccess(m, principal, parameters["keyID"], acl, requestOrigin(parameters)))
+}
+
+// postVersionV1Handler adds a new Active key version from a
+// knox.VersionCreateRequest body. It returns the created version without its
+// data.
+// The route for this handler is POST /v1/keys/<key_id>/versions/
+// The principal needs Write access.
+func postVersionV1Handler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	var req knox.VersionCreateRequest
+	if httpErr := decodeJSONBody(parameters, "body", &req); httpErr != nil {
+		return nil, httpErr
+	}
+	if len(req.Data) == 0 {
+		return nil, errF(knox.NoKeyDataCode, "Missing field 'data'")
+	}
+	version, httpErr := addVersion(m, principal, parameters["keyID"], req.Data, requestOrigin(parameters))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return &withoutData(knox.KeyVersionList{*version})[0], nil
+}
+
+// putVersionV1Handler changes the status of a key version from a
+// knox.VersionUpdateRequest body, with the rules of putVersionsHandler.
+// The route for this handler is PUT /v1/keys/<key_id>/versions/<version_id>/
+// The principal needs Write access.
+func putVersionV1Handler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	id, intErr := strconv.ParseUint(parameters["versionID"], 10, 64)
+	if intErr != nil {
+		return nil, errF(knox.BadRequestDataCode, intErr.Error())
+	}
+	var req knox.VersionUpdateRequest
+	if httpErr := decodeJSONBody(parameters, "body", &req); httpErr != nil {
+		return nil, httpErr
+	}
+	if req.Status == nil {
+		return nil, errF(knox.BadRequestDataCode, "Missing field 'status'")
+	}
+	return pendingResult(updateVersion(m, principal, parameters["keyID"], id, *req.Status, requestOrigin(parameters)))
 }
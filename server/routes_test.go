@@ -784,7 +784,7 @@ func TestAuthorizeRequest(t *testing.T) {
 			defer SetAccessCallback(nil)
 
 			SetAccessCallback(tc.CallBackImpl)
-			authorized, err := authorizeRequest(tc.Input.Key, tc.Input.Principal, tc.Input.AccessType)
+			authorized, err := authorizeRequest(tc.Input.Key, tc.Input.Principal, tc.Input.AccessType, nil)
 			if err != nil {
 				if err.Error() == tc.ExpectedError.Error() {
 					if authorized != tc.ExpectedAuthorized {
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// sessionTokens issues Knox session tokens. When nil (the default), the
+// session routes are disabled. The same SessionTokens must be given to
+// auth.NewSessionTokenProvider for the tokens to authenticate.
+var sessionTokens *auth.SessionTokens
+
+// SetSessionTokens enables issuing session tokens. Pass nil to disable it.
+func SetSessionTokens(s *auth.SessionTokens) {
+	sessionTokens = s
+}
+
+// fromSession reports whether principal was authenticated by a session token,
+// based on the provider names recorded by the Authentication decorator.
+func fromSession(principal knox.Principal) bool {
+	mux, ok := principal.(knox.PrincipalMux)
+	if !ok {
+		return false
+	}
+	for name := range mux.PrincipalsByProvider() {
+		if name == auth.SessionProviderName || strings.HasPrefix(name, auth.SessionProviderName+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestSessionTokens(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.NewSessionTokens(auth.SessionTokenConfig{
+		Keys:        []auth.SessionSigningKey{{ID: "k1", Key: key}},
+		Revocations: auth.NewTempSessionRevocationStore(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSessionTokens(tokens)
+	defer SetSessionTokens(nil)
+
+	m, _ := makeDB()
+	alice := auth.NewUser("alice", []string{"admins"})
+	original := knox.NewPrincipalMux(alice, map[string]knox.Principal{
+		"github": alice,
+		"mtls":   auth.NewMachine("laptop01"),
+	})
+	i, httpErr := postSessionHandler(m, original, nil)
+	if httpErr != nil {
+		t.Fatalf("%+v is not nil", httpErr)
+	}
+	session := i.(*knox.SessionToken)
+
+	// authenticate runs a request with the session token through the
+	// Authentication decorator and returns the resulting principal.
+	authenticate := func() (knox.Principal, int) {
+		var principal knox.Principal
+		h := Authentication([]auth.Provider{auth.NewSessionTokenProvider(tokens)}, nil)(func(w http.ResponseWriter, r *http.Request) {
+			principal = GetPrincipal(r)
+		})
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "0x"+session.Token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return principal, w.Code
+	}
+
+	principal, _ := authenticate()
+	if principal == nil {
+		t.Fatal("expected session token to authenticate")
+	}
+	if principal.GetID() != "alice" || !auth.IsUser(principal) || !auth.IsMachine(principal) {
+		t.Fatalf("unexpected principal %v", principal.Raw())
+	}
+	byProvider := principal.(knox.PrincipalMux).PrincipalsByProvider()
+	if _, ok := byProvider["session/github"]; !ok {
+		t.Fatalf("expected original provider names to be kept, got %v", byProvider)
+	}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "admins", AccessType: knox.Read}}
+	if !principal.CanAccess(acl, knox.Read) {
+		t.Fatal("expected user groups to be carried in the session")
+	}
+
+	// Sessions cannot be used to extend themselves.
+	if _, httpErr := postSessionHandler(m, principal, nil); httpErr == nil || httpErr.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected unauthorized, got %+v", httpErr)
+	}
+
+	if _, httpErr := deleteSessionHandler(m, principal, map[string]string{"sessionID": session.ID}); httpErr != nil {
+		t.Fatalf("%+v is not nil", httpErr)
+	}
+	if p, code := authenticate(); p != nil || code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked session to be rejected, got %v %d", p, code)
+	}
+}
+
+func TestSessionTokensDisabled(t *testing.T) {
+	m, _ := makeDB()
+	if _, err := postSessionHandler(m, auth.NewUser("alice", nil), nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented, got %+v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+const (
+	// totpPeriod and totpDigits follow the RFC 6238 defaults used by
+	// authenticator apps.
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is the number of periods either side of now that are accepted.
+	totpSkew = 1
+	// totpSecretSize is the length of generated secrets, as RFC 4226 recommends.
+	totpSecretSize = 20
+
+	// maxStepUpFailures wrong codes in a row lock a user's second factor for
+	// stepUpLockout, so that codes cannot be guessed.
+	maxStepUpFailures = 5
+	stepUpLockout     = 5 * time.Minute
+)
+
+// enrollTOTPRouteID is the route that replaces a user's own second factor,
+// which always requires the current one. enrollUserTOTPRouteID is the route
+// through which step-up administrators enroll a second factor for another
+// user, which always requires the administrator's own.
+const (
+	enrollTOTPRouteID     = "posttotp"
+	enrollUserTOTPRouteID = "postusertotp"
+)
+
+// ErrTOTPNotEnrolled is returned by a TOTPStore for users without a secret.
+var ErrTOTPNotEnrolled = fmt.Errorf("No second factor enrolled")
+
+// TOTPStore persists the TOTP secrets users have enrolled, by user ID.
+//
+// Get must fail with ErrTOTPNotEnrolled if the user has not enrolled.
+//
+// Knox does not include a persistent TOTPStore; deployments should implement
+// one on replicated storage that encrypts the secrets. Losing enrollments is
+// safe but disruptive: users without a second factor cannot perform the
+// operations that require one until an administrator enrolls them again.
+type TOTPStore interface {
+	Get(userID string) ([]byte, error)
+	Set(userID string, secret []byte) error
+}
+
+// NewTempTOTPStore creates an in memory TOTPStore. Like keydb.TempDB it does
+// no replication across servers and is meant for tests and development. All
+// enrollments are lost when the server restarts.
+func NewTempTOTPStore() TOTPStore {
+	return &tempTOTPStore{secrets: map[string][]byte{}}
+}
+
+type tempTOTPStore struct {
+	sync.Mutex
+	secrets map[string][]byte
+}
+
+func (s *tempTOTPStore) Get(userID string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	secret, ok := s.secrets[userID]
+	if !ok {
+		return nil, ErrTOTPNotEnrolled
+	}
+	return secret, nil
+}
+
+func (s *tempTOTPStore) Set(userID string, secret []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.secrets[userID] = secret
+	return nil
+}
+
+// StepUpRule requires a fresh second factor for a route, optionally only for
+// keys with a label (see AddKeyLabel) and, for the putversion route, only for
+// changes to a version status, such as promotions to knox.Primary.
+type StepUpRule struct {
+	RouteID string
+	Label   string
+	Status  *knox.VersionStatus
+}
+
+// StepUpConfig configures step-up authentication.
+type StepUpConfig struct {
+	// Store holds enrolled TOTP secrets. Required.
+	Store TOTPStore
+
+	// Rules select the operations that require a second factor, such as
+	// {RouteID: "deletekey"} or {RouteID: "putaccess", Label: SensitiveLabel}.
+	Rules []StepUpRule
+
+	// AdminGroup is the user group whose members enroll second factors for
+	// other users. Users cannot enroll their first second factor themselves,
+	// so that a stolen token cannot be used to enroll one.
+	AdminGroup string
+
+	// Issuer names Knox in authenticator apps. Defaults to "Knox".
+	Issuer string
+}
+
+// StepUp requires users to present a current TOTP code, in StepUpHeader, for
+// the operations selected by its rules. Only users are affected, as machines
+// and services cannot hold a second factor; the threat addressed is a stolen
+// user token.
+type StepUp struct {
+	store      TOTPStore
+	rules      []StepUpRule
+	adminGroup string
+	issuer     string
+	time       func() time.Time
+
+	mu       sync.Mutex
+	lastStep map[string]int64
+	failures map[string]*failureRecord
+}
+
+// NewStepUp builds a StepUp from the given configuration.
+func NewStepUp(cfg StepUpConfig) (*StepUp, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("step-up authentication requires a TOTP store")
+	}
+	issuer := cfg.Issuer
+	if issuer == "" {
+		issuer = "Knox"
+	}
+	return &StepUp{
+		store:      cfg.Store,
+		rules:      cfg.Rules,
+		adminGroup: cfg.AdminGroup,
+		issuer:     issuer,
+		time:       time.Now,
+		lastStep:   map[string]int64{},
+		failures:   map[string]*failureRecord{},
+	}, nil
+}
+
+// stepUp is consulted for every route when set. When nil (the default), no
+// second factor is required and enrollment is unavailable.
+var stepUp *StepUp
+
+// SetStepUp enables step-up authentication. Pass nil to disable it.
+func SetStepUp(s *StepUp) {
+	stepUp = s
+}
+
+// checkStepUp returns an error unless the request may proceed without, or
+// carries a valid, second factor.
+func checkStepUp(routeID string, principal knox.Principal, parameters map[string]string, code string) *HTTPError {
+	if stepUp == nil || principal == nil || !auth.IsUser(principal) {
+		return nil
+	}
+	userID := principal.GetID()
+	if !stepUp.required(routeID, parameters) {
+		return nil
+	}
+	if code == "" {
+		return errF(knox.StepUpRequiredCode, fmt.Sprintf("This operation requires a code from your second factor in the %s header", knox.StepUpHeader))
+	}
+	return stepUp.verify(userID, code)
+}
+
+// required reports whether a request to routeID with parameters needs a
+// second factor.
+func (s *StepUp) required(routeID string, parameters map[string]string) bool {
+	if routeID == enrollTOTPRouteID || routeID == enrollUserTOTPRouteID {
+		return true
+	}
+	keyID := parameters["keyID"]
+	for _, r := range s.rules {
+		if r.RouteID != routeID {
+			continue
+		}
+		if r.Label != "" && (keyID == "" || !keyHasLabel(keyID, r.Label)) {
+			continue
+		}
+		if r.Status != nil {
+			// Requests whose status cannot be read are refused by the route.
+			if status, ok := requestedStatus(parameters); ok && status != *r.Status {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// requestedStatus returns the version status a putversion request asks for,
+// from the form parameter of v0 or the JSON body of v1.
+func requestedStatus(parameters map[string]string) (knox.VersionStatus, bool) {
+	var status knox.VersionStatus
+	if s, ok := parameters["status"]; ok {
+		return status, status.UnmarshalJSON([]byte(s)) == nil
+	}
+	var req knox.VersionUpdateRequest
+	if decodeJSONBody(parameters, "body", &req) != nil || req.Status == nil {
+		return status, false
+	}
+	return *req.Status, true
+}
+
+// verify checks code against the user's enrolled secret. Each code is
+// accepted once.
+func (s *StepUp) verify(userID, code string) *HTTPError {
+	secret, err := s.store.Get(userID)
+	if err == ErrTOTPNotEnrolled {
+		return errF(knox.UnauthorizedCode, "This operation requires a second factor; ask an administrator to enroll one for you")
+	}
+	if err != nil {
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+
+	now := s.time()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.failures[userID]; ok && now.Before(rec.lockedUntil) {
+		return errF(knox.TooManyRequestsCode, "Too many wrong second factor codes, retry later")
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if step <= s.lastStep[userID] {
+			return errF(knox.UnauthorizedCode, "Second factor code has already been used")
+		}
+		s.lastStep[userID] = step
+		delete(s.failures, userID)
+		return nil
+	}
+	rec, ok := s.failures[userID]
+	if !ok {
+		rec = &failureRecord{}
+		s.failures[userID] = rec
+	}
+	rec.failures++
+	rec.last = now
+	if rec.failures >= maxStepUpFailures {
+		rec.failures = 0
+		rec.lockedUntil = now.Add(stepUpLockout)
+	}
+	return errF(knox.UnauthorizedCode, "Invalid second factor code")
+}
+
+// Enroll generates and stores a new secret for userID. It is meant for
+// bootstrapping the first administrators, who have nobody to enroll them;
+// other enrollments go through the Knox API.
+func (s *StepUp) Enroll(userID string) (*knox.TOTPEnrollment, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := s.store.Set(userID, secret); err != nil {
+		return nil, err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	v := url.Values{}
+	v.Set("secret", encoded)
+	v.Set("issuer", s.issuer)
+	v.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + s.issuer + ":" + userID,
+		RawQuery: v.Encode(),
+	}
+	return &knox.TOTPEnrollment{Secret: encoded, URI: uri.String()}, nil
+}
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
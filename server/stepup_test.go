@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for step, code := range map[int64]string{1: "287082", 37037036: "081804", 41152263: "005924"} {
+		if got := totpCode(secret, step); got != code {
+			t.Errorf("step %d: expected %s, got %s", step, code, got)
+		}
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	primary := knox.Primary
+	s, err := NewStepUp(StepUpConfig{
+		Store: NewTempTOTPStore(),
+		Rules: []StepUpRule{
+			{RouteID: "deletekey"},
+			{RouteID: "putaccess", Label: SensitiveLabel},
+			{RouteID: "putversion", Status: &primary},
+		},
+		AdminGroup: "security",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.time = func() time.Time { return now }
+	SetStepUp(s)
+	AddKeyLabel("prod_", SensitiveLabel)
+	defer func() {
+		SetStepUp(nil)
+		keyLabelRules = nil
+	}()
+
+	alice := auth.NewUser("alice", nil)
+	machine := auth.NewMachine("host01")
+	check := func(route, keyID string, p knox.Principal, code string) *HTTPError {
+		return checkStepUp(route, p, map[string]string{"keyID": keyID}, code)
+	}
+	checkStatus := func(status string, parameters map[string]string) *HTTPError {
+		parameters["keyID"] = "dev_db"
+		return checkStepUp("putversion", alice, parameters, "")
+	}
+
+	// Only the configured routes and labels are affected, and only for users.
+	for _, c := range []struct{ route, keyID string }{
+		{"getkey", "prod_db"},
+		{"putaccess", "dev_db"},
+		{"postversion", "prod_db"},
+	} {
+		if err := check(c.route, c.keyID, alice, ""); err != nil {
+			t.Errorf("%s %s: unexpected %+v", c.route, c.keyID, err)
+		}
+	}
+	if err := check("deletekey", "dev_db", machine, ""); err != nil {
+		t.Fatalf("expected machines not to need a second factor, got %+v", err)
+	}
+	if err := check("putaccess", "prod_db", alice, ""); err == nil || err.Subcode != knox.StepUpRequiredCode {
+		t.Fatalf("expected step-up to be required, got %+v", err)
+	}
+	if err := check("deletekey", "dev_db", alice, "123456"); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected users without a second factor to be refused, got %+v", err)
+	}
+
+	// Status rules match the requested status in either API version.
+	if err := checkStatus("Active", map[string]string{"status": `"Active"`}); err != nil {
+		t.Fatalf("expected demotions not to need a second factor, got %+v", err)
+	}
+	if err := checkStatus("Inactive", map[string]string{"body": `{"status": "Inactive"}`}); err != nil {
+		t.Fatalf("expected demotions not to need a second factor, got %+v", err)
+	}
+	for _, parameters := range []map[string]string{{"status": `"Primary"`}, {"body": `{"status": "Primary"}`}, {"status": "bogus"}} {
+		if err := checkStatus("Primary", parameters); err == nil || err.Subcode != knox.StepUpRequiredCode {
+			t.Fatalf("%v: expected step-up to be required, got %+v", parameters, err)
+		}
+	}
+
+	// Users cannot enroll their first second factor themselves.
+	if err := check(enrollTOTPRouteID, "", alice, ""); err == nil || err.Subcode != knox.StepUpRequiredCode {
+		t.Fatalf("expected step-up to be required to enroll, got %+v", err)
+	}
+	if err := check(enrollTOTPRouteID, "", alice, "123456"); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected self enrollment to be refused, got %+v", err)
+	}
+
+	m, _ := makeDB()
+	admin := auth.NewUser("carol", []string{"security"})
+	if _, err := postUserTOTPHandler(m, alice, map[string]string{"userID": "bob"}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected non-administrators to be refused, got %+v", err)
+	}
+	if _, err := postUserTOTPHandler(m, admin, map[string]string{"userID": "carol"}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected administrators not to enroll themselves, got %+v", err)
+	}
+	if err := check(enrollUserTOTPRouteID, "", admin, ""); err == nil || err.Subcode != knox.StepUpRequiredCode {
+		t.Fatalf("expected administrators to need their own second factor, got %+v", err)
+	}
+	i, httpErr := postUserTOTPHandler(m, admin, map[string]string{"userID": "alice"})
+	if httpErr != nil {
+		t.Fatalf("%+v is not nil", httpErr)
+	}
+	enrollment := i.(*knox.TOTPEnrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Knox:alice?") {
+		t.Fatalf("unexpected URI %s", enrollment.URI)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(at time.Time) string {
+		return totpCode(secret, at.Unix()/30)
+	}
+
+	if err := check("deletekey", "dev_db", alice, "000000"); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected a wrong code to be refused, got %+v", err)
+	}
+	if err := check("deletekey", "dev_db", alice, code(now)); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if err := check("deletekey", "dev_db", alice, code(now)); err == nil {
+		t.Fatal("expected a used code to be refused")
+	}
+	now = now.Add(30 * time.Second)
+	if err := check("deletekey", "dev_db", alice, code(now.Add(30*time.Second))); err != nil {
+		t.Fatalf("expected the next code to be accepted for clock skew, got %+v", err)
+	}
+
+	// Replacing the second factor requires the current one.
+	now = now.Add(time.Minute)
+	if err := check(enrollTOTPRouteID, "", alice, code(now)); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postTOTPHandler(m, alice, nil); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if err := check("deletekey", "dev_db", alice, code(now.Add(30*time.Second))); err == nil {
+		t.Fatal("expected the replaced second factor to be refused")
+	}
+	enrollment, _ = s.Enroll("alice")
+	secret, _ = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+
+	// Repeated wrong codes lock the second factor.
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < maxStepUpFailures; i++ {
+		check("deletekey", "dev_db", alice, "000000")
+	}
+	if err := check("deletekey", "dev_db", alice, code(now)); err == nil || err.Subcode != knox.TooManyRequestsCode {
+		t.Fatalf("expected lockout, got %+v", err)
+	}
+	now = now.Add(stepUpLockout)
+	if err := check("deletekey", "dev_db", alice, code(now)); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	if _, err := postTOTPHandler(m, machine, nil); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("expected machines to be refused enrollment, got %+v", err)
+	}
+}
+
+func TestStepUpRoute(t *testing.T) {
+	s, err := NewStepUp(StepUpConfig{Store: NewTempTOTPStore(), Rules: []StepUpRule{{RouteID: "mockroute"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStepUp(s)
+	defer SetStepUp(nil)
+
+	route := mockRoute()
+	route.Id = "mockroute"
+	h := Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil)(route.ServeHTTP)
+	r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+	r.Header.Set("Authorization", "0utoken")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), knox.StepUpHeader) {
+		t.Fatalf("expected step-up to be demanded, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStepUpDisabled(t *testing.T) {
+	m, _ := makeDB()
+	if _, err := postTOTPHandler(m, auth.NewUser("alice", nil), nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("expected not implemented, got %+v", err)
+	}
+}
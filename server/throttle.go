@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/sha256"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/internal/bounded"
+)
+
+// maxThrottleEntries bounds the memory used by each AuthThrottle counter.
+const maxThrottleEntries = 10000
+
+// authThrottleMetrics counts authentication failures and the requests refused
+// because their source or credential was locked out.
+var authThrottleMetrics = expvar.NewMap("knox_auth_throttle")
+
+// AuthThrottleConfig configures an AuthThrottle.
+type AuthThrottleConfig struct {
+	// MaxSourceFailures is the number of failures from one client address
+	// before it is locked out. Defaults to 100, as many clients may share an
+	// address behind NAT.
+	MaxSourceFailures int
+
+	// MaxCredentialFailures is the number of failures with one credential
+	// before it is locked out. Defaults to 5.
+	MaxCredentialFailures int
+
+	// Window is how long failures are remembered. Defaults to ten minutes.
+	Window time.Duration
+
+	// BaseLockout is the first lockout, which doubles with every further
+	// failure. Defaults to one second.
+	BaseLockout time.Duration
+
+	// MaxLockout caps the lockout. Defaults to fifteen minutes.
+	MaxLockout time.Duration
+}
+
+// AuthThrottle locks out client addresses and credentials that repeatedly
+// fail authentication, so that token guessing and misconfigured clients are
+// told to back off. Locked out sources and credentials are refused before
+// any provider runs, so a lockout holds even against valid credentials and
+// guesses cannot be checked while it lasts. Source limits are therefore set
+// high, as clients sharing an address with a misbehaving client are refused
+// too.
+type AuthThrottle struct {
+	cfg  AuthThrottleConfig
+	time func() time.Time
+
+	mu          sync.Mutex
+	sources     map[string]*failureRecord
+	credentials map[[sha256.Size]byte]*failureRecord
+}
+
+type failureRecord struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// NewAuthThrottle builds an AuthThrottle from the given configuration.
+func NewAuthThrottle(cfg AuthThrottleConfig) *AuthThrottle {
+	if cfg.MaxSourceFailures <= 0 {
+		cfg.MaxSourceFailures = 100
+	}
+	if cfg.MaxCredentialFailures <= 0 {
+		cfg.MaxCredentialFailures = 5
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Minute
+	}
+	if cfg.BaseLockout <= 0 {
+		cfg.BaseLockout = time.Second
+	}
+	if cfg.MaxLockout <= 0 {
+		cfg.MaxLockout = 15 * time.Minute
+	}
+	return &AuthThrottle{
+		cfg:         cfg,
+		time:        time.Now,
+		sources:     map[string]*failureRecord{},
+		credentials: map[[sha256.Size]byte]*failureRecord{},
+	}
+}
+
+var authThrottle *AuthThrottle
+
+// SetAuthThrottle throttles authentication failures in the Authentication
+// decorator. A nil throttle disables throttling.
+func SetAuthThrottle(t *AuthThrottle) {
+	authThrottle = t
+}
+
+// throttleKeys identifies the source and the credentials of a request. The
+// credentials are hashed so that they are not kept in memory.
+//
+// Certificate based providers are identified by a public token, such as a
+// hostname, that anyone can send. The verified client certificate is part of
+// the credential so that requests forging the token lock out only themselves.
+func throttleKeys(r *http.Request, providers []auth.Provider) (string, [sha256.Size]byte) {
+	source := r.RemoteAddr
+	if ip := clientIP(r); ip != nil {
+		source = ip.String()
+	}
+	h := sha256.New()
+	h.Write([]byte(r.Header.Get("Authorization")))
+	h.Write([]byte{0})
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		fingerprint := sha256.Sum256(r.TLS.VerifiedChains[0][0].Raw)
+		h.Write(fingerprint[:])
+	}
+	for _, p := range providers {
+		if hp, ok := p.(auth.HeaderProvider); ok {
+			h.Write([]byte{0})
+			h.Write([]byte(r.Header.Get(hp.Header())))
+		}
+	}
+	var credential [sha256.Size]byte
+	copy(credential[:], h.Sum(nil))
+	return source, credential
+}
+
+// blocked returns how long the source or credential remains locked out, or
+// zero if neither is.
+func (t *AuthThrottle) blocked(source string, credential [sha256.Size]byte) time.Duration {
+	now := t.time()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rec, ok := t.sources[source]; ok && now.Before(rec.lockedUntil) {
+		authThrottleMetrics.Add("blocked_source", 1)
+		return rec.lockedUntil.Sub(now)
+	}
+	if rec, ok := t.credentials[credential]; ok && now.Before(rec.lockedUntil) {
+		authThrottleMetrics.Add("blocked_credential", 1)
+		return rec.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail records an authentication failure for the source and credential.
+func (t *AuthThrottle) fail(source string, credential [sha256.Size]byte) {
+	now := t.time()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	authThrottleMetrics.Add("failures", 1)
+	t.sources = recordFailure(t.sources, source, t.cfg.MaxSourceFailures, t.cfg, now)
+	t.credentials = recordFailure(t.credentials, credential, t.cfg.MaxCredentialFailures, t.cfg, now)
+}
+
+// succeed forgets the failures of a credential that has authenticated. The
+// source's failures are kept, as they may have come from other clients.
+func (t *AuthThrottle) succeed(credential [sha256.Size]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.credentials, credential)
+}
+
+func recordFailure[K comparable](records map[K]*failureRecord, k K, max int, cfg AuthThrottleConfig, now time.Time) map[K]*failureRecord {
+	rec, ok := records[k]
+	if ok && rec.expired(cfg.Window, now) {
+		ok = false
+	}
+	if !ok {
+		// Existing lockouts are kept rather than dropped for new entries.
+		if !bounded.MakeRoom(records, maxThrottleEntries, func(v *failureRecord) bool { return v.expired(cfg.Window, now) }) {
+			return records
+		}
+		rec = &failureRecord{}
+		records[k] = rec
+	}
+	rec.failures++
+	rec.last = now
+	if rec.failures >= max {
+		lockout := cfg.MaxLockout
+		if shift := rec.failures - max; shift < 32 {
+			if d := cfg.BaseLockout << uint(shift); d > 0 && d < lockout {
+				lockout = d
+			}
+		}
+		rec.lockedUntil = now.Add(lockout)
+		authThrottleMetrics.Add("lockouts", 1)
+	}
+	return records
+}
+
+// expired reports whether the record no longer affects requests.
+func (rec *failureRecord) expired(window time.Duration, now time.Time) bool {
+	return now.Sub(rec.last) > window && !now.Before(rec.lockedUntil)
+}
+
+// retryAfter formats d for the Retry-After header, in whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
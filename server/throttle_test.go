@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestAuthThrottle(t *testing.T) {
+	now := time.Now()
+	throttle := NewAuthThrottle(AuthThrottleConfig{MaxCredentialFailures: 2, MaxSourceFailures: 4})
+	throttle.time = func() time.Time { return now }
+	SetAuthThrottle(throttle)
+	defer SetAuthThrottle(nil)
+
+	h := Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil)(func(w http.ResponseWriter, r *http.Request) {})
+	do := func(source, token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+		r.RemoteAddr = source + ":1234"
+		if token != "" {
+			r.Header.Set("Authorization", "0u"+token)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	// Requests without credentials are not counted.
+	for i := 0; i < 10; i++ {
+		if w := do("10.0.0.1", ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected unauthenticated, got %d", w.Code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("10.0.0.1", "notvalid"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected unauthenticated, got %d", w.Code)
+		}
+	}
+	blocked := authThrottleMetrics.Get("blocked_credential")
+	w := do("10.0.0.2", "notvalid")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected credential to be locked out, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if authThrottleMetrics.Get("blocked_credential") == blocked {
+		t.Fatal("expected blocked attempts to be counted")
+	}
+	if w := do("10.0.0.1", "token"); w.Code != http.StatusOK {
+		t.Fatalf("expected other credentials from the source to work, got %d", w.Code)
+	}
+
+	// Every further failure doubles the lockout.
+	now = now.Add(2 * time.Second)
+	do("10.0.0.2", "notvalid")
+	if w := do("10.0.0.2", "notvalid"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected a doubled lockout, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Failures outside the window are forgotten, so 10.0.0.1 never reaches
+	// its limit of four.
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		do("10.0.0.1", "notvalid")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		do("10.0.0.1", "notvalid")
+	}
+	if d := throttle.blocked("10.0.0.1", [32]byte{}); d != 0 {
+		t.Fatalf("expected source not to be locked out, got %s", d)
+	}
+}
+
+func TestAuthThrottleSource(t *testing.T) {
+	now := time.Now()
+	throttle := NewAuthThrottle(AuthThrottleConfig{MaxCredentialFailures: 100, MaxSourceFailures: 3})
+	throttle.time = func() time.Time { return now }
+	SetAuthThrottle(throttle)
+	defer SetAuthThrottle(nil)
+
+	h := Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil)(func(w http.ResponseWriter, r *http.Request) {})
+	do := func(source, token string) int {
+		r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+		r.RemoteAddr = source + ":1234"
+		r.Header.Set("Authorization", "0u"+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		do("10.0.0.1", "notvalid")
+	}
+	if code := do("10.0.0.1", "notvalid"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected source to be locked out, got %d", code)
+	}
+	// The lockout is checked before authentication, so it holds for valid
+	// credentials too.
+	if code := do("10.0.0.1", "token"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected valid credentials to be refused from a locked out source, got %d", code)
+	}
+	if code := do("10.0.0.3", "notvalid"); code != http.StatusUnauthorized {
+		t.Fatalf("expected other sources not to be locked out, got %d", code)
+	}
+	now = now.Add(2 * time.Second)
+	if code := do("10.0.0.1", "notvalid"); code != http.StatusUnauthorized {
+		t.Fatalf("expected lockout to end, got %d", code)
+	}
+	if HTTPErrMap[knox.TooManyRequestsCode].Code != http.StatusTooManyRequests {
+		t.Fatal("expected TooManyRequestsCode to map to 429")
+	}
+}
+
+// countingProvider authenticates every token unless fail is set, and counts
+// how often it is called.
+type countingProvider struct {
+	fail  bool
+	calls int
+}
+
+func (p *countingProvider) Name() string  { return "counting" }
+func (p *countingProvider) Version() byte { return '0' }
+func (p *countingProvider) Type() byte    { return 'u' }
+
+func (p *countingProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	p.calls++
+	if p.fail {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return auth.NewUser(token, nil), nil
+}
+
+func TestAuthThrottleBeforeProviders(t *testing.T) {
+	now := time.Now()
+	throttle := NewAuthThrottle(AuthThrottleConfig{MaxCredentialFailures: 2})
+	throttle.time = func() time.Time { return now }
+	SetAuthThrottle(throttle)
+	defer SetAuthThrottle(nil)
+
+	p := &countingProvider{fail: true}
+	h := Authentication([]auth.Provider{p}, nil)(func(w http.ResponseWriter, r *http.Request) {})
+	do := func() *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", "0utoken")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := do(); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected unauthenticated, got %d", w.Code)
+		}
+	}
+
+	// The credential is now valid, but it stays locked out and the provider
+	// is not asked to check it.
+	p.fail = false
+	calls := p.calls
+	w := do()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a locked out credential to be refused, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if p.calls != calls {
+		t.Fatal("expected the provider not to be called during a lockout")
+	}
+
+	now = now.Add(2 * time.Second)
+	if w := do(); w.Code != http.StatusOK {
+		t.Fatalf("expected the credential to work once the lockout ends, got %d", w.Code)
+	}
+}
+
+func TestThrottleKeysCertificate(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v0/keys/", nil)
+	r.Header.Set("Authorization", "0thost01")
+	_, forged := throttleKeys(r, nil)
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Raw: []byte("host01 certificate")}}}}
+	_, verified := throttleKeys(r, nil)
+	if forged == verified {
+		t.Fatal("expected the verified certificate to be part of the credential")
+	}
+}